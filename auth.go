@@ -0,0 +1,121 @@
+package sites
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/moisespsena-go/maps"
+	"github.com/moisespsena-go/stringvar"
+
+	"github.com/ecletus/core"
+)
+
+const AuthConfigKey = "auth"
+
+// authLegacyKeys are the auth keys of the config version 0, by lower case name.
+var authLegacyKeys = map[string]string{
+	"userregistration":  "user_registration",
+	"socialauthenabled": "social_auth_enabled",
+	"socialauth":        "social_auth",
+}
+
+// normalizeAuthKeys renames the legacy auth keys of the config not upgraded yet.
+func normalizeAuthKeys(siteName string, auth maps.MapSI) {
+	for _, key := range sortedKeys(auth) {
+		if name, ok := authLegacyKeys[strings.ToLower(key)]; ok {
+			if _, exists := auth[name]; !exists {
+				auth[name] = auth[key]
+			}
+			delete(auth, key)
+			log.Warningf("[%s] config: deprecated key %s.%s, use %s.%s. Run `config upgrade` to rewrite the config files.",
+				siteName, AuthConfigKey, key, AuthConfigKey, name)
+		}
+	}
+}
+
+// PrepareAuthConfig prepares the `auth` key of the site raw config: renames
+// the legacy keys and expands the args in the client credentials of the
+// social providers. The key is kept as a map.
+func PrepareAuthConfig(raw maps.MapSI, siteName string, args *stringvar.StringVar) (err error) {
+	auth, ok := configMap(raw[AuthConfigKey])
+	if !ok {
+		return
+	}
+	raw[AuthConfigKey] = auth
+	normalizeAuthKeys(siteName, auth)
+	social, ok := configMap(auth["social_auth"])
+	if !ok {
+		return
+	}
+	auth["social_auth"] = social
+	var providers []maps.MapSI
+	for _, name := range []string{"github", "google"} {
+		if provider, ok := configMap(social[name]); ok {
+			social[name] = provider
+			providers = append(providers, provider)
+		}
+	}
+	if oidc, ok := configMap(social["oidc"]); ok {
+		social["oidc"] = oidc
+		for _, name := range sortedKeys(oidc) {
+			if provider, ok := configMap(oidc[name]); ok {
+				oidc[name] = provider
+				providers = append(providers, provider)
+			}
+		}
+	}
+	if args == nil {
+		return
+	}
+	for _, provider := range providers {
+		for _, key := range []string{"client_id", "client_secret"} {
+			if v, ok := provider[key].(string); ok {
+				provider[key] = args.Format(v)
+			}
+		}
+	}
+	return
+}
+
+func configMap(value interface{}) (maps.MapSI, bool) {
+	switch t := value.(type) {
+	case maps.MapSI:
+		return t, true
+	case map[string]interface{}:
+		return maps.MapSI(t), true
+	}
+	return nil, false
+}
+
+var authConfigs sync.Map
+
+// SiteAuthConfig returns the auth config of the site. If not defined, returns
+// a zero config. The config is decoded once per site.
+func SiteAuthConfig(site *core.Site) (*AuthConfig, error) {
+	if v, ok := authConfigs.Load(site); ok {
+		return v.(*AuthConfig), nil
+	}
+	var raw = maps.MapSI{}
+	if auth, ok := configMap(SiteRawConfig(site)[AuthConfigKey]); ok {
+		// a copy: the site raw config is shared by the requests
+		copied := maps.MapSI{}
+		for key, value := range auth {
+			copied[key] = value
+		}
+		normalizeAuthKeys(site.Name(), copied)
+		raw[AuthConfigKey] = copied
+	}
+	cfg := &AuthConfig{}
+	if _, err := DecodeConfigKey(raw, AuthConfigKey, cfg); err != nil {
+		return nil, fmt.Errorf("decode auth config: %v", err)
+	}
+	cfg.Prepare(site.Name(), nil)
+	v, _ := authConfigs.LoadOrStore(site, cfg)
+	return v.(*AuthConfig), nil
+}
+
+// ForgetAuthConfig drops the decoded auth config of the site.
+func ForgetAuthConfig(site *core.Site) {
+	authConfigs.Delete(site)
+}
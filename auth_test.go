@@ -0,0 +1,45 @@
+package sites
+
+import (
+	"testing"
+
+	"github.com/moisespsena-go/maps"
+)
+
+func TestPrepareAuthConfigKeepsTheMap(t *testing.T) {
+	raw := maps.MapSI{
+		AuthConfigKey: maps.MapSI{
+			"UserRegistration":  true,
+			"socialAuthEnabled": true,
+			"social_auth": maps.MapSI{
+				"github": maps.MapSI{"client_id": "id", "client_secret": "secret"},
+			},
+		},
+	}
+	if err := PrepareAuthConfig(raw, "shop", nil); err != nil {
+		t.Fatal(err)
+	}
+	auth, ok := raw[AuthConfigKey].(maps.MapSI)
+	if !ok {
+		t.Fatalf("auth replaced by %T", raw[AuthConfigKey])
+	}
+	if auth["user_registration"] != true || auth["social_auth_enabled"] != true {
+		t.Errorf("legacy keys not renamed: %v", auth)
+	}
+	if _, ok := auth["UserRegistration"]; ok {
+		t.Error("legacy key kept")
+	}
+
+	var cfg AuthConfig
+	if _, err := DecodeConfigKey(raw, AuthConfigKey, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Prepare("shop", nil)
+	if !cfg.UserRegistration || !cfg.SocialAuthEnabled {
+		t.Errorf("decoded config = %+v", cfg)
+	}
+	providers := cfg.SocialProviders()
+	if len(providers) != 1 || providers[0].ProviderName() != "shop/github" {
+		t.Fatalf("providers = %v", providers)
+	}
+}
@@ -0,0 +1,547 @@
+package sites
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ecletus/core"
+	"github.com/ecletus/core/db/dbconfig"
+	"github.com/moisespsena-go/maps"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ecletus/sites/dir_config"
+)
+
+// The entries of the backup archive.
+const (
+	BackupManifestFile = "manifest.json"
+	BackupConfigFile   = "config.yaml"
+	BackupDBDir        = "db"
+	BackupDataDir      = "data"
+)
+
+// BackupVersion is the version of the backup archive format.
+const BackupVersion = 1
+
+type BackupDB struct {
+	Name    string `json:"name"`
+	Adapter string `json:"adapter"`
+	File    string `json:"file"`
+	// Isolation the isolation of the site in the DB, if shared. Only its
+	// schema or tables are dumped.
+	Isolation *DBIsolation `json:"isolation,omitempty"`
+}
+
+// BackupManifest describes the content of the backup archive.
+type BackupManifest struct {
+	Version   int        `json:"version"`
+	Site      string     `json:"site"`
+	CreatedAt time.Time  `json:"created_at"`
+	DBs       []BackupDB `json:"dbs"`
+	// Checksums the sha256 of each entry of the archive, but the manifest
+	Checksums map[string]string `json:"checksums"`
+}
+
+// SiteFactory creates (without registering) a site from its raw config, merged
+// over the site template and not yet prepared.
+type SiteFactory func(siteName string, cfg maps.MapSI) (*core.Site, error)
+
+// Backups writes and restores the sites backup archives. The archive is a
+// gzipped tar with the site config (its secrets are kept as references), a
+// logical dump of each DB, the site data dir (but tmp and cache) and a
+// manifest with the checksums.
+type Backups struct {
+	Config      *Config
+	Register    *core.SitesRegister
+	SiteFactory SiteFactory
+}
+
+func NewBackups(config *Config, register *core.SitesRegister, siteFactory SiteFactory) *Backups {
+	return &Backups{Config: config, Register: register, SiteFactory: siteFactory}
+}
+
+// Backup writes the backup archive of the site to w.
+func (this *Backups) Backup(ctx context.Context, site *core.Site, w io.Writer) (err error) {
+	var (
+		gz       = gzip.NewWriter(w)
+		tw       = tar.NewWriter(gz)
+		manifest = &BackupManifest{
+			Version:   BackupVersion,
+			Site:      site.Name(),
+			CreatedAt: time.Now().UTC(),
+			Checksums: map[string]string{},
+		}
+		cfg  maps.MapSI
+		data []byte
+	)
+
+	// the site config as written by the user: not merged, not expanded and with
+	// the secrets as references
+	var ok bool
+	if cfg, ok = this.Config.Sites[site.Name()].(maps.MapSI); !ok {
+		return fmt.Errorf("site %q: config not found", site.Name())
+	}
+	if data, err = yaml.Marshal(cfg); err != nil {
+		return fmt.Errorf("encode config: %v", err)
+	}
+	if err = addBackupEntry(tw, manifest, BackupConfigFile, int64(len(data)), strings.NewReader(string(data))); err != nil {
+		return
+	}
+
+	if err = site.EachDB(func(DB *core.DB) (err error) {
+		dbCfg := site.Config().Db[DB.Name]
+		if dbCfg == nil {
+			return fmt.Errorf("DB %q: config not found", DB.Name)
+		}
+		dumper := GetDBDumper(dbCfg.Adapter)
+		if dumper == nil {
+			return fmt.Errorf("DB %q: no dumper of the adapter %q", DB.Name, dbCfg.Adapter)
+		}
+		var isolation *DBIsolation
+		if isolation, err = SiteIsolation(site, DB.Name); err != nil {
+			return fmt.Errorf("DB %q: %v", DB.Name, err)
+		}
+		if isolation != nil {
+			isolation.Exclude = this.excludes(site.Name(), dbCfg, isolation)
+		}
+		var f *os.File
+		if f, err = ioutil.TempFile("", "site-backup-*.sql"); err != nil {
+			return
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if err = dumper.Dump(ctx, dbCfg, isolation, f); err != nil {
+			return fmt.Errorf("DB %q: dump: %v", DB.Name, err)
+		}
+		var info os.FileInfo
+		if info, err = f.Stat(); err != nil {
+			return
+		}
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+		entry := BackupDB{DB.Name, dbCfg.Adapter, path.Join(BackupDBDir, DB.Name+".sql"), isolation}
+		manifest.DBs = append(manifest.DBs, entry)
+		return addBackupEntry(tw, manifest, entry.File, info.Size(), f)
+	}); err != nil {
+		return
+	}
+
+	root := this.Config.SiteDirs(site.Name()).Root
+	if err = filepath.Walk(root, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, _ := filepath.Rel(root, pth)
+		if info.IsDir() {
+			if rel == SiteDirTmp || rel == SiteDirCache {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(pth)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return addBackupEntry(tw, manifest, path.Join(BackupDataDir, filepath.ToSlash(rel)), info.Size(), f)
+	}); err != nil {
+		return
+	}
+
+	if data, err = json.MarshalIndent(manifest, "", "  "); err != nil {
+		return
+	}
+	if err = tw.WriteHeader(&tar.Header{Name: BackupManifestFile, Mode: 0644, Size: int64(len(data)), ModTime: manifest.CreatedAt}); err != nil {
+		return
+	}
+	if _, err = tw.Write(data); err != nil {
+		return
+	}
+	if err = tw.Close(); err != nil {
+		return
+	}
+	return gz.Close()
+}
+
+func addBackupEntry(tw *tar.Writer, manifest *BackupManifest, name string, size int64, r io.Reader) (err error) {
+	if err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: manifest.CreatedAt}); err != nil {
+		return
+	}
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(tw, h), r); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	manifest.Checksums[name] = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+// Restore restores the backup archive and registers the site. If newName is
+// not blank, the site is restored with it: the DB names derived from the
+// archived site name are derived from the new name and the DBs are created
+// before restoring them. The DBs shared with other sites are not created: the
+// schema or the tables of the site isolation are restored into them, renamed
+// to the isolation of the new site. The site config is saved to
+// Config.SiteConfigFile. On failure, the created DBs, isolations, data dir and
+// config are removed.
+func (this *Backups) Restore(ctx context.Context, r io.Reader, newName string) (site *core.Site, err error) {
+	if this.SiteFactory == nil {
+		return nil, fmt.Errorf("restore: site factory is not configured")
+	}
+	var dir string
+	if dir, err = ioutil.TempDir("", "site-restore-"); err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	var manifest *BackupManifest
+	if manifest, err = extractBackup(r, dir); err != nil {
+		return
+	}
+	siteName := manifest.Site
+	if newName != "" {
+		siteName = newName
+	}
+	if err = ValidateSiteName(siteName); err != nil {
+		return
+	}
+	if this.Register.Has(siteName) {
+		return nil, fmt.Errorf("site %q already exists", siteName)
+	}
+	dirs := this.Config.SiteDirs(siteName)
+	if entries, _ := ioutil.ReadDir(dirs.Root); len(entries) > 0 {
+		return nil, fmt.Errorf("site %q: data dir %q is not empty", siteName, dirs.Root)
+	}
+
+	var (
+		data []byte
+		raw  map[string]interface{}
+	)
+	if data, err = ioutil.ReadFile(filepath.Join(dir, BackupConfigFile)); err != nil {
+		return
+	}
+	if err = yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("decode config: %v", err)
+	}
+	stored := dir_config.Normalize(raw).(maps.MapSI)
+	renamed := siteName != manifest.Site
+	if renamed {
+		// the shared DBs keep their names
+		shared := map[string]bool{}
+		for _, entry := range manifest.DBs {
+			shared[entry.Name] = entry.Isolation != nil
+		}
+		if err = renameDBNames(stored, manifest.Site, siteName, shared); err != nil {
+			return nil, fmt.Errorf("site %q: %v", siteName, err)
+		}
+	}
+
+	// the undo funcs of the steps done, run in reverse order on failure
+	var undo []func()
+	defer func() {
+		if err != nil {
+			for i := len(undo) - 1; i >= 0; i-- {
+				undo[i]()
+			}
+		}
+	}()
+
+	var undoConfig func()
+	if undoConfig, err = this.Config.AddSiteConfig(siteName, stored); err != nil {
+		return
+	}
+	undo = append(undo, undoConfig)
+
+	var cfg maps.MapSI
+	if cfg, err = this.Config.MergeSiteConfig(siteName); err != nil {
+		return
+	}
+	// the factory resolves the secrets of cfg
+	if site, err = this.SiteFactory(siteName, cfg); err != nil {
+		return
+	}
+
+	for _, entry := range manifest.DBs {
+		dbCfg := site.Config().Db[entry.Name]
+		if dbCfg == nil {
+			return nil, fmt.Errorf("DB %q: config not found", entry.Name)
+		}
+		dumper := GetDBDumper(dbCfg.Adapter)
+		if dumper == nil {
+			return nil, fmt.Errorf("DB %q: no dumper of the adapter %q", entry.Name, dbCfg.Adapter)
+		}
+		var isolation *DBIsolation
+		if isolation, err = SiteIsolation(site, entry.Name); err != nil {
+			return nil, fmt.Errorf("DB %q: %v", entry.Name, err)
+		}
+		if (isolation == nil) != (entry.Isolation == nil) {
+			return nil, fmt.Errorf("DB %q: the isolation of the site differs from the archived one", entry.Name)
+		}
+		if user := this.dbUser(dbCfg, isolation); user != "" {
+			return nil, fmt.Errorf("DB %q: %q is used by the site %q", entry.Name, dbCfg.Name, user)
+		}
+		if isolation != nil {
+			// the DB is shared: only the isolation is restored
+			if dropper, ok := dumper.(DBIsolationDropper); ok {
+				undo = append(undo, func() {
+					if err := dropper.DropIsolation(context.Background(), dbCfg, isolation); err != nil {
+						log.Errorf("[%s] drop DB %q isolation of the failed restore: %v", siteName, dbCfg.Name, err)
+					}
+				})
+			}
+		} else if renamed {
+			creator, ok := dumper.(DBCreator)
+			if !ok {
+				return nil, fmt.Errorf("DB %q: the adapter %q can not create DBs", entry.Name, dbCfg.Adapter)
+			}
+			if err = creator.CreateDB(ctx, dbCfg); err != nil {
+				return nil, fmt.Errorf("DB %q: create %q: %v", entry.Name, dbCfg.Name, err)
+			}
+			undo = append(undo, func() {
+				if err := creator.DropDB(context.Background(), dbCfg); err != nil {
+					log.Errorf("[%s] drop DB %q of the failed restore: %v", siteName, dbCfg.Name, err)
+				}
+			})
+		}
+		if err = restoreDB(ctx, dumper, dbCfg, entry.Isolation, isolation, filepath.Join(dir, filepath.FromSlash(entry.File))); err != nil {
+			return nil, fmt.Errorf("DB %q: restore: %v", entry.Name, err)
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dirs.Root), 0755); err != nil {
+		return
+	}
+	if err = os.RemoveAll(dirs.Root); err != nil {
+		return
+	}
+	undo = append(undo, func() {
+		os.RemoveAll(dirs.Root)
+	})
+	if err = moveDir(filepath.Join(dir, BackupDataDir), dirs.Root); err != nil {
+		return nil, fmt.Errorf("restore data dir: %v", err)
+	}
+
+	if err = this.Register.Add(site); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// RestoreFile restores the backup archive file. See Restore.
+func (this *Backups) RestoreFile(ctx context.Context, pth, newName string) (site *core.Site, err error) {
+	var f *os.File
+	if f, err = os.Open(pth); err != nil {
+		return
+	}
+	defer f.Close()
+	return this.Restore(ctx, f, newName)
+}
+
+// renameDBNames replaces the old site name by the new one in the DB names of
+// the site config, but of the shared DBs. Returns error if a DB name is not
+// derived from the site name, as the restore would overwrite the DB of the
+// old site.
+func renameDBNames(cfg maps.MapSI, oldName, newName string, shared map[string]bool) error {
+	dbs, _ := cfg["db"].(maps.MapSI)
+	for _, key := range sortedKeys(dbs) {
+		db, ok := dbs[key].(maps.MapSI)
+		if !ok || shared[key] {
+			continue
+		}
+		name, ok := db["name"].(string)
+		if !ok || name == "" {
+			continue
+		}
+		if !strings.Contains(name, oldName) {
+			return fmt.Errorf("DB %q: the name %q is not derived from the site name %q: set the DB name of the new site", key, name, oldName)
+		}
+		db["name"] = strings.Replace(name, oldName, newName, -1)
+	}
+	return nil
+}
+
+// dbUser returns the name of the registered site that uses the DB of cfg. If
+// isolation is not nil, the sites of the DB with other isolations are not
+// users of the isolation.
+func (this *Backups) dbUser(cfg *dbconfig.DBConfig, isolation *DBIsolation) (siteName string) {
+	this.Register.ByName.Each(func(site *core.Site) error {
+		for dbName, other := range site.Config().Db {
+			if other.Adapter != cfg.Adapter || other.Host != cfg.Host || other.Port != cfg.Port || other.Name != cfg.Name {
+				continue
+			}
+			if isolation != nil {
+				if otherIsolation, err := SiteIsolation(site, dbName); err == nil && otherIsolation != nil && !otherIsolation.Overlaps(isolation) {
+					continue
+				}
+			}
+			siteName = site.Name()
+			return io.EOF
+		}
+		return nil
+	})
+	return
+}
+
+// excludes returns the table prefixes of the other registered sites of the
+// DB of cfg, longer than the table prefix of the isolation and starting with
+// it, whose tables are not of the isolation.
+func (this *Backups) excludes(siteName string, cfg *dbconfig.DBConfig, isolation *DBIsolation) (prefixes []string) {
+	if isolation.Strategy != IsolationTablePrefix {
+		return
+	}
+	this.Register.ByName.Each(func(site *core.Site) error {
+		if site.Name() == siteName {
+			return nil
+		}
+		for dbName, other := range site.Config().Db {
+			if other.Adapter != cfg.Adapter || other.Host != cfg.Host || other.Port != cfg.Port || other.Name != cfg.Name {
+				continue
+			}
+			if otherIsolation, err := SiteIsolation(site, dbName); err == nil && otherIsolation != nil &&
+				otherIsolation.Strategy == IsolationTablePrefix && len(otherIsolation.Namespace) > len(isolation.Namespace) &&
+				strings.HasPrefix(otherIsolation.Namespace, isolation.Namespace) {
+				prefixes = append(prefixes, otherIsolation.Namespace)
+			}
+		}
+		return nil
+	})
+	sort.Strings(prefixes)
+	return
+}
+
+func restoreDB(ctx context.Context, dumper DBDumper, cfg *dbconfig.DBConfig, from, to *DBIsolation, pth string) error {
+	f, err := os.Open(pth)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return dumper.Restore(ctx, cfg, from, to, f)
+}
+
+// extractBackup extracts the archive into dir and verifies its checksums.
+func extractBackup(r io.Reader, dir string) (manifest *BackupManifest, err error) {
+	var gz *gzip.Reader
+	if gz, err = gzip.NewReader(r); err != nil {
+		return
+	}
+	defer gz.Close()
+
+	var (
+		tr        = tar.NewReader(gz)
+		checksums = map[string]string{}
+	)
+	for {
+		var hdr *tar.Header
+		if hdr, err = tr.Next(); err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if hdr.Name == BackupManifestFile {
+			manifest = &BackupManifest{}
+			if err = json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("decode manifest: %v", err)
+			}
+			continue
+		}
+		var pth string
+		if pth, err = SafeJoin(dir, filepath.FromSlash(hdr.Name)); err != nil {
+			return
+		}
+		if err = os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+			return
+		}
+		var f *os.File
+		if f, err = os.OpenFile(pth, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); err != nil {
+			return
+		}
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(f, h), tr)
+		f.Close()
+		if err != nil {
+			return
+		}
+		checksums[hdr.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("%s not found", BackupManifestFile)
+	}
+	if manifest.Version > BackupVersion {
+		return nil, fmt.Errorf("backup version %d is newer than the supported version %d", manifest.Version, BackupVersion)
+	}
+	var names []string
+	for name := range manifest.Checksums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if sum, ok := checksums[name]; !ok {
+			return nil, fmt.Errorf("%s: missing", name)
+		} else if sum != manifest.Checksums[name] {
+			return nil, fmt.Errorf("%s: checksum mismatch", name)
+		}
+		delete(checksums, name)
+	}
+	for name := range checksums {
+		return nil, fmt.Errorf("%s: not in the manifest", name)
+	}
+	return
+}
+
+// moveDir moves the dir src to dst, copying it if they are in different devices.
+func moveDir(src, dst string) (err error) {
+	if _, err = os.Stat(src); os.IsNotExist(err) {
+		return os.MkdirAll(dst, 0755)
+	}
+	if err = os.Rename(src, dst); err == nil {
+		return
+	}
+	return filepath.Walk(src, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, pth)
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		in, err := os.Open(pth)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
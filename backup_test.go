@@ -0,0 +1,185 @@
+package sites
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ecletus/core"
+	"github.com/ecletus/core/db/dbconfig"
+	"github.com/ecletus/core/site_config"
+	"github.com/moisespsena-go/maps"
+
+	"github.com/ecletus/sites/secrets"
+)
+
+func newTestBackups(t *testing.T) (backups *Backups, cleanup func()) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		DataDir: filepath.Join(dir, "data"),
+		Dir:     filepath.Join(dir, "config"),
+		Raw:     maps.MapSI{},
+		Sites: maps.MapSI{"a": maps.MapSI{
+			"vars": maps.MapSI{"title": "${env:BACKUP_TEST_TITLE}"},
+			"auth": maps.MapSI{"social_auth": maps.MapSI{"github": maps.MapSI{"client_secret": secrets.Ref("github/secret")}}},
+		}},
+	}
+	backups = NewBackups(config, &core.SitesRegister{}, func(siteName string, cfg maps.MapSI) (*core.Site, error) {
+		return newTestSite(siteName, cfg), nil
+	})
+	return backups, func() { os.RemoveAll(dir) }
+}
+
+func TestBackupRestoreAs(t *testing.T) {
+	os.Setenv("BACKUP_TEST_TITLE", "expanded")
+	defer os.Unsetenv("BACKUP_TEST_TITLE")
+	backups, cleanup := newTestBackups(t)
+	defer cleanup()
+
+	dirs := backups.Config.SiteDirs("a")
+	if err := dirs.Create(); err != nil {
+		t.Fatal(err)
+	}
+	pth, _ := dirs.Data("file.txt")
+	if err := ioutil.WriteFile(pth, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	ctx := context.Background()
+	if err := backups.Backup(ctx, newTestSite("a", nil), &archive); err != nil {
+		t.Fatal(err)
+	}
+	site, err := backups.Restore(ctx, &archive, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if site.Name() != "b" || !backups.Register.Has("b") {
+		t.Fatal("site b not registered")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(backups.Config.SiteDirs("b").Root, SiteDirData, "file.txt")); string(data) != "content" {
+		t.Errorf("restored file = %q", data)
+	}
+	data, err := ioutil.ReadFile(backups.Config.SiteConfigFile("b"))
+	if err != nil {
+		t.Fatalf("config not saved: %v", err)
+	}
+	for _, s := range []string{"${env:BACKUP_TEST_TITLE}", "!secret github/secret"} {
+		if !strings.Contains(string(data), s) {
+			t.Errorf("saved config without %q:\n%s", s, data)
+		}
+	}
+	if strings.Contains(string(data), "expanded") {
+		t.Errorf("saved config with the expanded value:\n%s", data)
+	}
+}
+
+func TestRestoreRollback(t *testing.T) {
+	backups, cleanup := newTestBackups(t)
+	defer cleanup()
+
+	var archive bytes.Buffer
+	ctx := context.Background()
+	if err := backups.Backup(ctx, newTestSite("a", nil), &archive); err != nil {
+		t.Fatal(err)
+	}
+	backups.SiteFactory = func(siteName string, cfg maps.MapSI) (*core.Site, error) {
+		return nil, fmt.Errorf("bad config")
+	}
+	if _, err := backups.Restore(ctx, &archive, "b"); err == nil {
+		t.Fatal("expected the factory error")
+	}
+	if _, ok := backups.Config.Sites["b"]; ok {
+		t.Error("config of the failed restore kept")
+	}
+	if _, err := os.Stat(backups.Config.SiteConfigFile("b")); !os.IsNotExist(err) {
+		t.Errorf("config file of the failed restore kept: %v", err)
+	}
+}
+
+func TestRenameDBNames(t *testing.T) {
+	cfg := maps.MapSI{"db": maps.MapSI{
+		"default": maps.MapSI{"name": "shop_a"},
+		"logs":    maps.MapSI{"adapter": "postgres"},
+	}}
+	if err := renameDBNames(cfg, "a", "b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if name := lookup(cfg, []string{"db", "default", "name"}); name != "shop_b" {
+		t.Errorf("name = %v", name)
+	}
+	cfg = maps.MapSI{"db": maps.MapSI{"default": maps.MapSI{"name": "shared"}}}
+	if err := renameDBNames(cfg, "a", "b", nil); err == nil {
+		t.Error("expected the error of the DB name not derived from the site name")
+	}
+	// the shared DBs of the isolated sites keep their names
+	if err := renameDBNames(cfg, "a", "b", map[string]bool{"default": true}); err != nil {
+		t.Fatal(err)
+	}
+	if name := lookup(cfg, []string{"db", "default", "name"}); name != "shared" {
+		t.Errorf("shared name = %v", name)
+	}
+}
+
+func TestDBUserIsolation(t *testing.T) {
+	backups, cleanup := newTestBackups(t)
+	defer cleanup()
+	shared := &dbconfig.DBConfig{Adapter: "postgres", Host: "db", Name: "shared"}
+	newSite := func(name string, raw maps.MapSI) *core.Site {
+		return core.NewSite(name, site_config.Config{Raw: raw, Db: map[string]*dbconfig.DBConfig{"default": shared}}, nil, nil)
+	}
+	prefixed := func(prefix string) maps.MapSI {
+		return maps.MapSI{IsolationConfigKey: maps.MapSI{"strategy": "table_prefix", "name": prefix}}
+	}
+	if err := backups.Register.Add(newSite("a", prefixed("a"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if user := backups.dbUser(shared, &DBIsolation{Strategy: IsolationTablePrefix, Namespace: "b_"}); user != "" {
+		t.Errorf("other isolation used by %q", user)
+	}
+	if user := backups.dbUser(shared, &DBIsolation{Strategy: IsolationTablePrefix, Namespace: "a_"}); user != "a" {
+		t.Errorf("same isolation used by %q", user)
+	}
+	if user := backups.dbUser(shared, nil); user != "a" {
+		t.Errorf("not isolated DB used by %q", user)
+	}
+
+	if err := backups.Register.Add(newSite("c", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if user := backups.dbUser(shared, &DBIsolation{Strategy: IsolationTablePrefix, Namespace: "b_"}); user != "c" {
+		t.Errorf("DB of a not isolated site used by %q", user)
+	}
+}
+
+func TestBackupsExcludes(t *testing.T) {
+	backups, cleanup := newTestBackups(t)
+	defer cleanup()
+	shared := &dbconfig.DBConfig{Adapter: "postgres", Host: "db", Name: "shared"}
+	for name, prefix := range map[string]string{"shop": "shop", "shop2": "shop_2", "blog": "blog"} {
+		raw := maps.MapSI{IsolationConfigKey: maps.MapSI{"strategy": "table_prefix", "name": prefix}}
+		site := core.NewSite(name, site_config.Config{Raw: raw, Db: map[string]*dbconfig.DBConfig{"default": shared}}, nil, nil)
+		if err := backups.Register.Add(site); err != nil {
+			t.Fatal(err)
+		}
+	}
+	isolation := &DBIsolation{Strategy: IsolationTablePrefix, Namespace: "shop_"}
+	if excludes := backups.excludes("shop", shared, isolation); len(excludes) != 1 || excludes[0] != "shop_2_" {
+		t.Errorf("excludes = %v", excludes)
+	}
+	if excludes := backups.excludes("shop", &dbconfig.DBConfig{Adapter: "postgres", Host: "db", Name: "other"}, isolation); len(excludes) != 0 {
+		t.Errorf("excludes of other DB = %v", excludes)
+	}
+	if excludes := backups.excludes("shop2", shared, &DBIsolation{Strategy: IsolationTablePrefix, Namespace: "shop_2_"}); len(excludes) != 0 {
+		t.Errorf("excludes of the longer prefix = %v", excludes)
+	}
+}
@@ -0,0 +1,210 @@
+package sites
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/ecletus/core"
+)
+
+type ACMEConfig struct {
+	// DirectoryURL of the ACME server. Defaults to Let's Encrypt production.
+	DirectoryURL string `mapstructure:"directory_url"`
+	Email        string `mapstructure:"email"`
+	// CARoots PEM file with the roots trusted to talk with the ACME server,
+	// used for local stand-ins like pebble.
+	CARoots string `mapstructure:"ca_roots"`
+}
+
+type TLSConfig struct {
+	// CertsDir holds the `HOST.crt` and `HOST.key` files of each host.
+	// Defaults to `SHARED_DATA_DIR/certs`.
+	CertsDir string      `mapstructure:"certs_dir"`
+	ACME     *ACMEConfig `mapstructure:"acme"`
+}
+
+// CertManager serves the certificates of the hosts registered on the sites
+// register, loading them from the certs dir or obtaining them from an ACME server.
+type CertManager struct {
+	Register *core.SitesRegister
+	Dir      string
+	ACME     *autocert.Manager
+
+	mu    sync.RWMutex
+	hosts map[string]string
+	certs map[string]*localCert
+}
+
+// localCert is a certificate loaded from the certs dir, with the modification
+// times of its files.
+type localCert struct {
+	cert           *tls.Certificate
+	crtMod, keyMod time.Time
+}
+
+func NewCertManager(register *core.SitesRegister, config *Config) (m *CertManager, err error) {
+	m = &CertManager{
+		Register: register,
+		Dir:      filepath.Join(config.SharedDataDir(), "certs"),
+		hosts:    map[string]string{},
+		certs:    map[string]*localCert{},
+	}
+	if config.TLS == nil {
+		return
+	}
+	if config.TLS.CertsDir != "" {
+		m.Dir = config.TLS.CertsDir
+	}
+	if cfg := config.TLS.ACME; cfg != nil {
+		m.ACME = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(filepath.Join(m.Dir, "acme")),
+			HostPolicy: m.hostPolicy,
+			Email:      cfg.Email,
+		}
+		if cfg.DirectoryURL != "" || cfg.CARoots != "" {
+			client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+			if cfg.CARoots != "" {
+				var pem []byte
+				if pem, err = ioutil.ReadFile(cfg.CARoots); err != nil {
+					return nil, fmt.Errorf("read ACME CA roots: %v", err)
+				}
+				pool := x509.NewCertPool()
+				if !pool.AppendCertsFromPEM(pem) {
+					return nil, fmt.Errorf("ACME CA roots %q: no certificates found", cfg.CARoots)
+				}
+				client.HTTPClient = &http.Client{Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{RootCAs: pool},
+				}}
+			}
+			m.ACME.Client = client
+		}
+	}
+	return
+}
+
+// Init registers the host hooks. Hosts added at runtime are served without restart.
+func (this *CertManager) Init() {
+	this.Register.OnHostAdd(func(site *core.Site, host string) {
+		host = normalizeHost(host)
+		this.mu.Lock()
+		this.hosts[host] = site.Name()
+		delete(this.certs, host)
+		this.mu.Unlock()
+	})
+	this.Register.OnHostDel(func(site *core.Site, host string) {
+		host = normalizeHost(host)
+		this.mu.Lock()
+		delete(this.hosts, host)
+		delete(this.certs, host)
+		this.mu.Unlock()
+	})
+}
+
+// Has reports whether host is registered.
+func (this *CertManager) Has(host string) bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	_, ok := this.hosts[normalizeHost(host)]
+	return ok
+}
+
+func (this *CertManager) hostPolicy(_ context.Context, host string) error {
+	if !this.Has(host) {
+		return fmt.Errorf("host %q is not registered", host)
+	}
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (this *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := normalizeHost(hello.ServerName)
+	if host == "" {
+		return nil, fmt.Errorf("missing server name")
+	}
+	if !this.Has(host) {
+		return nil, fmt.Errorf("host %q is not registered", host)
+	}
+
+	cert, err := this.loadLocal(host)
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil {
+		return cert, nil
+	}
+
+	if this.ACME != nil {
+		return this.ACME.GetCertificate(hello)
+	}
+	return nil, fmt.Errorf("no certificate for host %q", host)
+}
+
+// TLSConfig returns a tls.Config serving the managed certificates.
+func (this *CertManager) TLSConfig() *tls.Config {
+	cfg := &tls.Config{GetCertificate: this.GetCertificate}
+	if this.ACME != nil {
+		cfg.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	}
+	return cfg
+}
+
+// HTTPHandler handles the ACME HTTP-01 challenges, delegating other requests to fallback.
+func (this *CertManager) HTTPHandler(fallback http.Handler) http.Handler {
+	if this.ACME == nil {
+		return fallback
+	}
+	return this.ACME.HTTPHandler(fallback)
+}
+
+// loadLocal returns the certificate of the certs dir, or nil if not exists. The
+// certificate is reloaded when its files change.
+func (this *CertManager) loadLocal(host string) (*tls.Certificate, error) {
+	certFile, keyFile := filepath.Join(this.Dir, host+".crt"), filepath.Join(this.Dir, host+".key")
+	crtInfo, err := os.Stat(certFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	keyInfo, err := os.Stat(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate of host %q: %v", host, err)
+	}
+
+	this.mu.RLock()
+	cached := this.certs[host]
+	this.mu.RUnlock()
+	if cached != nil && cached.crtMod.Equal(crtInfo.ModTime()) && cached.keyMod.Equal(keyInfo.ModTime()) {
+		return cached.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate of host %q: %v", host, err)
+	}
+	this.mu.Lock()
+	this.certs[host] = &localCert{&cert, crtInfo.ModTime(), keyInfo.ModTime()}
+	this.mu.Unlock()
+	return &cert, nil
+}
+
+func normalizeHost(host string) string {
+	if pos := strings.LastIndexByte(host, ':'); pos >= 0 && !strings.HasSuffix(host, "]") {
+		host = host[:pos]
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,139 @@
+package sites
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCert(t *testing.T, dir, host string, serial int64, mod time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, keyFile := filepath.Join(dir, host+".crt"), filepath.Join(dir, host+".key")
+	if err = ioutil.WriteFile(crt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{crt, keyFile} {
+		if err = os.Chtimes(f, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func serialOf(t *testing.T, cert *tls.Certificate) int64 {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+func TestCertManagerReloadsRenewedCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &CertManager{Dir: dir, hosts: map[string]string{"a.example.com": "a"}, certs: map[string]*localCert{}}
+	hello := &tls.ClientHelloInfo{ServerName: "A.example.com"}
+
+	if _, err = m.GetCertificate(hello); err == nil {
+		t.Fatal("expected error without certificate")
+	}
+
+	now := time.Now().Truncate(time.Second)
+	writeTestCert(t, dir, "a.example.com", 1, now.Add(-time.Minute))
+	cert, err := m.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial := serialOf(t, cert); serial != 1 {
+		t.Fatalf("serial = %d, want 1", serial)
+	}
+
+	writeTestCert(t, dir, "a.example.com", 2, now)
+	if cert, err = m.GetCertificate(hello); err != nil {
+		t.Fatal(err)
+	}
+	if serial := serialOf(t, cert); serial != 2 {
+		t.Fatalf("renewed serial = %d, want 2", serial)
+	}
+
+	if _, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"}); err == nil {
+		t.Fatal("expected error for unregistered host")
+	}
+}
+
+// TestCertManagerPebble obtains a certificate from a pebble ACME server,
+// started with PEBBLE_VA_ALWAYS_VALID=1. It runs when PEBBLE_DIRECTORY_URL and
+// PEBBLE_CA_ROOTS (the pebble minica PEM) are set.
+func TestCertManagerPebble(t *testing.T) {
+	directoryURL, caRoots := os.Getenv("PEBBLE_DIRECTORY_URL"), os.Getenv("PEBBLE_CA_ROOTS")
+	if directoryURL == "" || caRoots == "" {
+		t.Skip("PEBBLE_DIRECTORY_URL and PEBBLE_CA_ROOTS are not set")
+	}
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := NewCertManager(nil, &Config{DataDir: dir, TLS: &TLSConfig{ACME: &ACMEConfig{
+		DirectoryURL: directoryURL,
+		CARoots:      caRoots,
+		Email:        "admin@example.com",
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.hosts["pebble.example.com"] = "pebble"
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:      "pebble.example.com",
+		SupportedProtos: []string{"h2"},
+		CipherSuites:    []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = leaf.VerifyHostname("pebble.example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
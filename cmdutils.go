@@ -2,16 +2,34 @@ package sites
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	errwrap "github.com/moisespsena-go/error-wrap"
 	"github.com/spf13/cobra"
 
 	"github.com/ecletus/core"
+	"github.com/ecletus/sites/dir_config"
+	"github.com/ecletus/sites/secrets"
 )
 
 type CmdUtils struct {
 	SitesRegister *core.SitesRegister
+	// Lazy initializes the lazy sites before run the commands
+	Lazy *LazySites
+	// Control if not nil, runs the commands that change the sites in the
+	// serving process, if any
+	Control *Control
+}
+
+func (cu *CmdUtils) ensure(site *core.Site) error {
+	if cu.Lazy == nil {
+		return nil
+	}
+	return cu.Lazy.Ensure(site)
 }
 
 func (cu *CmdUtils) Site(command *cobra.Command, run ...func(cmd *cobra.Command, site *core.Site, args []string) error) *cobra.Command {
@@ -29,7 +47,11 @@ func (cu *CmdUtils) Site(command *cobra.Command, run ...func(cmd *cobra.Command,
 	}
 	if len(run) == 1 {
 		command.RunE = func(cmd *cobra.Command, args []string) error {
-			return run[0](cmd, cu.SitesRegister.MustGet(args[0]), args[1:])
+			site := cu.SitesRegister.MustGet(args[0])
+			if err := cu.ensure(site); err != nil {
+				return errwrap.Wrap(err, "Site %q", site.Name())
+			}
+			return run[0](cmd, site, args[1:])
 		}
 	}
 
@@ -66,7 +88,10 @@ func (cu *CmdUtils) Sites(command *cobra.Command, run ...func(cmd *cobra.Command
 		}
 		command.RunE = func(cmd *cobra.Command, args []string) (err error) {
 			callSite := func(site *core.Site) error {
-				err := run[0](cmd, site, args)
+				err := cu.ensure(site)
+				if err == nil {
+					err = run[0](cmd, site, args)
+				}
 				if err != nil {
 					return errwrap.Wrap(err, "Site %q", site.Name())
 				}
@@ -103,7 +128,10 @@ func (cu *CmdUtils) Alone(command *cobra.Command, run ...func(cmd *cobra.Command
 		command.RunE = func(cmd *cobra.Command, args []string) (err error) {
 			site := cu.SitesRegister.Site()
 
-			if err = run[0](cmd, site, args); err != nil {
+			if err = cu.ensure(site); err == nil {
+				err = run[0](cmd, site, args)
+			}
+			if err != nil {
 				return errwrap.Wrap(err, "Site %q", site.Name())
 			}
 			return nil
@@ -111,3 +139,338 @@ func (cu *CmdUtils) Alone(command *cobra.Command, run ...func(cmd *cobra.Command
 	}
 	return command
 }
+
+// Maintenance creates the `maintenance` command, that puts sites into (or out of) maintenance.
+func (cu *CmdUtils) Maintenance(m *Maintenance) *cobra.Command {
+	set := func(enabled bool) func(cmd *cobra.Command, site *core.Site, args []string) error {
+		return func(cmd *cobra.Command, site *core.Site, args []string) error {
+			return m.Set(site.Name(), enabled)
+		}
+	}
+	setGlobal := func(enabled bool) func(cmd *cobra.Command, args []string) error {
+		return func(cmd *cobra.Command, args []string) error {
+			return m.SetGlobal(enabled)
+		}
+	}
+	global := &cobra.Command{
+		Use:   "global",
+		Short: "Put all sites into (or out of) maintenance",
+	}
+	global.AddCommand(
+		&cobra.Command{Use: "on", Short: "Enable the global maintenance", Args: cobra.NoArgs, RunE: setGlobal(true)},
+		&cobra.Command{Use: "off", Short: "Disable the global maintenance", Args: cobra.NoArgs, RunE: setGlobal(false)},
+	)
+	command := &cobra.Command{
+		Use:   "maintenance",
+		Short: "Manage the sites maintenance mode",
+	}
+	command.AddCommand(
+		cu.Sites(&cobra.Command{Use: "on", Short: "Put sites into maintenance"}, set(true)),
+		cu.Sites(&cobra.Command{Use: "off", Short: "Put sites out of maintenance"}, set(false)),
+		cu.Sites(&cobra.Command{Use: "status", Short: "Show the sites maintenance status"},
+			func(cmd *cobra.Command, site *core.Site, args []string) error {
+				status := "off"
+				if m.Enabled(site.Name()) {
+					status = "on"
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s: %s\n", site.Name(), status)
+				return nil
+			}),
+		global,
+	)
+	return command
+}
+
+// DiskUsage creates the `du` command, that reports the disk usage of the sites data dirs.
+func (cu *CmdUtils) DiskUsage(config *Config) *cobra.Command {
+	return cu.Sites(&cobra.Command{Use: "du", Short: "Show the disk usage of the sites data dirs"},
+		func(cmd *cobra.Command, site *core.Site, args []string) error {
+			usage, err := config.SiteDirs(site.Name()).Usage()
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(out, "%s: %s", site.Name(), FormatSize(usage.Total()))
+			for _, subDir := range SiteSubDirs {
+				fmt.Fprintf(out, "\t%s=%s", subDir, FormatSize(usage[subDir]))
+			}
+			fmt.Fprintln(out)
+			return nil
+		})
+}
+
+// Backup creates the `backup` command, that writes the backup archive of a site.
+func (cu *CmdUtils) Backup(backups *Backups) *cobra.Command {
+	var out string
+	command := cu.Site(&cobra.Command{Use: "backup", Short: "Write the backup archive of the site", Args: cobra.NoArgs},
+		func(cmd *cobra.Command, site *core.Site, args []string) (err error) {
+			pth := out
+			if pth == "" {
+				pth = site.Name() + "-" + time.Now().Format("20060102150405") + ".tar.gz"
+			}
+			var f *os.File
+			if f, err = os.Create(pth); err != nil {
+				return
+			}
+			if err = backups.Backup(cmd.Context(), site, f); err != nil {
+				f.Close()
+				os.Remove(pth)
+				return
+			}
+			if err = f.Close(); err == nil {
+				fmt.Fprintln(cmd.OutOrStdout(), pth)
+			}
+			return
+		})
+	command.Flags().StringVarP(&out, "out", "o", "", "the archive path. Defaults to SITE_NAME-TIMESTAMP.tar.gz")
+	return command
+}
+
+// Restore creates the `restore` command, that restores a site backup archive.
+func (cu *CmdUtils) Restore(backups *Backups) *cobra.Command {
+	var as string
+	command := &cobra.Command{
+		Use:   "restore ARCHIVE",
+		Short: "Restore the site of the backup archive",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			var pth, siteName string
+			if pth, err = filepath.Abs(args[0]); err != nil {
+				return
+			}
+			if err = cu.Control.Call(cmd.Context(), "restore", restoreArgs{pth, as}, &siteName); err == ErrNoControl {
+				var site *core.Site
+				if site, err = backups.RestoreFile(cmd.Context(), pth, as); err == nil {
+					siteName = site.Name()
+				}
+			}
+			if err == nil {
+				fmt.Fprintf(cmd.OutOrStdout(), "site %q restored\n", siteName)
+			}
+			return
+		},
+	}
+	command.Flags().StringVar(&as, "as", "", "restore the site with this name")
+	return command
+}
+
+// Clone creates the `clone` command, that copies a site with a new name.
+func (cu *CmdUtils) Clone(backups *Backups) *cobra.Command {
+	return cu.Site(&cobra.Command{Use: "clone NEW_NAME", Short: "Copy the site, its DBs and its data dir with a new name", Args: cobra.ExactArgs(1)},
+		func(cmd *cobra.Command, site *core.Site, args []string) (err error) {
+			if err = cu.Control.Call(cmd.Context(), "clone", renameArgs{site.Name(), args[0]}, nil); err == ErrNoControl {
+				_, err = backups.Clone(cmd.Context(), site, args[0])
+			}
+			if err == nil {
+				fmt.Fprintf(cmd.OutOrStdout(), "site %q cloned to %q\n", site.Name(), args[0])
+			}
+			return
+		})
+}
+
+// Rename creates the `rename` command, that renames a site.
+func (cu *CmdUtils) Rename(router *SitesRouter, factory SiteFactory) *cobra.Command {
+	return cu.Site(&cobra.Command{Use: "rename NEW_NAME", Short: "Rename the site", Args: cobra.ExactArgs(1)},
+		func(cmd *cobra.Command, site *core.Site, args []string) (err error) {
+			oldName := site.Name()
+			if err = cu.Control.Call(cmd.Context(), "rename", renameArgs{oldName, args[0]}, nil); err == ErrNoControl {
+				_, err = router.Rename(oldName, args[0], factory)
+			}
+			if err == nil {
+				fmt.Fprintf(cmd.OutOrStdout(), "site %q renamed to %q\n", oldName, args[0])
+			}
+			return
+		})
+}
+
+// DBPools creates the `db-pools` command, that shows the metrics of the shared
+// DB pools of the serving process. If no process serves, shows the pools of
+// this process.
+func (cu *CmdUtils) DBPools(pools *DBPools) *cobra.Command {
+	return &cobra.Command{
+		Use:   "db-pools",
+		Short: "Show the metrics of the shared DB pools",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			out := cmd.OutOrStdout()
+			var report DBPoolsReport
+			if err = cu.Control.Call(cmd.Context(), "db-pools", nil, &report); err == ErrNoControl {
+				if pools == nil {
+					return fmt.Errorf("the DB pools are not shared")
+				}
+				fmt.Fprintln(cmd.ErrOrStderr(), "no serving process: showing the pools of this process")
+				report, err = pools.Report(), nil
+			}
+			if err != nil {
+				return
+			}
+			for _, s := range report.Pools {
+				fmt.Fprintf(out, "%s\topen=%d\tin_use=%d\tidle=%d\twait_count=%d\twait=%s\tsites=%s\n",
+					s.Key, s.OpenConnections, s.InUse, s.Idle, s.WaitCount, s.WaitDuration, strings.Join(s.Sites, ","))
+				for _, siteName := range s.Sites {
+					ss := report.Sites[siteName]
+					fmt.Fprintf(out, "  %s\tlimit=%d\trequests=%d\twaits=%d\n", siteName, ss.Limit, ss.Requests, ss.Waits)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// Jobs creates the `jobs` command, that lists and runs the sites jobs.
+func (cu *CmdUtils) Jobs(scheduler *Scheduler) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "jobs",
+		Short: "Manage the sites jobs",
+	}
+	command.AddCommand(
+		cu.Sites(&cobra.Command{Use: "list", Short: "List the sites jobs"},
+			func(cmd *cobra.Command, site *core.Site, args []string) error {
+				out := cmd.OutOrStdout()
+				jobs, err := scheduler.Jobs(site)
+				if err != nil {
+					return err
+				}
+				for _, status := range jobs {
+					fmt.Fprintf(out, "%s: %s", site.Name(), status.Name)
+					if !status.NextRun.IsZero() {
+						fmt.Fprintf(out, "\tnext=%s", status.NextRun.Format(time.RFC3339))
+					}
+					if !status.LastRun.IsZero() {
+						fmt.Fprintf(out, "\tlast=%s (%s)", status.LastRun.Format(time.RFC3339), status.Duration)
+					}
+					if status.LastErr != nil {
+						fmt.Fprintf(out, "\terror=%v", status.LastErr)
+					}
+					fmt.Fprintln(out)
+				}
+				return nil
+			}),
+		cu.Sites(&cobra.Command{Use: "run JOB_NAME", Short: "Run a job on the sites now", Args: cobra.ExactArgs(1)},
+			func(cmd *cobra.Command, site *core.Site, args []string) error {
+				return scheduler.Trigger(site, args[0])
+			}),
+	)
+	return command
+}
+
+// Config creates the `config` command, that inspects the config tree of configDir.
+func (cu *CmdUtils) Config(configDir string, keyNamer ...func(dir, name string, isdir bool) string) *cobra.Command {
+	var (
+		dir     string
+		env     string
+		command = &cobra.Command{
+			Use:   "config",
+			Short: "Inspect the sites config",
+		}
+		load = func() (*Config, error) {
+			loader := dir_config.NewLoader(keyNamer...)
+			loader.Env = env
+			return LoadConfig(loader, dir)
+		}
+	)
+	command.PersistentFlags().StringVar(&dir, "dir", configDir, "the config directory")
+	command.PersistentFlags().StringVar(&env, "env", os.Getenv(dir_config.EnvVar), "the config environment overlay")
+	command.AddCommand(&cobra.Command{
+		Use:   "validate",
+		Short: "Validate the sites config and the config of each site",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			var config *Config
+			if config, err = load(); err != nil {
+				return
+			}
+			writeConflicts(cmd, config)
+			if err = ValidateConfig(config); err != nil {
+				return
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), "config is valid")
+			return nil
+		},
+	}, &cobra.Command{
+		Use:   "upgrade",
+		Short: "Rewrite the config files to the latest config version",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			loader := dir_config.NewLoader(keyNamer...)
+			loader.Env = env
+			changes, err := UpgradeConfigFiles(loader, dir, ConfigMigrations)
+			for _, change := range changes {
+				fmt.Fprintln(cmd.OutOrStdout(), change)
+			}
+			if err == nil && len(changes) == 0 {
+				fmt.Fprintln(cmd.OutOrStdout(), "config is up to date")
+			}
+			return
+		},
+	}, &cobra.Command{
+		Use:   "explain SITE_NAME",
+		Short: "Print the resolved config of the site with the file that set each value",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			var (
+				config  *Config
+				entries []ExplainEntry
+			)
+			if config, err = load(); err != nil {
+				return
+			}
+			if _, ok := config.Sites[args[0]]; !ok {
+				return fmt.Errorf("Site %q does not exists.\n", args[0])
+			}
+			if entries, err = config.ExplainSite(args[0]); err != nil {
+				return
+			}
+			if err = WriteExplain(cmd.OutOrStdout(), entries); err != nil {
+				return
+			}
+			writeConflicts(cmd, config)
+			return nil
+		},
+	}, &cobra.Command{
+		Use:   "secret-set PATH",
+		Short: "Encrypt the value read from the stdin into the secrets provider, as PATH",
+		Long: "Encrypt the value read from the stdin into the secrets provider, as PATH. " +
+			"Use it in the config files as `!secret PATH`.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			var (
+				config   *Config
+				provider secrets.Provider
+				value    []byte
+			)
+			loader := dir_config.NewLoader(keyNamer...)
+			loader.Env = env
+			if config, err = loadConfig(loader, dir, false); err != nil {
+				return
+			}
+			if provider, err = config.SecretsProvider(); err != nil {
+				return
+			} else if provider == nil {
+				return fmt.Errorf("no secrets provider configured")
+			}
+			setter, ok := provider.(secrets.Setter)
+			if !ok {
+				return fmt.Errorf("secrets provider %q does not store values", config.Secrets.Provider)
+			}
+			if value, err = ioutil.ReadAll(cmd.InOrStdin()); err != nil {
+				return
+			}
+			if err = setter.Set(args[0], strings.TrimSuffix(string(value), "\n")); err != nil {
+				return
+			}
+			if err = setter.Save(); err != nil {
+				return
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), secrets.Ref(args[0]))
+			return nil
+		},
+	})
+	return command
+}
+
+func writeConflicts(cmd *cobra.Command, config *Config) {
+	for _, conflict := range config.Conflicts {
+		fmt.Fprintln(cmd.ErrOrStderr(), "WARNING: conflict:", conflict)
+	}
+}
@@ -1,41 +1,68 @@
 package sites
 
 import (
+	"context"
+	"fmt"
 	"path/filepath"
+	"sort"
 
 	"github.com/ecletus/core/db/dbconfig"
+	"github.com/go-errors/errors"
 
+	"github.com/ecletus/sites/dir_config"
+	"github.com/ecletus/sites/secrets"
+
+	"github.com/mitchellh/mapstructure"
 	"github.com/moisespsena-go/maps"
 	"github.com/moisespsena-go/stringvar"
 )
 
 type SocialAuthConfig struct {
-	/*Github   *github.Config
-	Google   *google.Config
-	Facebook *facebook.Config
-	Twitter  *twitter.Config*/
+	Github *OAuth2ProviderConfig `mapstructure:"github"`
+	Google *OIDCProviderConfig   `mapstructure:"google"`
+	// OIDC generic OpenID Connect providers by name
+	OIDC map[string]*OIDCProviderConfig `mapstructure:"oidc"`
 }
 
 func (s *SocialAuthConfig) Prepare(siteName string, args *stringvar.StringVar) {
-	/*if s.Github != nil {
-		s.Github.Name = siteName + "/" + s.Github.GetDefaultName()
+	if s.Github != nil {
+		s.Github.Prepare(siteName, "github", args)
+		s.Github.setDefaults(githubEndpoint)
 	}
 	if s.Google != nil {
-		s.Google.Name = siteName + "/" + s.Google.GetDefaultName()
+		if s.Google.Issuer == "" {
+			s.Google.Issuer = GoogleIssuer
+		}
+		s.Google.Prepare(siteName, "google", args)
 	}
-	if s.Facebook != nil {
-		s.Facebook.Name = siteName + "/" + s.Facebook.GetDefaultName()
+	for name, cfg := range s.OIDC {
+		cfg.Prepare(siteName, name, args)
 	}
-	if s.Twitter != nil {
-		s.Twitter.Name = siteName + "/" + s.Twitter.GetDefaultName()
+}
+
+// Providers returns the configured providers, sorted by name.
+func (s *SocialAuthConfig) Providers() (providers []SocialProvider) {
+	if s.Github != nil {
+		providers = append(providers, s.Github)
+	}
+	if s.Google != nil {
+		providers = append(providers, s.Google)
 	}
-	*/
+	for _, cfg := range s.OIDC {
+		providers = append(providers, cfg)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].ProviderName() < providers[j].ProviderName()
+	})
+	return
 }
 
 type AuthConfig struct {
-	UserRegistration  bool
-	SocialAuthEnabled bool
-	SocialAuth        *SocialAuthConfig
+	UserRegistration  bool              `mapstructure:"user_registration"`
+	SocialAuthEnabled bool              `mapstructure:"social_auth_enabled"`
+	SocialAuth        *SocialAuthConfig `mapstructure:"social_auth"`
+	// Registration policy. Overrides UserRegistration.
+	Registration *RegistrationPolicy `mapstructure:"registration"`
 }
 
 func (s *AuthConfig) Prepare(siteName string, args *stringvar.StringVar) {
@@ -44,11 +71,26 @@ func (s *AuthConfig) Prepare(siteName string, args *stringvar.StringVar) {
 	}
 }
 
+// SocialProviders returns the social auth providers, or nil if the social auth is disabled.
+func (s *AuthConfig) SocialProviders() []SocialProvider {
+	if !s.SocialAuthEnabled || s.SocialAuth == nil {
+		return nil
+	}
+	return s.SocialAuth.Providers()
+}
+
 type ConfigPluginHandler struct {
 	Path   string     `mapstructure:"path"`
 	Config maps.MapSI `mapstructure:"config"`
 }
 
+const (
+	// TemplatesKey is the top level key of the named site templates.
+	TemplatesKey = "templates"
+	// TemplateKey is the key of a site or template that selects its parent template.
+	TemplateKey = "template"
+)
+
 type SiteConfig struct {
 	Db  map[string]*dbconfig.DBConfig `mapstructure:"db"`
 	Raw maps.MapSI
@@ -70,8 +112,276 @@ type Config struct {
 	RedirectSiteNotFoundToIndex bool                 `mapstructure:"redirect_site_not_found_to_index"`
 	LogPath                     string               `mapstructure:"log_path"`
 	SiteTemplate                SiteConfig           `mapstructure:"site_template"`
+	Templates                   maps.MapSI           `mapstructure:"templates"`
 	Raw                         maps.MapSI
 	Sites                       maps.MapSI
+
+	// TrustedProxies CIDRs allowed to set the Forwarded and X-Forwarded-* headers
+	TrustedProxies []string   `mapstructure:"trusted_proxies"`
+	TLS            *TLSConfig `mapstructure:"tls"`
+	// RateLimit enables the limits declared in the `rate_limit` key of each site config
+	RateLimit   bool               `mapstructure:"rate_limit"`
+	Maintenance *MaintenanceConfig `mapstructure:"maintenance"`
+	// DrainTimeout seconds a removed site waits for its in flight requests. Defaults to 30.
+	DrainTimeout int             `mapstructure:"drain_timeout"`
+	Secrets      *secrets.Config `mapstructure:"secrets"`
+	DBPools      *DBPoolsConfig  `mapstructure:"db_pools"`
+	// LazyInit initializes the sites on their first request or command. Their DB
+	// events, as the migrations, run after it, and a failed initialization is
+	// retried later. The jobs of a site are scheduled on its initialization: the
+	// jobs of the sites never used do not run
+	LazyInit bool `mapstructure:"lazy_init"`
+	// IdleTimeout seconds a lazy site waits, without requests, to release its DB
+	// connections and its caches
+	IdleTimeout int `mapstructure:"idle_timeout"`
+	// StartupWorkers the max sites initialized, or migrated, concurrently. Defaults to the number of CPUs.
+	// The DB events of the sites on the same physical DB run serially, but the
+	// plugin handlers run concurrently for the others: set 1 if they are not safe.
+	StartupWorkers int `mapstructure:"startup_workers"`
+
+	// Sources the location of each key, if loaded by the dir_config.Loader
+	Sources dir_config.Sources `mapstructure:"-"`
+	// Conflicts the keys overridden by other files or directories, if loaded by the dir_config.Loader
+	Conflicts []dir_config.Conflict `mapstructure:"-"`
+	// Dir the config directory
+	Dir string `mapstructure:"-"`
+
+	secretsProvider secrets.Provider
+	// loader the loader of Dir, to rewrite its files
+	loader *dir_config.Loader
+}
+
+// LoadConfig loads the config tree of dir, resolving the secrets of the top
+// level keys. The secrets of the sites are resolved when the sites are created.
+func LoadConfig(loader *dir_config.Loader, dir string) (config *Config, err error) {
+	return loadConfig(loader, dir, true)
+}
+
+func loadConfig(loader *dir_config.Loader, dir string, resolveSecrets bool) (config *Config, err error) {
+	var raw maps.MapSI
+	// the templates are expanded when merged, using the site vars
+	loader.SkipExpand(TemplatesKey)
+	if raw, err = loader.Load(dir); err != nil {
+		return
+	}
+	for _, warning := range loader.Warnings {
+		log.Warningf("config: %s", warning)
+	}
+	warnDeprecated(loader.Changes)
+	var provider secrets.Provider
+	if resolveSecrets && !loader.NoExpand {
+		if provider, err = resolveConfigSecrets(raw, dir); err != nil {
+			return
+		}
+	}
+	config = &Config{secretsProvider: provider}
+	if err = raw.CopyTo(config); err != nil {
+		return nil, fmt.Errorf("unmarshall config failed: %v", err)
+	}
+	config.Raw = raw
+	config.Sources = loader.Sources
+	config.Conflicts = loader.Conflicts
+	config.Dir = dir
+	config.loader = loader
+	config.SiteTemplate.Raw, _ = raw["site_template"].(maps.MapSI)
+	return
+}
+
+// SiteNames returns the sorted names of the sites.
+func (this *Config) SiteNames() (names []string) {
+	for name := range this.Sites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// TemplateChain returns the names of the templates of the site, from the
+// farthest ancestor to the template selected by the site.
+func (this *Config) TemplateChain(siteName string) (chain []string, err error) {
+	siteRaw, ok := this.Sites[siteName].(maps.MapSI)
+	if !ok {
+		return nil, fmt.Errorf("site %q: config is not a map", siteName)
+	}
+	var (
+		name, _ = siteRaw[TemplateKey].(string)
+		visited = map[string]bool{}
+	)
+	for name != "" {
+		if visited[name] {
+			return nil, fmt.Errorf("site %q: template %q: inheritance cycle", siteName, name)
+		}
+		visited[name] = true
+		tmpl, ok := this.Templates[name].(maps.MapSI)
+		if !ok {
+			return nil, fmt.Errorf("site %q: template %q does not exists", siteName, name)
+		}
+		chain = append([]string{name}, chain...)
+		name, _ = tmpl[TemplateKey].(string)
+	}
+	return
+}
+
+// MergeTemplates returns the raw config of the site template merged with the
+// templates of the site, without the site config.
+func (this *Config) MergeTemplates(siteName string) (cfg maps.MapSI, err error) {
+	var chain []string
+	if chain, err = this.TemplateChain(siteName); err != nil {
+		return
+	}
+	cfg = make(maps.MapSI)
+	if err = this.SiteTemplate.Raw.DeepCopy(cfg); err != nil {
+		return nil, errors.WrapPrefix(err, fmt.Sprintf("site %q: copy main config failed", siteName), 1)
+	}
+	for _, name := range chain {
+		if err = this.Templates[name].(maps.MapSI).DeepCopy(cfg); err != nil {
+			return nil, errors.WrapPrefix(err, fmt.Sprintf("site %q: copy template %q failed", siteName, name), 1)
+		}
+	}
+	delete(cfg, TemplateKey)
+	return
+}
+
+// SiteTemplateConfig returns the template config of the site, with the DB
+// configs merged from the site template and the templates of the site,
+// expanded with the vars of the site and with the secrets resolved. If the
+// site is not in the config, returns the site template.
+func (this *Config) SiteTemplateConfig(siteName string) (tmpl *SiteConfig, err error) {
+	var vars maps.MapSI
+	tmpl = &SiteConfig{}
+	if _, ok := this.Sites[siteName]; ok {
+		var site maps.MapSI
+		if site, err = this.mergeSiteConfig(siteName); err != nil {
+			return nil, err
+		}
+		vars, _ = site[dir_config.VarsKey].(maps.MapSI)
+		if tmpl.Raw, err = this.MergeTemplates(siteName); err != nil {
+			return nil, err
+		}
+	} else {
+		tmpl.Raw = make(maps.MapSI)
+		if err = this.SiteTemplate.Raw.DeepCopy(tmpl.Raw); err != nil {
+			return nil, errors.WrapPrefix(err, "copy site template failed", 1)
+		}
+		vars, _ = tmpl.Raw[dir_config.VarsKey].(maps.MapSI)
+	}
+	if err = this.expandSiteConfig(tmpl.Raw, vars); err != nil {
+		return nil, fmt.Errorf("site %q: expand template config failed: %v", siteName, err)
+	}
+	var provider secrets.Provider
+	if provider, err = this.SecretsProvider(); err != nil {
+		return nil, err
+	}
+	if _, err = secrets.Resolve(context.Background(), provider, tmpl.Raw); err != nil {
+		return nil, fmt.Errorf("site %q: resolve template secrets failed: %v", siteName, err)
+	}
+	if err = tmpl.Raw.CopyTo(tmpl); err != nil {
+		return nil, fmt.Errorf("site %q: unmarshall template config failed: %v", siteName, err)
+	}
+	return
+}
+
+// MergeSiteConfig returns the raw config of the site merged over its templates.
+// The merge order is: the site template, the templates of the site from the
+// farthest ancestor, then the site.
+func (this *Config) MergeSiteConfig(siteName string) (cfg maps.MapSI, err error) {
+	if cfg, err = this.mergeSiteConfig(siteName); err != nil {
+		return
+	}
+	vars, _ := cfg[dir_config.VarsKey].(maps.MapSI)
+	if err = this.expandSiteConfig(cfg, vars); err != nil {
+		return nil, fmt.Errorf("site %q: expand config failed: %v", siteName, err)
+	}
+	return
+}
+
+// expandSiteConfig expands cfg with the top level vars and vars, removing
+// the vars of cfg.
+func (this *Config) expandSiteConfig(cfg, vars maps.MapSI) (err error) {
+	var expander *dir_config.Expander
+	if expander, err = this.Expander(); err != nil {
+		return
+	}
+	if expander, err = expander.Child(vars); err != nil {
+		return
+	}
+	delete(cfg, dir_config.VarsKey)
+	_, err = expander.Expand(cfg)
+	return
+}
+
+// mergeSiteConfig returns the raw config of the site merged over its
+// templates, without expanding it.
+func (this *Config) mergeSiteConfig(siteName string) (cfg maps.MapSI, err error) {
+	if cfg, err = this.MergeTemplates(siteName); err != nil {
+		return
+	}
+	if err = this.Sites[siteName].(maps.MapSI).DeepCopy(cfg); err != nil {
+		return nil, errors.WrapPrefix(err, fmt.Sprintf("site %q: copy site config failed", siteName), 1)
+	}
+	delete(cfg, "sites")
+	delete(cfg, TemplateKey)
+	return
+}
+
+// resolveConfigSecrets resolves the secrets of the top level keys of raw,
+// except the sites and the templates. Returns the provider, if used.
+func resolveConfigSecrets(raw maps.MapSI, dir string) (provider secrets.Provider, err error) {
+	var keys []string
+	for key, value := range raw {
+		switch key {
+		case "sites", "site_template", TemplatesKey, "secrets":
+			continue
+		}
+		if secrets.HasRefs(value) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	var cfg secrets.Config
+	if err = mapstructure.Decode(raw["secrets"], &cfg); err != nil {
+		return nil, fmt.Errorf("decode secrets config failed: %v", err)
+	}
+	if cfg.Provider != "" {
+		cfg.Dir = dir
+		if provider, err = secrets.New(&cfg); err != nil {
+			return
+		}
+	}
+	for _, key := range keys {
+		if raw[key], err = secrets.Resolve(context.Background(), provider, raw[key]); err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return
+}
+
+// SecretsProvider returns the provider of the site secrets, or nil if not
+// configured. The relative paths of the provider options are relative to Dir.
+func (this *Config) SecretsProvider() (provider secrets.Provider, err error) {
+	if this.Secrets == nil {
+		return nil, nil
+	}
+	if this.secretsProvider == nil {
+		cfg := *this.Secrets
+		cfg.Dir = this.Dir
+		if this.secretsProvider, err = secrets.New(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	return this.secretsProvider, nil
+}
+
+// Expander returns the expander of the top level vars.
+func (this *Config) Expander() (*dir_config.Expander, error) {
+	vars, _ := this.Raw[dir_config.VarsKey].(maps.MapSI)
+	expander, err := dir_config.NewExpander(vars)
+	if err == nil {
+		expander.Dir = this.Dir
+	}
+	return expander, err
 }
 
 func (this Config) SharedDataDir() string {
@@ -81,3 +391,12 @@ func (this Config) SharedDataDir() string {
 func (this Config) SharedSiteDataDir() string {
 	return filepath.Join(this.DataDir, "_shared", "site")
 }
+
+// SiteDataDir returns the data dir of the site. Returns error if the site
+// name is not valid (see ValidateSiteName).
+func (this Config) SiteDataDir(siteName string) (string, error) {
+	if err := ValidateSiteName(siteName); err != nil {
+		return "", err
+	}
+	return filepath.Join(this.DataDir, "sites", siteName), nil
+}
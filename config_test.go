@@ -0,0 +1,85 @@
+package sites
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/moisespsena-go/maps"
+
+	"github.com/ecletus/sites/secrets"
+)
+
+type mapSecrets map[string]string
+
+func (this mapSecrets) Get(ctx context.Context, path string) (string, error) {
+	if v, ok := this[path]; ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("not found")
+}
+
+func init() {
+	secrets.Register("test", func(dir string, options maps.MapSI) (secrets.Provider, error) {
+		return mapSecrets{"acme/email": "ops@example.com", "dir": dir}, nil
+	})
+}
+
+func TestResolveConfigSecrets(t *testing.T) {
+	site := maps.MapSI{"db": maps.MapSI{"password": secrets.Ref("missing")}}
+	raw := maps.MapSI{
+		"secrets": maps.MapSI{"provider": "test"},
+		"tls":     maps.MapSI{"acme": maps.MapSI{"email": secrets.Ref("acme/email")}},
+		"vars":    maps.MapSI{"dir": secrets.Ref("dir")},
+		"sites":   maps.MapSI{"a": site},
+	}
+	provider, err := resolveConfigSecrets(raw, "/etc/sites")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider == nil {
+		t.Fatal("expected the provider")
+	}
+	if got := raw["tls"].(maps.MapSI)["acme"].(maps.MapSI)["email"]; got != "ops@example.com" {
+		t.Errorf("email = %v", got)
+	}
+	if got := raw["vars"].(maps.MapSI)["dir"]; got != "/etc/sites" {
+		t.Errorf("provider dir = %v", got)
+	}
+	// the sites are resolved when created
+	if got := site["db"].(maps.MapSI)["password"]; got != secrets.Ref("missing") {
+		t.Errorf("site password = %v", got)
+	}
+}
+
+func TestSiteTemplateConfigExpandsAndResolves(t *testing.T) {
+	config := &Config{
+		Raw:     maps.MapSI{"vars": maps.MapSI{"host": "db.local"}},
+		Secrets: &secrets.Config{Provider: "test"},
+		Sites:   maps.MapSI{"a": maps.MapSI{"vars": maps.MapSI{"db_name": "shop_a"}}},
+	}
+	config.SiteTemplate.Raw = maps.MapSI{"db": maps.MapSI{"default": maps.MapSI{
+		"adapter":  "postgres",
+		"host":     "${var:host}",
+		"name":     "${var:db_name|default:shop}",
+		"user":     secrets.Ref("acme/email"),
+		"password": secrets.Ref("dir"),
+	}}}
+
+	tmpl, err := config.SiteTemplateConfig("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := tmpl.Db["default"]
+	if db.Host != "db.local" || db.Name != "shop_a" || db.User != "ops@example.com" {
+		t.Errorf("site template DB = %+v", db)
+	}
+
+	// not configured sites get the site template
+	if tmpl, err = config.SiteTemplateConfig("b"); err != nil {
+		t.Fatal(err)
+	}
+	if db = tmpl.Db["default"]; db.Host != "db.local" || db.Name != "shop" {
+		t.Errorf("site template DB of not configured site = %+v", db)
+	}
+}
@@ -0,0 +1,216 @@
+package sites
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ecletus/core"
+)
+
+// ControlSocket is the name of the control socket in the data dir.
+const ControlSocket = "control.sock"
+
+// ErrNoControl is returned by Control.Call if no serving process listens on
+// the control socket. The command can be run by the calling process.
+var ErrNoControl = errors.New("no serving process")
+
+// ControlHandler runs a command with its JSON args and returns its result.
+type ControlHandler func(ctx context.Context, args json.RawMessage) (result interface{}, err error)
+
+// Control serves, on a unix socket, the commands that change the state of the
+// serving process, as rename a site, so that the CLI does not change the data
+// used by the server behind its back. The commands are posted as JSON to
+// /NAME.
+type Control struct {
+	Path string
+
+	mu       sync.RWMutex
+	handlers map[string]ControlHandler
+	server   *http.Server
+}
+
+func NewControl(path string) *Control {
+	return &Control{Path: path, handlers: map[string]ControlHandler{}}
+}
+
+// Handle registers the handler of the command.
+func (this *Control) Handle(name string, handler ControlHandler) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.handlers[name] = handler
+}
+
+// Listen serves the commands on the socket. The socket file left by a
+// previous process is replaced. Returns error if other process listens on it.
+func (this *Control) Listen() (err error) {
+	if conn, err := net.Dial("unix", this.Path); err == nil {
+		conn.Close()
+		return fmt.Errorf("control socket %q: used by other process", this.Path)
+	}
+	if err = os.Remove(this.Path); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	var ln net.Listener
+	if ln, err = net.Listen("unix", this.Path); err != nil {
+		return
+	}
+	if err = os.Chmod(this.Path, 0600); err != nil {
+		ln.Close()
+		return
+	}
+	server := &http.Server{Handler: this}
+	this.mu.Lock()
+	this.server = server
+	this.mu.Unlock()
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("control socket: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Close stops serving the commands and removes the socket.
+func (this *Control) Close() (err error) {
+	this.mu.Lock()
+	server := this.server
+	this.server = nil
+	this.mu.Unlock()
+	if server == nil {
+		return nil
+	}
+	err = server.Close()
+	os.Remove(this.Path)
+	return
+}
+
+func (this *Control) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	this.mu.RLock()
+	handler := this.handlers[strings.TrimPrefix(r.URL.Path, "/")]
+	this.mu.RUnlock()
+	if handler == nil {
+		http.NotFound(w, r)
+		return
+	}
+	args, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := handler(r.Context(), args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Call runs the command in the serving process, decoding its result into
+// result, if not nil. Returns ErrNoControl if no process listens on the socket.
+func (this *Control) Call(ctx context.Context, name string, args, result interface{}) (err error) {
+	if this == nil {
+		return ErrNoControl
+	}
+	var body []byte
+	if body, err = json.Marshal(args); err != nil {
+		return
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", this.Path)
+		},
+	}}
+	req, err := http.NewRequest(http.MethodPost, "http://control/"+name, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok {
+			if opErr, ok := uerr.Err.(*net.OpError); ok && opErr.Op == "dial" {
+				return ErrNoControl
+			}
+		}
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("command %q is not served by the serving process", name)
+	}
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return errors.New(strings.TrimSpace(string(msg)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// HandleControl serves the commands of the sites router on the control
+// socket: the rename, clone and restore of the sites created with factory, if
+// not nil, and the metrics of the DB pools, if shared.
+func (this *SitesRouter) HandleControl(factory SiteFactory) {
+	if this.DBPools != nil {
+		this.Control.Handle("db-pools", func(ctx context.Context, data json.RawMessage) (interface{}, error) {
+			return this.DBPools.Report(), nil
+		})
+	}
+	if factory == nil {
+		return
+	}
+	backups := NewBackups(this.Config, this.Register, factory)
+	this.Control.Handle("rename", func(ctx context.Context, data json.RawMessage) (_ interface{}, err error) {
+		var args renameArgs
+		if err = json.Unmarshal(data, &args); err != nil {
+			return
+		}
+		_, err = this.Rename(args.Site, args.NewName, factory)
+		return
+	})
+	this.Control.Handle("clone", func(ctx context.Context, data json.RawMessage) (_ interface{}, err error) {
+		var args renameArgs
+		if err = json.Unmarshal(data, &args); err != nil {
+			return
+		}
+		site, ok := this.Register.ByName.Get(args.Site)
+		if !ok {
+			return nil, fmt.Errorf("site %q does not exists", args.Site)
+		}
+		_, err = backups.Clone(ctx, site, args.NewName)
+		return
+	})
+	this.Control.Handle("restore", func(ctx context.Context, data json.RawMessage) (_ interface{}, err error) {
+		var args restoreArgs
+		if err = json.Unmarshal(data, &args); err != nil {
+			return
+		}
+		var site *core.Site
+		if site, err = backups.RestoreFile(ctx, args.Archive, args.As); err != nil {
+			return
+		}
+		return site.Name(), nil
+	})
+}
+
+type restoreArgs struct {
+	// Archive the absolute path of the archive, opened by the serving process
+	Archive string `json:"archive"`
+	As      string `json:"as"`
+}
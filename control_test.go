@@ -0,0 +1,118 @@
+package sites
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestControl(t *testing.T) (control *Control, cleanup func()) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewControl(filepath.Join(dir, ControlSocket)), func() { os.RemoveAll(dir) }
+}
+
+func TestControlCall(t *testing.T) {
+	control, cleanup := newTestControl(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := control.Call(ctx, "echo", nil, nil); err != ErrNoControl {
+		t.Fatalf("call without server: %v", err)
+	}
+	if err := (*Control)(nil).Call(ctx, "echo", nil, nil); err != ErrNoControl {
+		t.Fatalf("call of nil control: %v", err)
+	}
+
+	control.Handle("echo", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		var s string
+		if err := json.Unmarshal(args, &s); err != nil {
+			return nil, err
+		}
+		if s == "" {
+			return nil, fmt.Errorf("blank")
+		}
+		return s + "!", nil
+	})
+	if err := control.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+
+	var result string
+	if err := control.Call(ctx, "echo", "hi", &result); err != nil || result != "hi!" {
+		t.Errorf("echo = %q, %v", result, err)
+	}
+	if err := control.Call(ctx, "echo", "", nil); err == nil || err.Error() != "blank" {
+		t.Errorf("echo error = %v", err)
+	}
+	if err := control.Call(ctx, "other", nil, nil); err == nil || err == ErrNoControl {
+		t.Errorf("unknown command error = %v", err)
+	}
+	if err := NewControl(control.Path).Listen(); err == nil {
+		t.Error("listened on the socket of other server")
+	}
+}
+
+func TestControlListenStaleSocket(t *testing.T) {
+	control, cleanup := newTestControl(t)
+	defer cleanup()
+	if err := ioutil.WriteFile(control.Path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := control.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := control.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(control.Path); !os.IsNotExist(err) {
+		t.Errorf("socket not removed: %v", err)
+	}
+}
+
+func TestControlRestore(t *testing.T) {
+	backups, cleanup := newTestBackups(t)
+	defer cleanup()
+	control, cleanupControl := newTestControl(t)
+	defer cleanupControl()
+
+	ctx := context.Background()
+	pth := filepath.Join(backups.Config.DataDir, "a.tar.gz")
+	if err := os.MkdirAll(backups.Config.DataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = backups.Backup(ctx, newTestSite("a", nil), f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	router := NewSitesRouter(backups.Register, nil)
+	router.Config, router.Control = backups.Config, control
+	router.HandleControl(backups.SiteFactory)
+	if err = control.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+
+	var siteName string
+	if err = control.Call(ctx, "restore", restoreArgs{pth, "b"}, &siteName); err != nil {
+		t.Fatal(err)
+	}
+	if siteName != "b" || !router.Register.Has("b") {
+		t.Errorf("site %q not registered by the serving process", siteName)
+	}
+	if err = control.Call(ctx, "restore", restoreArgs{pth, "b"}, &siteName); err == nil || err == ErrNoControl {
+		t.Errorf("restore over the registered site: %v", err)
+	}
+}
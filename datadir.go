@@ -0,0 +1,175 @@
+package sites
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The sub dirs of the site data dir.
+const (
+	SiteDirData    = "data"
+	SiteDirCache   = "cache"
+	SiteDirTmp     = "tmp"
+	SiteDirUploads = "uploads"
+)
+
+// SiteSubDirs are the sub dirs created in the site data dir.
+var SiteSubDirs = []string{SiteDirData, SiteDirCache, SiteDirTmp, SiteDirUploads}
+
+// SiteDirs is the layout of the site data dir:
+//
+//	DATA_DIR/sites/SITE_NAME/
+//	    data/     persistent files of the plugins
+//	    cache/    files that can be rebuilt, cleaned when the site is destroyed
+//	    tmp/      temporary files, cleaned when the site is destroyed
+//	    uploads/  files uploaded by the users
+type SiteDirs struct {
+	Root string
+	// err the error of the site name
+	err error
+}
+
+// ValidateSiteName returns error if the site name is not a valid dir name.
+func ValidateSiteName(siteName string) error {
+	if siteName == "" || siteName == "." || siteName == ".." || strings.ContainsAny(siteName, `/\`) {
+		return fmt.Errorf("invalid site name %q", siteName)
+	}
+	return nil
+}
+
+// SiteDirs returns the data dir layout of the site. If the site name is not
+// valid, the methods return its error.
+func (this Config) SiteDirs(siteName string) SiteDirs {
+	root, err := this.SiteDataDir(siteName)
+	if err != nil {
+		return SiteDirs{err: err}
+	}
+	return SiteDirs{Root: root}
+}
+
+// Err returns the error of the site name.
+func (this SiteDirs) Err() error {
+	return this.err
+}
+
+func (this SiteDirs) Data(elem ...string) (string, error) {
+	return this.Join(SiteDirData, elem...)
+}
+
+func (this SiteDirs) Cache(elem ...string) (string, error) {
+	return this.Join(SiteDirCache, elem...)
+}
+
+func (this SiteDirs) Tmp(elem ...string) (string, error) {
+	return this.Join(SiteDirTmp, elem...)
+}
+
+func (this SiteDirs) Uploads(elem ...string) (string, error) {
+	return this.Join(SiteDirUploads, elem...)
+}
+
+// Join joins elem to the sub dir of the site data dir. Returns error if the
+// path escapes the sub dir.
+func (this SiteDirs) Join(subDir string, elem ...string) (string, error) {
+	if this.err != nil {
+		return "", this.err
+	}
+	root, err := SafeJoin(this.Root, subDir)
+	if err != nil {
+		return "", err
+	}
+	return SafeJoin(root, elem...)
+}
+
+// Create creates the sub dirs of the site data dir.
+func (this SiteDirs) Create() (err error) {
+	if this.err != nil {
+		return this.err
+	}
+	for _, subDir := range SiteSubDirs {
+		if err = os.MkdirAll(filepath.Join(this.Root, subDir), 0755); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// Clean removes the content of the tmp and cache dirs.
+func (this SiteDirs) Clean() (err error) {
+	if this.err != nil {
+		return this.err
+	}
+	for _, subDir := range []string{SiteDirTmp, SiteDirCache} {
+		dir := filepath.Join(this.Root, subDir)
+		if err = os.RemoveAll(dir); err != nil {
+			return
+		}
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// DiskUsage is the size in bytes of each sub dir of the site data dir. The
+// files out of the sub dirs are accounted in the "" key.
+type DiskUsage map[string]int64
+
+func (this DiskUsage) Total() (total int64) {
+	for _, size := range this {
+		total += size
+	}
+	return
+}
+
+// Usage returns the disk usage of the site data dir.
+func (this SiteDirs) Usage() (usage DiskUsage, err error) {
+	if this.err != nil {
+		return nil, this.err
+	}
+	usage = DiskUsage{}
+	err = filepath.Walk(this.Root, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		var subDir string
+		if rel, _ := filepath.Rel(this.Root, pth); strings.ContainsRune(rel, filepath.Separator) {
+			subDir = rel[:strings.IndexRune(rel, filepath.Separator)]
+		}
+		usage[subDir] += info.Size()
+		return nil
+	})
+	return
+}
+
+// SafeJoin joins elem to root. Returns error if the path escapes root.
+func SafeJoin(root string, elem ...string) (string, error) {
+	root = filepath.Clean(root)
+	pth := filepath.Join(append([]string{root}, elem...)...)
+	if pth != root && !strings.HasPrefix(pth, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q escapes %q", filepath.Join(elem...), root)
+	}
+	return pth, nil
+}
+
+// FormatSize formats size in bytes using binary units.
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,61 @@
+package sites
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateSiteName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"shop":       true,
+		"shop.com":   true,
+		"":           false,
+		".":          false,
+		"..":         false,
+		"../../etc":  false,
+		"a/b":        false,
+		`a\b`:        false,
+		"..shop..":   true,
+		"shop_2.dev": true,
+	} {
+		if err := ValidateSiteName(name); (err == nil) != valid {
+			t.Errorf("ValidateSiteName(%q) = %v", name, err)
+		}
+	}
+}
+
+func TestSiteDirsInvalidName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datadir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := Config{DataDir: filepath.Join(dir, "data")}
+	dirs := config.SiteDirs("../../escaped")
+	if dirs.Err() == nil {
+		t.Fatal("expected the site name error")
+	}
+	if err = dirs.Create(); err == nil {
+		t.Fatal("created the dirs of a invalid site name")
+	}
+	if _, err = dirs.Data("x"); err == nil {
+		t.Fatal("joined a invalid site name")
+	}
+	if _, err = config.SiteDataDir("../../escaped"); err == nil {
+		t.Fatal("expected the site data dir error")
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("created %v", entries)
+	}
+
+	dirs = config.SiteDirs("a")
+	if err = dirs.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dirs.Data("..", "..", "b"); err == nil {
+		t.Fatal("expected the escaped path error")
+	}
+}
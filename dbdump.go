@@ -0,0 +1,504 @@
+package sites
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ecletus/core/db/dbconfig"
+)
+
+// DBDumper writes and restores the logical dumps of the DBs of an adapter.
+// The isolation, if not nil, is the schema or the tables prefix of the site
+// in a shared DB (see IsolationConfigKey): only its tables are dumped. The
+// dump of the isolation from is restored into the isolation to.
+type DBDumper interface {
+	Dump(ctx context.Context, cfg *dbconfig.DBConfig, isolation *DBIsolation, w io.Writer) error
+	Restore(ctx context.Context, cfg *dbconfig.DBConfig, from, to *DBIsolation, r io.Reader) error
+}
+
+// DBCreator is a DBDumper that creates and drops the DBs, to restore the
+// backups into new DBs.
+type DBCreator interface {
+	// CreateDB creates the DB. Returns error if it exists.
+	CreateDB(ctx context.Context, cfg *dbconfig.DBConfig) error
+	DropDB(ctx context.Context, cfg *dbconfig.DBConfig) error
+}
+
+// DBIsolationDropper is a DBDumper that drops the schema or the tables of an
+// isolation, to undo the restores into shared DBs.
+type DBIsolationDropper interface {
+	DropIsolation(ctx context.Context, cfg *dbconfig.DBConfig, isolation *DBIsolation) error
+}
+
+var (
+	dbDumpersMu sync.RWMutex
+	dbDumpers   = map[string]DBDumper{}
+)
+
+// RegisterDBDumper registers the dumper of the DBs of the adapter.
+func RegisterDBDumper(adapter string, dumper DBDumper) {
+	dbDumpersMu.Lock()
+	defer dbDumpersMu.Unlock()
+	dbDumpers[adapter] = dumper
+}
+
+// GetDBDumper returns the dumper of the adapter, or nil.
+func GetDBDumper(adapter string) DBDumper {
+	dbDumpersMu.RLock()
+	defer dbDumpersMu.RUnlock()
+	return dbDumpers[adapter]
+}
+
+func init() {
+	postgres := &CommandDBDumper{
+		DumpCommand: func(cfg *dbconfig.DBConfig, scope DBScope) (args, env []string) {
+			args = append(append([]string{"pg_dump"}, pgArgs(cfg)...), "--clean", "--if-exists", "--no-owner")
+			if scope.Schema != "" {
+				args = append(args, "--schema", scope.Schema)
+			}
+			for _, table := range scope.Tables {
+				args = append(args, "--table", table)
+			}
+			return append(args, cfg.Name), []string{"PGPASSWORD=" + cfg.Password}
+		},
+		RestoreCommand: func(cfg *dbconfig.DBConfig) (args, env []string) {
+			return append(append([]string{"psql"}, pgArgs(cfg)...), "--quiet", "--set", "ON_ERROR_STOP=1", cfg.Name),
+				[]string{"PGPASSWORD=" + cfg.Password}
+		},
+		CreateCommand: func(cfg *dbconfig.DBConfig) (args, env []string) {
+			return append(append([]string{"createdb"}, pgArgs(cfg)...), cfg.Name),
+				[]string{"PGPASSWORD=" + cfg.Password}
+		},
+		DropCommand: func(cfg *dbconfig.DBConfig) (args, env []string) {
+			return append(append([]string{"dropdb"}, pgArgs(cfg)...), "--if-exists", cfg.Name),
+				[]string{"PGPASSWORD=" + cfg.Password}
+		},
+		QueryCommand: func(cfg *dbconfig.DBConfig, query string) (args, env []string) {
+			return append(append([]string{"psql"}, pgArgs(cfg)...), "--quiet", "--no-align", "--tuples-only", "--set", "ON_ERROR_STOP=1", "--command", query, cfg.Name),
+				[]string{"PGPASSWORD=" + cfg.Password}
+		},
+		TablesQuery: "SELECT tablename FROM pg_tables WHERE schemaname = current_schema() AND tablename LIKE '%s'",
+		QuoteIdent:  pgQuote,
+		Schemas:     true,
+	}
+	RegisterDBDumper("postgres", postgres)
+	RegisterDBDumper("postgresql", postgres)
+
+	RegisterDBDumper("mysql", &CommandDBDumper{
+		DumpCommand: func(cfg *dbconfig.DBConfig, scope DBScope) (args, env []string) {
+			args = append(append([]string{"mysqldump"}, mysqlArgs(cfg)...), "--single-transaction")
+			if len(scope.Tables) == 0 {
+				args = append(args, "--routines")
+			}
+			return append(append(args, cfg.Name), scope.Tables...), []string{"MYSQL_PWD=" + cfg.Password}
+		},
+		RestoreCommand: func(cfg *dbconfig.DBConfig) (args, env []string) {
+			return append(append([]string{"mysql"}, mysqlArgs(cfg)...), cfg.Name),
+				[]string{"MYSQL_PWD=" + cfg.Password}
+		},
+		CreateCommand: func(cfg *dbconfig.DBConfig) (args, env []string) {
+			return append(append([]string{"mysql"}, mysqlArgs(cfg)...), "--execute", "CREATE DATABASE "+mysqlQuote(cfg.Name)),
+				[]string{"MYSQL_PWD=" + cfg.Password}
+		},
+		DropCommand: func(cfg *dbconfig.DBConfig) (args, env []string) {
+			return append(append([]string{"mysql"}, mysqlArgs(cfg)...), "--execute", "DROP DATABASE IF EXISTS "+mysqlQuote(cfg.Name)),
+				[]string{"MYSQL_PWD=" + cfg.Password}
+		},
+		QueryCommand: func(cfg *dbconfig.DBConfig, query string) (args, env []string) {
+			return append(append([]string{"mysql"}, mysqlArgs(cfg)...), "--batch", "--skip-column-names", "--execute", query, cfg.Name),
+				[]string{"MYSQL_PWD=" + cfg.Password}
+		},
+		TablesQuery: "SHOW TABLES LIKE '%s'",
+		QuoteIdent:  mysqlQuote,
+		Quote:       "`",
+	})
+}
+
+func pgArgs(cfg *dbconfig.DBConfig) (args []string) {
+	if cfg.Host != "" {
+		args = append(args, "--host", cfg.Host)
+	}
+	if port := fmt.Sprint(cfg.Port); port != "" && port != "0" {
+		args = append(args, "--port", port)
+	}
+	if cfg.User != "" {
+		args = append(args, "--username", cfg.User)
+	}
+	return append(args, "--no-password")
+}
+
+func mysqlArgs(cfg *dbconfig.DBConfig) (args []string) {
+	if cfg.Host != "" {
+		args = append(args, "--host", cfg.Host)
+	}
+	if port := fmt.Sprint(cfg.Port); port != "" && port != "0" {
+		args = append(args, "--port", port)
+	}
+	if cfg.User != "" {
+		args = append(args, "--user", cfg.User)
+	}
+	return
+}
+
+func mysqlQuote(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func pgQuote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// DBScope is the part of the DB dumped: a schema or tables. The zero value is
+// the whole DB.
+type DBScope struct {
+	Schema string
+	Tables []string
+}
+
+// CommandDBDumper dumps and restores the DBs with external commands, that
+// write the dump to the stdout and read it from the stdin. The command funcs
+// return the command line and the variables added to the command environment.
+type CommandDBDumper struct {
+	DumpCommand    func(cfg *dbconfig.DBConfig, scope DBScope) (args, env []string)
+	RestoreCommand func(cfg *dbconfig.DBConfig) (args, env []string)
+	// CreateCommand and DropCommand, if not nil, create and drop the DBs
+	CreateCommand func(cfg *dbconfig.DBConfig) (args, env []string)
+	DropCommand   func(cfg *dbconfig.DBConfig) (args, env []string)
+	// QueryCommand, if not nil, runs the SQL query and writes its rows, a row
+	// by line and without headers. Required by the isolated DBs.
+	QueryCommand func(cfg *dbconfig.DBConfig, query string) (args, env []string)
+	// TablesQuery the query of the names of the tables LIKE the %s pattern
+	TablesQuery string
+	QuoteIdent  func(name string) string
+	// Schemas reports whether the adapter supports the schema isolation
+	Schemas bool
+	// Quote if not blank, the quote of all of the identifiers of the dumps.
+	// Only the quoted identifiers are renamed by the restore into other
+	// isolation, as the values can be written in the same lines.
+	Quote string
+}
+
+func (this *CommandDBDumper) run(ctx context.Context, args, env []string, stdin io.Reader, stdout io.Writer) error {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin, cmd.Stdout = stdin, stdout
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %v: %s", cmd.Args[0], err, msg)
+		}
+		return fmt.Errorf("%s: %v", cmd.Args[0], err)
+	}
+	return nil
+}
+
+func (this *CommandDBDumper) query(ctx context.Context, cfg *dbconfig.DBConfig, query string) (rows []string, err error) {
+	if this.QueryCommand == nil {
+		return nil, fmt.Errorf("queries are not supported")
+	}
+	var out bytes.Buffer
+	args, env := this.QueryCommand(cfg, query)
+	if err = this.run(ctx, args, env, nil, &out); err != nil {
+		return
+	}
+	for _, row := range strings.Split(out.String(), "\n") {
+		if row = strings.TrimSpace(row); row != "" {
+			rows = append(rows, row)
+		}
+	}
+	return
+}
+
+// scope returns the part of the DB of the isolation.
+func (this *CommandDBDumper) scope(ctx context.Context, cfg *dbconfig.DBConfig, isolation *DBIsolation) (scope DBScope, err error) {
+	if isolation == nil {
+		return
+	}
+	switch isolation.Strategy {
+	case IsolationSchema:
+		if !this.Schemas {
+			return scope, fmt.Errorf("the schema isolation is not supported")
+		}
+		scope.Schema = isolation.Namespace
+	case IsolationTablePrefix:
+		if this.TablesQuery == "" {
+			return scope, fmt.Errorf("the table prefix isolation is not supported")
+		}
+		// the namespace has only a-z, 0-9 and _
+		pattern := strings.Replace(isolation.Namespace, "_", `\_`, -1) + "%"
+		var tables []string
+		if tables, err = this.query(ctx, cfg, fmt.Sprintf(this.TablesQuery, pattern)); err != nil {
+			return
+		}
+		// the tables of the longer prefixes of other sites
+		for _, table := range tables {
+			if isolation.Owns(table) {
+				scope.Tables = append(scope.Tables, table)
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown isolation strategy %q", isolation.Strategy)
+	}
+	return
+}
+
+func (this *CommandDBDumper) Dump(ctx context.Context, cfg *dbconfig.DBConfig, isolation *DBIsolation, w io.Writer) error {
+	scope, err := this.scope(ctx, cfg, isolation)
+	if err != nil {
+		return err
+	}
+	if isolation != nil && scope.Schema == "" && len(scope.Tables) == 0 {
+		// no tables of the isolation: the dump of the tables would be the whole DB
+		return nil
+	}
+	args, env := this.DumpCommand(cfg, scope)
+	return this.run(ctx, args, env, nil, w)
+}
+
+// Restore restores the dump. The dump is restored into other table prefix
+// isolation only if r is an io.ReadSeeker, as it is read twice.
+func (this *CommandDBDumper) Restore(ctx context.Context, cfg *dbconfig.DBConfig, from, to *DBIsolation, r io.Reader) error {
+	if from != nil && to != nil && !from.Equal(to) {
+		var tables []string
+		if from.Strategy == IsolationTablePrefix {
+			rs, ok := r.(io.ReadSeeker)
+			if !ok {
+				return fmt.Errorf("restore into other table prefix: the dump is not seekable")
+			}
+			var err error
+			if tables, err = DumpTables(rs, from.Namespace); err != nil {
+				return err
+			}
+			if _, err = rs.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		src := r
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(RenameIsolation(pw, src, from, to, tables, this.Quote))
+		}()
+		defer pr.Close()
+		r = pr
+	}
+	args, env := this.RestoreCommand(cfg)
+	return this.run(ctx, args, env, r, nil)
+}
+
+// DropIsolation drops the schema or the tables of the isolation.
+func (this *CommandDBDumper) DropIsolation(ctx context.Context, cfg *dbconfig.DBConfig, isolation *DBIsolation) (err error) {
+	if this.QuoteIdent == nil {
+		return fmt.Errorf("drop isolation is not supported")
+	}
+	var scope DBScope
+	if scope, err = this.scope(ctx, cfg, isolation); err != nil {
+		return
+	}
+	if scope.Schema != "" {
+		_, err = this.query(ctx, cfg, "DROP SCHEMA IF EXISTS "+this.QuoteIdent(scope.Schema)+" CASCADE")
+		return
+	}
+	for _, table := range scope.Tables {
+		if _, err = this.query(ctx, cfg, "DROP TABLE IF EXISTS "+this.QuoteIdent(table)); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+func (this *CommandDBDumper) CreateDB(ctx context.Context, cfg *dbconfig.DBConfig) error {
+	if this.CreateCommand == nil {
+		return fmt.Errorf("create DB is not supported")
+	}
+	args, env := this.CreateCommand(cfg)
+	return this.run(ctx, args, env, nil, nil)
+}
+
+func (this *CommandDBDumper) DropDB(ctx context.Context, cfg *dbconfig.DBConfig) error {
+	if this.DropCommand == nil {
+		return fmt.Errorf("drop DB is not supported")
+	}
+	args, env := this.DropCommand(cfg)
+	return this.run(ctx, args, env, nil, nil)
+}
+
+// RenameIsolation copies the dump r to w, renaming the schema of the schema
+// isolation from, or the tables (with the sequences, indexes and constraints
+// named by them) of the table prefix isolation from, to the ones of the
+// isolation to. tables are the tables of the prefix isolation in the dump (see
+// DumpTables). The schema is renamed only where it qualifies a name, as
+// `schema.table`, and in the schema statements, as CREATE SCHEMA and SET
+// search_path, so that the tables and columns with its name are kept. The
+// data of the COPY statements is not changed. If quote is not blank, only the
+// identifiers quoted by it are renamed.
+func RenameIsolation(w io.Writer, r io.Reader, from, to *DBIsolation, tables []string, quote string) (err error) {
+	if from.Strategy != to.Strategy {
+		return fmt.Errorf("the %s isolation can not be restored into the %s isolation", from.Strategy, to.Strategy)
+	}
+	// the longest first, as a table can be a part of the name of other
+	tables = append([]string{}, tables...)
+	sort.Slice(tables, func(i, j int) bool {
+		return len(tables[i]) > len(tables[j])
+	})
+	rename := func(line string, start, end int) string {
+		ident := line[start:end]
+		if from.Strategy == IsolationSchema {
+			if ident == from.Namespace && (strings.HasPrefix(strings.TrimPrefix(line[end:], quote), ".") || isSchemaName(line[:start])) {
+				return to.Namespace
+			}
+			return ident
+		}
+		for _, table := range tables {
+			ident = replaceIdentPart(ident, table, to.Namespace+strings.TrimPrefix(table, from.Namespace))
+		}
+		return ident
+	}
+	var (
+		br     = bufio.NewReader(r)
+		line   string
+		inCopy bool
+	)
+	for {
+		line, err = br.ReadString('\n')
+		if line != "" {
+			if inCopy {
+				inCopy = strings.TrimRight(line, "\r\n") != `\.`
+			} else {
+				inCopy = strings.HasPrefix(line, "COPY ") && strings.HasSuffix(strings.TrimRight(line, "\r\n"), "FROM stdin;")
+				line = mapIdentsAt(line, quote, rename)
+			}
+			if _, werr := io.WriteString(w, line); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return
+		}
+	}
+}
+
+// DumpTables returns the tables created by the dump whose names start with
+// the prefix.
+func DumpTables(r io.Reader, prefix string) (tables []string, err error) {
+	var (
+		br   = bufio.NewReader(r)
+		line string
+		seen = map[string]bool{}
+	)
+	for {
+		line, err = br.ReadString('\n')
+		if strings.HasPrefix(line, "CREATE TABLE ") {
+			head := strings.TrimPrefix(line, "CREATE TABLE ")
+			if i := strings.IndexByte(head, '('); i >= 0 {
+				head = head[:i]
+			}
+			found := false
+			mapIdents(head, "", func(ident string) string {
+				// the first prefixed identifier, after the schema qualifier
+				if !found && strings.HasPrefix(ident, prefix) {
+					found = true
+					if !seen[ident] {
+						seen[ident] = true
+						tables = append(tables, ident)
+					}
+				}
+				return ident
+			})
+		}
+		if err == io.EOF {
+			return tables, nil
+		} else if err != nil {
+			return
+		}
+	}
+}
+
+// isSchemaName reports whether the identifier after the statement head is a
+// schema name: of the schema statements, as CREATE SCHEMA, or of SET
+// search_path.
+func isSchemaName(head string) bool {
+	head = strings.ToUpper(strings.TrimLeft(head, " \t"))
+	if strings.HasPrefix(head, "SET SEARCH_PATH") {
+		return true
+	}
+	head = strings.TrimRight(head, " \t\"`")
+	for _, suffix := range []string{"SCHEMA", "SCHEMA IF EXISTS", "SCHEMA IF NOT EXISTS"} {
+		if head == suffix || strings.HasSuffix(head, " "+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceIdentPart replaces old by new in the identifier, where old is the
+// identifier or a part of it delimited by _.
+func replaceIdentPart(ident, old, new string) string {
+	for i := 0; i+len(old) <= len(ident); {
+		j := strings.Index(ident[i:], old)
+		if j < 0 {
+			break
+		}
+		j += i
+		end := j + len(old)
+		if (j == 0 || ident[j-1] == '_') && (end == len(ident) || ident[end] == '_') {
+			ident = ident[:j] + new + ident[end:]
+			i = j + len(new)
+		} else {
+			i = j + 1
+		}
+	}
+	return ident
+}
+
+// mapIdents replaces the identifiers of the line by the result of fn. If
+// quote is not blank, only the identifiers quoted by it are replaced.
+func mapIdents(line, quote string, fn func(ident string) string) string {
+	return mapIdentsAt(line, quote, func(line string, start, end int) string {
+		return fn(line[start:end])
+	})
+}
+
+// mapIdentsAt is as mapIdents, but fn gets the line and the position of the
+// identifier, to see its context.
+func mapIdentsAt(line, quote string, fn func(line string, start, end int) string) string {
+	var (
+		b     strings.Builder
+		start = -1
+	)
+	flush := func(end int) {
+		ident := line[start:end]
+		if quote == "" || (start >= len(quote) && line[start-len(quote):start] == quote) {
+			ident = fn(line, start, end)
+		}
+		b.WriteString(ident)
+		start = -1
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			flush(i)
+		}
+		b.WriteByte(c)
+	}
+	if start >= 0 {
+		flush(len(line))
+	}
+	return b.String()
+}
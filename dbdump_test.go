@@ -0,0 +1,183 @@
+package sites
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ecletus/core/db/dbconfig"
+)
+
+func TestRenameIsolationSchema(t *testing.T) {
+	dump := strings.Join([]string{
+		"DROP TABLE IF EXISTS a.orders;",
+		"CREATE SCHEMA a;",
+		"CREATE TABLE a.orders (id integer DEFAULT nextval('a.orders_id_seq'::regclass), aa text);",
+		"COPY a.orders (id, aa) FROM stdin;",
+		"1\ta.b",
+		"\\.",
+		"ALTER TABLE ONLY a.orders ADD CONSTRAINT orders_pkey PRIMARY KEY (id);",
+		"",
+	}, "\n")
+	var out bytes.Buffer
+	if err := RenameIsolation(&out, strings.NewReader(dump), &DBIsolation{Strategy: IsolationSchema, Namespace: "a"}, &DBIsolation{Strategy: IsolationSchema, Namespace: "b"}, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"DROP TABLE IF EXISTS b.orders;",
+		"CREATE SCHEMA b;",
+		"CREATE TABLE b.orders (id integer DEFAULT nextval('b.orders_id_seq'::regclass), aa text);",
+		"COPY b.orders (id, aa) FROM stdin;",
+		"1\ta.b",
+		"\\.",
+		"ALTER TABLE ONLY b.orders ADD CONSTRAINT orders_pkey PRIMARY KEY (id);",
+		"",
+	}, "\n")
+	if out.String() != want {
+		t.Errorf("renamed dump:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestRenameIsolationSchemaKeepsNames(t *testing.T) {
+	dump := strings.Join([]string{
+		"DROP SCHEMA IF EXISTS shop;",
+		"CREATE SCHEMA shop;",
+		"SET search_path = shop, pg_catalog;",
+		"CREATE TABLE shop.shop (id integer, shop text);",
+		"ALTER TABLE ONLY shop.shop ADD CONSTRAINT shop_pkey PRIMARY KEY (id);",
+		"CREATE INDEX shop ON shop.shop USING btree (shop);",
+		"",
+	}, "\n")
+	var out bytes.Buffer
+	if err := RenameIsolation(&out, strings.NewReader(dump), &DBIsolation{Strategy: IsolationSchema, Namespace: "shop"}, &DBIsolation{Strategy: IsolationSchema, Namespace: "blog"}, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"DROP SCHEMA IF EXISTS blog;",
+		"CREATE SCHEMA blog;",
+		"SET search_path = blog, pg_catalog;",
+		"CREATE TABLE blog.shop (id integer, shop text);",
+		"ALTER TABLE ONLY blog.shop ADD CONSTRAINT shop_pkey PRIMARY KEY (id);",
+		"CREATE INDEX shop ON blog.shop USING btree (shop);",
+		"",
+	}, "\n")
+	if out.String() != want {
+		t.Errorf("renamed dump:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestRenameIsolationTablePrefix(t *testing.T) {
+	from, to := &DBIsolation{Strategy: IsolationTablePrefix, Namespace: "a_"}, &DBIsolation{Strategy: IsolationTablePrefix, Namespace: "b_"}
+	dump := strings.Join([]string{
+		"DROP INDEX IF EXISTS public.idx_a_orders_code;",
+		"CREATE TABLE public.a_orders (",
+		"    a_id integer DEFAULT nextval('public.a_orders_id_seq'::regclass)",
+		");",
+		"CREATE TABLE public.a_orders_items (id integer);",
+		"COPY public.a_orders (a_id) FROM stdin;",
+		"a_orders",
+		"\\.",
+		"CREATE INDEX idx_a_orders_code ON public.a_orders USING btree (a_id);",
+		"",
+	}, "\n")
+	tables, err := DumpTables(strings.NewReader(dump), from.Namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tables, ",") != "a_orders,a_orders_items" {
+		t.Fatalf("tables = %v", tables)
+	}
+	var out bytes.Buffer
+	if err = RenameIsolation(&out, strings.NewReader(dump), from, to, tables, ""); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"DROP INDEX IF EXISTS public.idx_b_orders_code;",
+		"CREATE TABLE public.b_orders (",
+		"    a_id integer DEFAULT nextval('public.b_orders_id_seq'::regclass)",
+		");",
+		"CREATE TABLE public.b_orders_items (id integer);",
+		"COPY public.b_orders (a_id) FROM stdin;",
+		"a_orders",
+		"\\.",
+		"CREATE INDEX idx_b_orders_code ON public.b_orders USING btree (a_id);",
+		"",
+	}, "\n")
+	if out.String() != want {
+		t.Errorf("renamed dump:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	// the values of the lines of the quoted identifiers are not renamed
+	out.Reset()
+	dump = "INSERT INTO `a_orders` VALUES (1,'a_orders');\n"
+	if err = RenameIsolation(&out, strings.NewReader(dump), from, to, []string{"a_orders"}, "`"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "INSERT INTO `b_orders` VALUES (1,'a_orders');\n"; out.String() != want {
+		t.Errorf("renamed dump = %q, want %q", out.String(), want)
+	}
+
+	if err = RenameIsolation(&out, strings.NewReader(""), from, &DBIsolation{Strategy: IsolationSchema, Namespace: "b"}, nil, ""); err == nil {
+		t.Error("renamed the prefix into a schema")
+	}
+}
+
+func TestCommandDBDumperIsolation(t *testing.T) {
+	var query string
+	dumper := &CommandDBDumper{
+		DumpCommand: func(cfg *dbconfig.DBConfig, scope DBScope) (args, env []string) {
+			return append([]string{"echo", "dump", scope.Schema}, scope.Tables...), nil
+		},
+		QueryCommand: func(cfg *dbconfig.DBConfig, q string) (args, env []string) {
+			query = q
+			return []string{"printf", "a_orders\na_users\n"}, nil
+		},
+		TablesQuery: "TABLES LIKE '%s'",
+	}
+	ctx, cfg := context.Background(), &dbconfig.DBConfig{Name: "shared"}
+
+	var out bytes.Buffer
+	if err := dumper.Dump(ctx, cfg, &DBIsolation{Strategy: IsolationTablePrefix, Namespace: "a_"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "dump  a_orders a_users\n"; out.String() != want {
+		t.Errorf("dump = %q, want %q", out.String(), want)
+	}
+	if want := `TABLES LIKE 'a\_%'`; query != want {
+		t.Errorf("tables query = %q, want %q", query, want)
+	}
+
+	if err := dumper.Dump(ctx, cfg, &DBIsolation{Strategy: IsolationSchema, Namespace: "a"}, &out); err == nil {
+		t.Error("dumped the schema of an adapter without schemas")
+	}
+	dumper.Schemas = true
+	out.Reset()
+	if err := dumper.Dump(ctx, cfg, &DBIsolation{Strategy: IsolationSchema, Namespace: "a"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "dump a\n"; out.String() != want {
+		t.Errorf("dump = %q, want %q", out.String(), want)
+	}
+}
+
+func TestCommandDBDumperIsolationExclude(t *testing.T) {
+	dumper := &CommandDBDumper{
+		DumpCommand: func(cfg *dbconfig.DBConfig, scope DBScope) (args, env []string) {
+			return append([]string{"echo", "dump"}, scope.Tables...), nil
+		},
+		QueryCommand: func(cfg *dbconfig.DBConfig, q string) (args, env []string) {
+			return []string{"printf", "shop_2_orders\nshop_orders\nshop_users\n"}, nil
+		},
+		TablesQuery: "TABLES LIKE '%s'",
+	}
+	isolation := &DBIsolation{Strategy: IsolationTablePrefix, Namespace: "shop_", Exclude: []string{"shop_2_"}}
+
+	var out bytes.Buffer
+	if err := dumper.Dump(context.Background(), &dbconfig.DBConfig{Name: "shared"}, isolation, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "dump shop_orders shop_users\n"; out.String() != want {
+		t.Errorf("dump = %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,352 @@
+package sites
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ecletus/core"
+	"github.com/ecletus/core/db/dbconfig"
+	"github.com/moisespsena-go/aorm"
+	"github.com/moisespsena-go/xroute"
+)
+
+// DBPoolConfigKey is the site config key of its shared pools usage:
+//
+//	db_pool:
+//	  limit: 5   # max concurrent requests. Overrides db_pools.site_limit
+//
+// The limit gates the HTTP requests of the site, not its DB connections: a
+// request can use several connections, and the jobs and the commands of the
+// site are not limited. The connections are limited by db_pools.max_open.
+const DBPoolConfigKey = "db_pool"
+
+// DBPoolsConfig is the `db_pools` key of the sites config.
+type DBPoolsConfig struct {
+	// Enabled shares the connection pool of the site DBs with the same DSN
+	Enabled bool `mapstructure:"enabled"`
+	MaxOpen int  `mapstructure:"max_open"`
+	MaxIdle int  `mapstructure:"max_idle"`
+	// SiteLimit default max concurrent HTTP requests of each site using the
+	// shared pools. It does not limit the connections. 0 is unlimited.
+	SiteLimit int `mapstructure:"site_limit"`
+}
+
+type SiteDBPoolConfig struct {
+	Limit int `mapstructure:"limit"`
+}
+
+type sharedPool struct {
+	key   string
+	db    *aorm.DB
+	sites map[string]bool
+	// idle the idle sites
+	idle map[string]bool
+}
+
+// allIdle reports whether all sites of the pool are idle.
+func (this *sharedPool) allIdle() bool {
+	return len(this.sites) > 0 && len(this.idle) == len(this.sites)
+}
+
+type sitePool struct {
+	keys     map[string]string
+	sem      chan struct{}
+	requests int64
+	waits    int64
+}
+
+// DBPools shares the connection pools of the site DBs with the same DSN. The
+// pools are reference counted by the sites and closed with the last site.
+type DBPools struct {
+	Config *DBPoolsConfig
+
+	mu    sync.Mutex
+	pools map[string]*sharedPool
+	sites map[string]*sitePool
+}
+
+func NewDBPools(config *DBPoolsConfig) *DBPools {
+	return &DBPools{
+		Config: config,
+		pools:  map[string]*sharedPool{},
+		sites:  map[string]*sitePool{},
+	}
+}
+
+// DBPoolKey returns the key of the pool of the DB config. The DBs share the pool
+// only if all of their connection options, as the SSL mode and the params, are
+// equal, so the options are a part of the key, as the hash of the config
+// fields. The password is not: the same user has the same password.
+func DBPoolKey(cfg *dbconfig.DBConfig) string {
+	opts := *cfg
+	opts.Password = ""
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%+v", opts)))
+	return fmt.Sprintf("%s://%s@%s:%v/%s#%s", cfg.Adapter, cfg.User, cfg.Host, cfg.Port, cfg.Name, hex.EncodeToString(sum[:4]))
+}
+
+// Share replaces the pools of the site DBs by the shared pools of their DSN,
+// closing the pools of the site.
+func (this *DBPools) Share(site *core.Site) (err error) {
+	var limit = this.Config.SiteLimit
+	var siteCfg SiteDBPoolConfig
+	if ok, err := DecodeSiteConfig(site, DBPoolConfigKey, &siteCfg); err != nil {
+		return fmt.Errorf("decode %s config: %v", DBPoolConfigKey, err)
+	} else if ok && siteCfg.Limit > 0 {
+		limit = siteCfg.Limit
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	sp := this.sites[site.Name()]
+	if sp == nil {
+		sp = &sitePool{keys: map[string]string{}}
+		if limit > 0 {
+			sp.sem = make(chan struct{}, limit)
+		}
+		this.sites[site.Name()] = sp
+	}
+
+	return site.EachDB(func(DB *core.DB) (err error) {
+		cfg := site.Config().Db[DB.Name]
+		if cfg == nil {
+			return nil
+		}
+		key := DBPoolKey(cfg)
+		pool := this.pools[key]
+		if pool == nil {
+			pool = &sharedPool{key: key, db: DB.DB, sites: map[string]bool{}, idle: map[string]bool{}}
+			if this.Config.MaxOpen > 0 {
+				DB.DB.DB().SetMaxOpenConns(this.Config.MaxOpen)
+			}
+			if this.Config.MaxIdle > 0 {
+				DB.DB.DB().SetMaxIdleConns(this.Config.MaxIdle)
+			}
+			this.pools[key] = pool
+		} else if DB.DB.DB() != pool.db.DB() {
+			own := DB.DB
+			DB.DB = pool.db.New()
+			if err = own.Close(); err != nil {
+				log.Warningf("[%s] close DB %q pool: %v", site.Name(), DB.Name, err)
+			}
+		}
+		if pool.allIdle() {
+			pool.db.DB().SetMaxIdleConns(this.maxIdle())
+		}
+		pool.sites[site.Name()] = true
+		sp.keys[DB.Name] = key
+		return nil
+	})
+}
+
+// Release releases the shared pool of the site DB, closing it if not used by
+// other sites. Returns false if the DB is not shared.
+func (this *DBPools) Release(site *core.Site, DB *core.DB) (shared bool, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	sp := this.sites[site.Name()]
+	if sp == nil {
+		return
+	}
+	key, ok := sp.keys[DB.Name]
+	if !ok {
+		return
+	}
+	delete(sp.keys, DB.Name)
+	if len(sp.keys) == 0 {
+		delete(this.sites, site.Name())
+	}
+	pool := this.pools[key]
+	if pool == nil {
+		return true, nil
+	}
+	wasIdle := pool.allIdle()
+	delete(pool.sites, site.Name())
+	delete(pool.idle, site.Name())
+	if len(pool.sites) == 0 {
+		delete(this.pools, key)
+		err = pool.db.Close()
+	} else if !wasIdle && pool.allIdle() {
+		pool.db.DB().SetMaxIdleConns(0)
+	}
+	return true, err
+}
+
+func (this *DBPools) maxIdle() int {
+	if this.Config.MaxIdle > 0 {
+		return this.Config.MaxIdle
+	}
+	return DefaultMaxIdleConns
+}
+
+// Idle marks the site as idle, releasing the idle connections of its shared
+// pools used only by idle sites.
+func (this *DBPools) Idle(siteName string) {
+	this.setIdle(siteName, true)
+}
+
+// Wake marks the site as not idle, restoring the idle connections of its
+// shared pools.
+func (this *DBPools) Wake(siteName string) {
+	this.setIdle(siteName, false)
+}
+
+func (this *DBPools) setIdle(siteName string, idle bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	sp := this.sites[siteName]
+	if sp == nil {
+		return
+	}
+	for _, key := range sp.keys {
+		pool := this.pools[key]
+		if pool == nil || pool.idle[siteName] == idle {
+			continue
+		}
+		wasIdle := pool.allIdle()
+		if idle {
+			pool.idle[siteName] = true
+		} else {
+			delete(pool.idle, siteName)
+		}
+		if isIdle := pool.allIdle(); isIdle != wasIdle {
+			if isIdle {
+				pool.db.DB().SetMaxIdleConns(0)
+			} else {
+				pool.db.DB().SetMaxIdleConns(this.maxIdle())
+			}
+		}
+	}
+}
+
+// Acquire takes a request slot of the site limit, waiting until ctx is done.
+// The slot does not hold a DB connection.
+func (this *DBPools) Acquire(ctx context.Context, siteName string) (release func(), err error) {
+	this.mu.Lock()
+	sp := this.sites[siteName]
+	this.mu.Unlock()
+	if sp == nil || sp.sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case sp.sem <- struct{}{}:
+	default:
+		atomic.AddInt64(&sp.waits, 1)
+		select {
+		case sp.sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	atomic.AddInt64(&sp.requests, 1)
+	return func() {
+		atomic.AddInt64(&sp.requests, -1)
+		<-sp.sem
+	}, nil
+}
+
+func (this *DBPools) Middleware() *xroute.Middleware {
+	md := xroute.NewMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if site := RequestSite(r); site != nil {
+				release, err := this.Acquire(r.Context(), site.Name())
+				if err != nil {
+					w.Header().Set("Retry-After", "1")
+					http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+					return
+				}
+				defer release()
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	md.Name = PKG + ".DBPools"
+	return md
+}
+
+// DBPoolStats are the metrics of a shared pool.
+type DBPoolStats struct {
+	Key   string
+	Sites []string
+	sql.DBStats
+}
+
+// SiteDBPoolStats are the metrics of the site requests limit.
+type SiteDBPoolStats struct {
+	Limit int
+	// Requests the requests in progress
+	Requests int64
+	// Waits the requests that waited for a slot
+	Waits int64
+}
+
+// DBPoolsReport are the metrics of the shared pools and of the limits of their
+// sites, by site name.
+type DBPoolsReport struct {
+	Pools []DBPoolStats
+	Sites map[string]SiteDBPoolStats
+}
+
+// Stats returns the metrics of the shared pools, sorted by key.
+func (this *DBPools) Stats() (stats []DBPoolStats) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for key, pool := range this.pools {
+		s := DBPoolStats{Key: key, DBStats: pool.db.DB().Stats()}
+		for siteName := range pool.sites {
+			s.Sites = append(s.Sites, siteName)
+		}
+		sort.Strings(s.Sites)
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Key < stats[j].Key
+	})
+	return
+}
+
+// SiteStats returns the metrics of the site limit.
+func (this *DBPools) SiteStats(siteName string) (stats SiteDBPoolStats) {
+	this.mu.Lock()
+	sp := this.sites[siteName]
+	this.mu.Unlock()
+	if sp == nil {
+		return
+	}
+	stats.Limit = cap(sp.sem)
+	stats.Requests = atomic.LoadInt64(&sp.requests)
+	stats.Waits = atomic.LoadInt64(&sp.waits)
+	return
+}
+
+// Report returns the metrics of the shared pools and of their sites.
+func (this *DBPools) Report() (report DBPoolsReport) {
+	report.Pools = this.Stats()
+	report.Sites = map[string]SiteDBPoolStats{}
+	for _, pool := range report.Pools {
+		for _, siteName := range pool.Sites {
+			if _, ok := report.Sites[siteName]; !ok {
+				report.Sites[siteName] = this.SiteStats(siteName)
+			}
+		}
+	}
+	return
+}
+
+// IsShared reports whether the site DB uses a shared pool.
+func (this *DBPools) IsShared(siteName, dbName string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if sp := this.sites[siteName]; sp != nil {
+		_, ok := sp.keys[dbName]
+		return ok
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package sites
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ecletus/core"
+	"github.com/ecletus/core/db/dbconfig"
+)
+
+func TestDBPoolKey(t *testing.T) {
+	cfg := func() *dbconfig.DBConfig {
+		return &dbconfig.DBConfig{Adapter: "postgres", Host: "db", User: "app", Password: "a", Name: "sites"}
+	}
+	a, b := cfg(), cfg()
+	b.Password = "b"
+	if DBPoolKey(a) != DBPoolKey(b) {
+		t.Errorf("the password changed the key: %q != %q", DBPoolKey(a), DBPoolKey(b))
+	}
+	b.Host = "other"
+	if DBPoolKey(a) == DBPoolKey(b) {
+		t.Errorf("the configs of other hosts have the same key %q", DBPoolKey(a))
+	}
+	if a.Password != "a" {
+		t.Errorf("the config was changed")
+	}
+}
+
+func TestDBPoolsAcquire(t *testing.T) {
+	pools := NewDBPools(&DBPoolsConfig{})
+	pools.sites["a"] = &sitePool{keys: map[string]string{}, sem: make(chan struct{}, 1)}
+
+	release, err := pools.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := pools.SiteStats("a"); stats.Limit != 1 || stats.Requests != 1 || stats.Waits != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := pools.Acquire(ctx, "a"); err != context.DeadlineExceeded {
+		t.Errorf("acquire over the limit: %v", err)
+	}
+	if stats := pools.SiteStats("a"); stats.Requests != 1 || stats.Waits != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	release()
+	if release, err = pools.Acquire(context.Background(), "a"); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	release()
+
+	// the sites without limit are not gated
+	if _, err := pools.Acquire(context.Background(), "other"); err != nil {
+		t.Errorf("acquire of unlimited site: %v", err)
+	}
+}
+
+func TestDBPoolsControl(t *testing.T) {
+	control, cleanup := newTestControl(t)
+	defer cleanup()
+	router := NewSitesRouter(&core.SitesRegister{}, nil)
+	router.Control, router.DBPools = control, NewDBPools(&DBPoolsConfig{})
+	router.HandleControl(nil)
+	if err := control.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+
+	var report DBPoolsReport
+	if err := control.Call(context.Background(), "db-pools", nil, &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Pools) != 0 || len(report.Sites) != 0 {
+		t.Errorf("report = %+v", report)
+	}
+	// rename needs the site factory
+	if err := control.Call(context.Background(), "rename", renameArgs{"a", "b"}, nil); err == nil || err == ErrNoControl {
+		t.Errorf("rename without factory: %v", err)
+	}
+}
+
+func TestSharedPoolAllIdle(t *testing.T) {
+	pool := &sharedPool{sites: map[string]bool{}, idle: map[string]bool{}}
+	if pool.allIdle() {
+		t.Error("pool without sites is idle")
+	}
+	pool.sites["a"], pool.sites["b"] = true, true
+	pool.idle["a"] = true
+	if pool.allIdle() {
+		t.Error("pool with a used site is idle")
+	}
+	pool.idle["b"] = true
+	if !pool.allIdle() {
+		t.Error("pool with idle sites is not idle")
+	}
+}
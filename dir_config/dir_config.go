@@ -1,38 +1,221 @@
 package dir_config
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
-	"gopkg.in/yaml.v2"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 
 	"github.com/go-errors/errors"
 	"github.com/moisespsena-go/maps"
+
+	"github.com/ecletus/sites/secrets"
 )
 
 var ErrSiteDisabled = errors.New("site disabled")
 
+const (
+	// EnvVar is the environment variable of the active environment.
+	EnvVar = "CONFIG_ENV"
+	// EnvDir is the root directory of the environment overlay directories.
+	EnvDir = "env"
+	// ExtendsKey is the top level key of the files extended by a config file.
+	ExtendsKey = "extends"
+	// IncludeTag is the YAML tag that replaces the value by the content of a file.
+	IncludeTag = "!include"
+)
+
 func KeyName(fileName string) (v string) {
 	if pos := strings.LastIndexByte(fileName, '.'); pos >= 0 {
 		v = fileName[0:pos]
 	} else {
 		v = fileName
 	}
+	if v == "" {
+		// hidden file or dir
+		return fileName
+	}
 	if v[0] == '/' || v[0] == '\\' || v[0] == '_' {
 		v = v[1:]
 	}
 	return
 }
 
+// DefaultKnownEnvs are the default Loader.KnownEnvs.
+var DefaultKnownEnvs = []string{"development", "dev", "test", "testing", "ci", "staging", "production", "prod"}
+
+// ConfigFileExts are the extensions of the config files.
+var ConfigFileExts = []string{".yaml", ".yml", ".json", ".toml"}
+
 func ValidConfigFile(fileName string) bool {
-	return fileName[0] != '.' && (strings.HasSuffix(fileName, ".yaml") || strings.HasSuffix(fileName, ".yml"))
+	if fileName[0] == '.' {
+		return false
+	}
+	for _, ext := range ConfigFileExts {
+		if strings.HasSuffix(fileName, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Loader loads the config tree of a directory, recording the source location of each key.
+type Loader struct {
+	KeyNamers []func(dir, name string, isdir bool) string
+	Sources   Sources
+	// Conflicts the keys overridden by other files or directories
+	Conflicts []Conflict
+	// Env the active environment, as the value of EnvVar. The overlays of the
+	// environment are merged over the base tree: the `KEY.ENV.EXT` files of
+	// each directory, then the `env/ENV/` directory of the root. If blank, the
+	// overlays are disabled and the `env` directory and the `KEY.ENV.EXT` files
+	// are loaded as any other.
+	Env string
+	// KnownEnvs the environments of the overlay files not loaded if not active.
+	// Defaults to DefaultKnownEnvs.
+	KnownEnvs []string
+	// NoExpand disables the expansion of the references (see Expander)
+	NoExpand bool
+	// Migrate upgrades the loaded tree before the expansion, returning the
+	// changes made. Defaults to DefaultMigrate.
+	Migrate func(cfg maps.MapSI) ([]Change, error)
+	// NoMigrate disables the migration, as to rewrite the files of an old tree
+	NoMigrate bool
+	// Changes the changes made by the migration
+	Changes []Change
+	// ExpandSkip top level keys not expanded. Defaults to DefaultExpandSkip.
+	ExpandSkip []string
+	// SkipDirs the names of the directories not loaded, as the directories of
+	// the fragments shared by `extends` and `!include`. All directories are
+	// loaded by default.
+	SkipDirs []string
+	// Warnings the non fatal issues of the loaded files
+	Warnings []Warning
+}
+
+// Warning is a non fatal issue of a config file.
+type Warning struct {
+	Location Location
+	Message  string
+}
+
+func (this Warning) String() string {
+	return this.Location.String() + ": " + this.Message
+}
+
+// DefaultMigrate is the default Loader.Migrate. The package of the config
+// format sets it, so that all the loaders upgrade the trees.
+var DefaultMigrate func(cfg maps.MapSI) ([]Change, error)
+
+// yaml11Bools the YAML 1.1 booleans, read as strings by YAML 1.2.
+var yaml11Bools = map[string]bool{
+	"y": true, "Y": true, "yes": true, "Yes": true, "YES": true,
+	"on": true, "On": true, "ON": true,
+	"n": false, "N": false, "no": false, "No": false, "NO": false,
+	"off": false, "Off": false, "OFF": false,
+}
+
+func NewLoader(keyNamer ...func(dir, name string, isdir bool) string) *Loader {
+	return &Loader{
+		KeyNamers:  keyNamer,
+		Sources:    Sources{},
+		ExpandSkip: DefaultExpandSkip,
+		KnownEnvs:  DefaultKnownEnvs,
+	}
 }
 
 func LoadMainConfig(dir string, keyNamer ...func(dir, name string, isdir bool) string) (mainConfig maps.MapSI, err error) {
+	return NewLoader(keyNamer...).Load(dir)
+}
+
+func (this *Loader) migrate(cfg maps.MapSI) (err error) {
+	migrate := this.Migrate
+	if migrate == nil {
+		migrate = DefaultMigrate
+	}
+	if this.NoMigrate || migrate == nil {
+		return
+	}
+	if this.Changes, err = migrate(cfg); err != nil {
+		return
+	}
+	for _, change := range this.Changes {
+		if change.Op == ChangeRename {
+			this.Sources.Move(change.Path, change.To)
+		}
+	}
+	return
+}
+
+// SkipExpand adds the top level keys not expanded by Load.
+func (this *Loader) SkipExpand(keys ...string) {
+	skip := append([]string{}, this.ExpandSkip...)
+keys:
+	for _, key := range keys {
+		for _, s := range skip {
+			if s == key {
+				continue keys
+			}
+		}
+		skip = append(skip, key)
+	}
+	this.ExpandSkip = skip
+}
+
+// Load loads the config tree of dir.
+func (this *Loader) Load(dir string) (mainConfig maps.MapSI, err error) {
+	if this.Sources == nil {
+		this.Sources = Sources{}
+	}
+	if mainConfig, err = this.loadDir(dir, nil); err != nil {
+		return
+	}
+	if this.Env != "" {
+		envDir := filepath.Join(dir, EnvDir, this.Env)
+		if _, err = os.Stat(envDir); err == nil {
+			var overlay maps.MapSI
+			if overlay, err = this.loadDir(envDir, nil); err != nil {
+				return nil, errors.WrapPrefix(err, "env dir `"+envDir+"`", 1)
+			}
+			Merge(mainConfig, overlay)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		} else {
+			err = nil
+		}
+	}
+	if err = this.migrate(mainConfig); err != nil {
+		return nil, errors.WrapPrefix(err, "migrate config failed", 1)
+	}
+	if this.NoExpand {
+		return
+	}
+	if _, err = ExpandConfig(mainConfig, dir, this.ExpandSkip...); err != nil {
+		return nil, errors.WrapPrefix(err, "expand config failed", 1)
+	}
+	return
+}
+
+func (this *Loader) keyName(dir, name string, isdir bool) (keyName string) {
+	for _, knr := range this.KeyNamers {
+		if keyName = knr(dir, name, isdir); keyName != "" {
+			break
+		}
+	}
+	if keyName == "" {
+		keyName = KeyName(name)
+	}
+	return
+}
+
+func (this *Loader) loadDir(dir string, prefix []string) (mainConfig maps.MapSI, err error) {
 	var fileInfos []os.FileInfo
 
 	if fileInfos, err = ioutil.ReadDir(dir); err != nil {
@@ -42,36 +225,41 @@ func LoadMainConfig(dir string, keyNamer ...func(dir, name string, isdir bool) s
 	var (
 		main     string
 		mainKeys [][2]string
-		subs []string
-		keyNameOf = func(name string, isdir bool) (keyName string) {
-			for _, knr := range keyNamer {
-				if keyName = knr(dir, name, isdir); keyName != "" {
-					break
-				}
-			}
-			if keyName == "" {
-				keyName = KeyName(name)
-			}
-			return
-		}
+		overlays [][2]string
+		subs     []string
+		files    = map[string]string{}
 	)
 
 	for _, f := range fileInfos {
 		if f.IsDir() {
-			subs = append(subs, f.Name())
+			if !this.skipDir(f.Name(), prefix) {
+				subs = append(subs, f.Name())
+			}
+			continue
 		}
-		if ValidConfigFile(f.Name()) {
-			var keyName = keyNameOf(f.Name(), false)
-			if keyName == "config" {
-				main = f.Name()
-				continue
+		if !ValidConfigFile(f.Name()) {
+			continue
+		}
+		if base, env, ok := this.splitEnv(f.Name()); ok {
+			if env == this.Env {
+				overlays = append(overlays, [2]string{f.Name(), this.keyName(dir, base, false)})
 			}
+			continue
+		}
+		keyName := this.keyName(dir, f.Name(), false)
+		if other, ok := files[keyName]; ok {
+			return nil, fmt.Errorf("%s: files %q and %q set the same key %q", dir, other, f.Name(), keyName)
+		}
+		files[keyName] = f.Name()
+		if keyName == "config" {
+			main = f.Name()
+		} else {
 			mainKeys = append(mainKeys, [2]string{f.Name(), keyName})
 		}
 	}
 
 	if main != "" {
-		if mainConfig, err = load(filepath.Join(dir, main)); err != nil {
+		if mainConfig, err = this.load(filepath.Join(dir, main), prefix); err != nil {
 			return nil, fmt.Errorf("load main config %q failed: %v", main, err)
 		}
 	}
@@ -81,48 +269,501 @@ func LoadMainConfig(dir string, keyNamer ...func(dir, name string, isdir bool) s
 	}
 
 	for _, name := range mainKeys {
-		pth := filepath.Join(dir, name[0])
-		if cfg, err := load(pth); err != nil {
+		var (
+			pth     = filepath.Join(dir, name[0])
+			keyPath = appendPath(prefix, name[1])
+			before  = this.Sources.snapshot(keyPath)
+		)
+		if cfg, err := this.load(pth, keyPath); err != nil {
 			return nil, fmt.Errorf("load main %q config failed: %v", pth, err)
 		} else {
+			if _, ok := mainConfig[name[1]]; ok {
+				this.addConflicts(before, keyPath, cfg)
+			}
 			mainConfig.Set(name[1], cfg)
 		}
 	}
 
 	for _, name := range subs {
 		var (
-			pth  = filepath.Join(dir, name)
-			sub  maps.MapSI
+			pth     = filepath.Join(dir, name)
+			keyName = this.keyName(dir, name, true)
+			keyPath = appendPath(prefix, keyName)
+			before  = this.Sources.snapshot(keyPath)
+			sub     maps.MapSI
 		)
-		if sub, err = LoadMainConfig(pth, keyNamer...); err != nil {
+		if sub, err = this.loadDir(pth, keyPath); err != nil {
 			return nil, errors.WrapPrefix(err, "dir `"+pth+"`", 1)
 		} else if sub != nil && len(sub) > 0 {
-			name = keyNameOf(name, true)
-			if _, ok := mainConfig[name]; ok {
-				if err = sub.CopyTo(mainConfig[name]); err != nil {
+			if _, ok := mainConfig[keyName]; ok {
+				this.addConflicts(before, keyPath, sub)
+				if err = sub.CopyTo(mainConfig[keyName]); err != nil {
 					return nil, errors.WrapPrefix(err, "cfg `"+pth+" copy to parent failed`", 1)
 				}
 			} else {
-				mainConfig[name] = sub
+				mainConfig[keyName] = sub
 			}
 		}
 	}
 
+	sort.SliceStable(overlays, func(i, j int) bool {
+		return overlays[i][1] == "config" && overlays[j][1] != "config"
+	})
+
+	for _, name := range overlays {
+		var (
+			pth     = filepath.Join(dir, name[0])
+			keyPath = prefix
+			overlay maps.MapSI
+		)
+		if name[1] != "config" {
+			keyPath = appendPath(prefix, name[1])
+		}
+		if overlay, err = this.load(pth, keyPath); err != nil {
+			return nil, fmt.Errorf("load overlay %q failed: %v", pth, err)
+		}
+		if name[1] == "config" {
+			Merge(mainConfig, overlay)
+		} else if base, ok := mainConfig[name[1]].(maps.MapSI); ok {
+			Merge(base, overlay)
+		} else {
+			mainConfig[name[1]] = overlay
+		}
+	}
+
 	return
 }
 
-func load(path string) (data maps.MapSI, err error) {
-	f, err := os.Open(path)
-	if err != nil {
+// skipDir returns if the directory name of the key path prefix is not loaded.
+func (this *Loader) skipDir(name string, prefix []string) bool {
+	if this.Env != "" && len(prefix) == 0 && name == EnvDir {
+		return true
+	}
+	for _, skip := range this.SkipDirs {
+		if name == skip {
+			return true
+		}
+	}
+	return false
+}
+
+// splitEnv splits the overlay file name `KEY.ENV.EXT` into `KEY.EXT` and ENV.
+func (this *Loader) splitEnv(fileName string) (base, env string, ok bool) {
+	if this.Env == "" {
+		return
+	}
+	ext := filepath.Ext(fileName)
+	name := strings.TrimSuffix(fileName, ext)
+	pos := strings.LastIndexByte(name, '.')
+	if pos <= 0 {
+		return
+	}
+	env = name[pos+1:]
+	if env != this.Env {
+		var known bool
+		for _, e := range this.KnownEnvs {
+			if e == env {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return "", "", false
+		}
+	}
+	return name[:pos] + ext, env, true
+}
+
+// addConflicts records the paths of value set before from another file.
+func (this *Loader) addConflicts(before Sources, prefix []string, value interface{}) {
+	switch t := value.(type) {
+	case maps.MapSI:
+		for key, v := range t {
+			this.addConflicts(before, appendPath(prefix, key), v)
+		}
+	default:
+		keyPath := KeyPath(prefix...)
+		if old, ok := before[keyPath]; ok {
+			if loc := this.Sources[keyPath]; loc.File != old.File {
+				this.Conflicts = append(this.Conflicts, Conflict{prefix, old, loc})
+			}
+		}
+	}
+}
+
+func (this *Loader) load(pth string, prefix []string) (data maps.MapSI, err error) {
+	return this.loadFile(pth, prefix, nil)
+}
+
+// loadFile loads the file pth, resolving its `extends` and `!include` directives.
+// stack is the chain of files being loaded, to detect cycles.
+func (this *Loader) loadFile(pth string, prefix []string, stack []string) (data maps.MapSI, err error) {
+	if stack, err = pushFile(stack, pth); err != nil {
+		return
+	}
+
+	var value interface{}
+
+	switch filepath.Ext(pth) {
+	case ".json", ".toml":
+		if value, err = decodeFile(pth); err != nil || value == nil {
+			return
+		}
+		var ok bool
+		if data, ok = value.(maps.MapSI); !ok {
+			return nil, fmt.Errorf("%s: root value is not a map", pth)
+		}
+		var bases maps.MapSI
+		if bases, err = this.loadExtends(pth, prefix, stack, data[ExtendsKey]); err != nil {
+			return
+		}
+		delete(data, ExtendsKey)
+		this.Sources.Add(prefix, Location{File: pth})
+		this.addValueSources(pth, prefix, data)
+		if bases != nil {
+			Merge(bases, data)
+			data = bases
+		}
+		return
+	}
+
+	var node *yaml.Node
+	if node, err = parseYAML(pth); err != nil || node == nil {
+		return
+	}
+	tagSecrets(node)
+	this.yaml11Bools(pth, node)
+
+	var bases maps.MapSI
+	if extends := mappingValue(node.Content[0], ExtendsKey); extends != nil {
+		var v interface{}
+		if err = extends.Decode(&v); err != nil {
+			return nil, fmt.Errorf("%s: %v", pth, err)
+		}
+		if bases, err = this.loadExtends(pth, prefix, stack, v); err != nil {
+			return
+		}
+	}
+
+	included := map[*yaml.Node]bool{}
+	if err = this.resolveIncludes(pth, prefix, stack, node, included); err != nil {
+		return
+	}
+
+	this.Sources.Add(prefix, Location{File: pth, Line: 1, Column: 1})
+	this.addSources(pth, prefix, node, included)
+
+	var cfg map[string]interface{}
+	if err = node.Decode(&cfg); err != nil {
 		return nil, err
 	}
+	data = Normalize(cfg).(maps.MapSI)
+	delete(data, ExtendsKey)
+	if bases != nil {
+		Merge(bases, data)
+		data = bases
+	}
+	return
+}
+
+// loadExtends loads and merges the base files of the `extends` value.
+func (this *Loader) loadExtends(pth string, prefix []string, stack []string, extends interface{}) (bases maps.MapSI, err error) {
+	var files []string
+	switch t := extends.(type) {
+	case nil:
+		return
+	case string:
+		files = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			files = append(files, fmt.Sprint(v))
+		}
+	default:
+		return nil, fmt.Errorf("%s: `%s` must be a path or a list of paths", pth, ExtendsKey)
+	}
+	bases = maps.MapSI{}
+	for _, file := range files {
+		var base maps.MapSI
+		if base, err = this.loadFile(relativePath(pth, file), prefix, stack); err != nil {
+			return nil, fmt.Errorf("%s: extends: %v", pth, err)
+		}
+		Merge(bases, base)
+	}
+	return
+}
+
+// resolveIncludes replaces the `!include PATH` nodes by the content of the files.
+func (this *Loader) resolveIncludes(pth string, prefix []string, stack []string, node *yaml.Node, included map[*yaml.Node]bool) (err error) {
+	if node.Kind == yaml.ScalarNode && node.Tag == IncludeTag {
+		var value interface{}
+		file := relativePath(pth, node.Value)
+		if value, err = this.loadValue(file, prefix, stack); err != nil {
+			return fmt.Errorf("%s:%d: include: %v", pth, node.Line, err)
+		}
+		line, column := node.Line, node.Column
+		*node = yaml.Node{}
+		if err = node.Encode(value); err != nil {
+			return
+		}
+		node.Line, node.Column = line, column
+		included[node] = true
+		return
+	}
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			if err = this.resolveIncludes(pth, prefix, stack, child, included); err != nil {
+				return
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if err = this.resolveIncludes(pth, appendPath(prefix, node.Content[i].Value), stack, node.Content[i+1], included); err != nil {
+				return
+			}
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			if err = this.resolveIncludes(pth, appendPath(prefix, fmt.Sprint(i)), stack, child, included); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// loadValue loads the file included. Config files are loaded with their
+// directives, other files are included as string.
+func (this *Loader) loadValue(pth string, prefix []string, stack []string) (value interface{}, err error) {
+	if ValidConfigFile(filepath.Base(pth)) {
+		var data maps.MapSI
+		if data, err = this.loadFile(pth, prefix, stack); err != nil {
+			return
+		}
+		return data, nil
+	}
+	var b []byte
+	if b, err = ioutil.ReadFile(pth); err != nil {
+		return
+	}
+	this.Sources.Add(prefix, Location{File: pth})
+	return string(b), nil
+}
+
+func (this *Loader) addSources(pth string, prefix []string, node *yaml.Node, included map[*yaml.Node]bool) {
+	if included[node] {
+		return
+	}
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			this.addSources(pth, prefix, child, included)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			keyPath := appendPath(prefix, key.Value)
+			if !included[value] {
+				this.Sources.Add(keyPath, Location{File: pth, Line: key.Line, Column: key.Column})
+			}
+			this.addSources(pth, keyPath, value, included)
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			keyPath := appendPath(prefix, fmt.Sprint(i))
+			if !included[child] {
+				this.Sources.Add(keyPath, Location{File: pth, Line: child.Line, Column: child.Column})
+			}
+			this.addSources(pth, keyPath, child, included)
+		}
+	}
+}
+
+// addValueSources records the file of each key path of value.
+func (this *Loader) addValueSources(pth string, prefix []string, value interface{}) {
+	switch t := value.(type) {
+	case maps.MapSI:
+		for key, v := range t {
+			keyPath := appendPath(prefix, key)
+			this.Sources.Add(keyPath, Location{File: pth})
+			this.addValueSources(pth, keyPath, v)
+		}
+	case []interface{}:
+		for i, v := range t {
+			keyPath := appendPath(prefix, fmt.Sprint(i))
+			this.Sources.Add(keyPath, Location{File: pth})
+			this.addValueSources(pth, keyPath, v)
+		}
+	}
+}
+
+// tagSecrets converts the `!secret PATH` scalars into the secret reference strings.
+func tagSecrets(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode && node.Tag == secrets.Tag {
+		node.Tag = "!!str"
+		node.Value = secrets.Ref(node.Value)
+		return
+	}
+	for _, child := range node.Content {
+		tagSecrets(child)
+	}
+}
+
+// yaml11Bools converts the plain YAML 1.1 booleans values (yes, no, on, off...)
+// of node into booleans, as read by the previous YAML parser, warning them.
+func (this *Loader) yaml11Bools(pth string, node *yaml.Node) {
+	convert := func(value *yaml.Node) {
+		if value.Kind != yaml.ScalarNode || value.Tag != "!!str" || value.Style != 0 {
+			return
+		}
+		if b, ok := yaml11Bools[value.Value]; ok {
+			this.Warnings = append(this.Warnings, Warning{
+				Location{File: pth, Line: value.Line, Column: value.Column},
+				fmt.Sprintf("YAML 1.1 boolean `%s` read as %v. Use `%v` or quote it.", value.Value, b, b),
+			})
+			value.Tag = "!!bool"
+			value.Value = fmt.Sprint(b)
+		}
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			convert(node.Content[i])
+		}
+	case yaml.SequenceNode:
+		for _, child := range node.Content {
+			convert(child)
+		}
+	}
+	for _, child := range node.Content {
+		this.yaml11Bools(pth, child)
+	}
+}
 
-	defer f.Close()
+func parseYAML(pth string) (node *yaml.Node, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(pth); err != nil {
+		return
+	}
+	node = &yaml.Node{}
+	if err = yaml.Unmarshal(data, node); err != nil {
+		return nil, err
+	}
+	if len(node.Content) == 0 {
+		return nil, nil
+	}
+	return
+}
 
+func decodeFile(pth string) (value interface{}, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(pth); err != nil {
+		return
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
 	var cfg map[string]interface{}
+	switch filepath.Ext(pth) {
+	case ".json":
+		err = json.Unmarshal(data, &cfg)
+	case ".toml":
+		err = toml.Unmarshal(data, &cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", pth, err)
+	}
+	return Normalize(cfg), nil
+}
 
-	if err = yaml.NewDecoder(f).Decode(&cfg); err != nil && err != io.EOF {
+// mappingValue returns the value node of key in the mapping node.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func pushFile(stack []string, pth string) ([]string, error) {
+	abs, err := filepath.Abs(pth)
+	if err != nil {
 		return nil, err
 	}
-	return cfg, nil
+	for i, file := range stack {
+		if file == abs {
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(append(stack[i:], abs), " -> "))
+		}
+	}
+	return append(append(make([]string, 0, len(stack)+1), stack...), abs), nil
+}
+
+func relativePath(from, pth string) string {
+	if filepath.IsAbs(pth) {
+		return pth
+	}
+	return filepath.Join(filepath.Dir(from), pth)
+}
+
+// Merge merges recursively src into dst. The maps are merged, other values replaced.
+func Merge(dst, src maps.MapSI) {
+	for key, value := range src {
+		if srcMap, ok := value.(maps.MapSI); ok {
+			if dstMap, ok := dst[key].(maps.MapSI); ok {
+				Merge(dstMap, srcMap)
+				continue
+			}
+			value = copyMap(srcMap)
+		}
+		dst[key] = value
+	}
+}
+
+func copyMap(m maps.MapSI) maps.MapSI {
+	c := make(maps.MapSI, len(m))
+	Merge(c, m)
+	return c
+}
+
+func appendPath(prefix []string, key ...string) []string {
+	return append(append(make([]string, 0, len(prefix)+len(key)), prefix...), key...)
+}
+
+// Normalize converts recursively the maps of value into maps.MapSI.
+func Normalize(value interface{}) interface{} {
+	switch t := value.(type) {
+	case maps.MapSI:
+		for k, v := range t {
+			t[k] = Normalize(v)
+		}
+		return t
+	case map[string]interface{}:
+		m := make(maps.MapSI, len(t))
+		for k, v := range t {
+			m[k] = Normalize(v)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(maps.MapSI, len(t))
+		for k, v := range t {
+			m[fmt.Sprint(k)] = Normalize(v)
+		}
+		return m
+	case []interface{}:
+		for i, v := range t {
+			t[i] = Normalize(v)
+		}
+		return t
+	case []map[string]interface{}:
+		items := make([]interface{}, len(t))
+		for i, v := range t {
+			items[i] = Normalize(v)
+		}
+		return items
+	}
+	return value
 }
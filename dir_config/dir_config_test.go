@@ -0,0 +1,151 @@
+package dir_config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moisespsena-go/maps"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "dir_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		pth := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(pth, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadYAML11Bools(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml": "alone: yes\nrate_limit: Off\nname: \"no\"\nlist: [on, x]\n",
+	})
+	defer os.RemoveAll(dir)
+
+	loader := NewLoader()
+	loader.Env = ""
+	cfg, err := loader.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg["alone"] != true || cfg["rate_limit"] != false {
+		t.Errorf("bools = %#v, %#v", cfg["alone"], cfg["rate_limit"])
+	}
+	if cfg["name"] != "no" {
+		t.Errorf("quoted string = %#v", cfg["name"])
+	}
+	if list := cfg["list"].([]interface{}); list[0] != true || list[1] != "x" {
+		t.Errorf("list = %#v", list)
+	}
+	if len(loader.Warnings) != 3 {
+		t.Fatalf("warnings = %v, want 3", loader.Warnings)
+	}
+	if loc := loader.Warnings[0].Location; loc.Line != 1 || loc.Column != 8 {
+		t.Errorf("first warning location = %s", loc)
+	}
+}
+
+func TestLoadSameKeyFiles(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml": "alone: true\n",
+		"config.json": `{"alone": false}`,
+	})
+	defer os.RemoveAll(dir)
+
+	if _, err := NewLoader().Load(dir); err == nil {
+		t.Fatal("expected error of config.yaml and config.json")
+	}
+}
+
+func TestLoadSkipDirs(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml":             "db: !include shared/db.yaml\n",
+		"sites/a.yaml":            "extends: ../shared/site.yaml\nname: a\n",
+		"shared/db.yaml":          "host: localhost\n",
+		"shared/site.yaml":        "theme: dark\n",
+		".hidden/config.yaml":     "x: 1\n",
+		"sites/.local/config.yml": "y: 2\n",
+	})
+	defer os.RemoveAll(dir)
+
+	loader := NewLoader()
+	loader.Env = ""
+	cfg, err := loader.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg["shared"]; !ok {
+		t.Error("expected the shared dir loaded by default")
+	}
+	if _, ok := cfg[".hidden"]; !ok {
+		t.Errorf("expected the hidden dir loaded, got %v", cfg)
+	}
+
+	loader = NewLoader()
+	loader.Env = ""
+	loader.SkipDirs = []string{"shared"}
+	if cfg, err = loader.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg["shared"]; ok {
+		t.Error("skipped dir loaded")
+	}
+	if host := cfg["db"].(maps.MapSI)["host"]; host != "localhost" {
+		t.Errorf("included host = %v", host)
+	}
+	site := cfg["sites"].(maps.MapSI)["a"].(maps.MapSI)
+	if site["theme"] != "dark" || site["name"] != "a" {
+		t.Errorf("extended site = %v", site)
+	}
+}
+
+func TestLoadEnvOverlaysOptIn(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml":          "a: 1\n",
+		"config.prod.yaml":     "a: 2\n",
+		"db.dev.yaml":          "host: dev\n",
+		"env/prod/config.yaml": "b: 3\n",
+	})
+	defer os.RemoveAll(dir)
+
+	os.Setenv(EnvVar, "prod")
+	defer os.Unsetenv(EnvVar)
+
+	// disabled by default, loaded as any other file and dir
+	cfg, err := NewLoader().Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg["a"] != 1 || cfg["b"] != nil {
+		t.Errorf("overlays merged without Env: %v", cfg)
+	}
+	for _, key := range []string{"config.prod", "db.dev", "env"} {
+		if _, ok := cfg[key]; !ok {
+			t.Errorf("key %q not loaded without Env", key)
+		}
+	}
+
+	loader := NewLoader()
+	loader.Env = "prod"
+	if cfg, err = loader.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if cfg["a"] != 2 || cfg["b"] != 3 {
+		t.Errorf("overlays not merged: %v", cfg)
+	}
+	for _, key := range []string{"config.prod", "db.dev", "env"} {
+		if _, ok := cfg[key]; ok {
+			t.Errorf("overlay key %q loaded with Env", key)
+		}
+	}
+}
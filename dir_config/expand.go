@@ -0,0 +1,256 @@
+package dir_config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moisespsena-go/maps"
+	"gopkg.in/yaml.v3"
+)
+
+// VarsKey is the key of the user defined vars, at the top level and on each site.
+const VarsKey = "vars"
+
+// DefaultExpandSkip are the top level keys not expanded by the Loader. The
+// sites are expanded when merged, using the site vars.
+var DefaultExpandSkip = []string{"sites", "site_template"}
+
+// Expander expands the references of the config strings:
+//
+//	${env:NAME}          the environment variable NAME, if set, even if empty
+//	${env:NAME:-x}       the environment variable NAME, or x if not set or empty
+//	${file:/path}        the trimmed content of the file. Relative paths are relative to Dir.
+//	${var:NAME}          the user defined var NAME
+//	${default:x}         the literal x
+//
+// Alternatives are separated by `|` and the first defined value wins, as in
+// `${env:PORT|var:port|default:8080}`. `$${` escapes a literal `${`. References
+// without a known prefix, as `${NAME}`, are kept.
+//
+// A value that is a single reference takes the type of the expanded scalar,
+// following the YAML rules: `port: ${env:PORT}` is a integer, if PORT is.
+type Expander struct {
+	Vars      map[string]string
+	Dir       string
+	LookupEnv func(key string) (string, bool)
+	ReadFile  func(pth string) ([]byte, error)
+	parent    *Expander
+}
+
+// NewExpander creates a expander with the vars, expanding them first.
+func NewExpander(vars maps.MapSI) (*Expander, error) {
+	return (&Expander{LookupEnv: os.LookupEnv, ReadFile: ioutil.ReadFile}).Child(vars)
+}
+
+// Child creates a expander with the vars overriding the vars of this.
+func (this *Expander) Child(vars maps.MapSI) (child *Expander, err error) {
+	child = &Expander{
+		Vars:      map[string]string{},
+		Dir:       this.Dir,
+		LookupEnv: this.LookupEnv,
+		ReadFile:  this.ReadFile,
+		parent:    this,
+	}
+	for name := range vars {
+		if _, err = child.lookupVar(name, vars, map[string]bool{}); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func (this *Expander) lookupVar(name string, pending maps.MapSI, visiting map[string]bool) (value string, err error) {
+	if value, ok := this.Vars[name]; ok {
+		return value, nil
+	}
+	if raw, ok := pending[name]; ok {
+		if visiting[name] {
+			return "", fmt.Errorf("var %q: reference cycle", name)
+		}
+		visiting[name] = true
+		defer delete(visiting, name)
+		if value, err = this.expandString(fmt.Sprint(raw), func(ref string) (string, bool, error) {
+			v, err := this.lookupVar(ref, pending, visiting)
+			return v, err == nil, err
+		}); err != nil {
+			return "", fmt.Errorf("var %q: %v", name, err)
+		}
+		this.Vars[name] = value
+		return
+	}
+	if this.parent != nil {
+		return this.parent.lookupVar(name, nil, visiting)
+	}
+	return "", fmt.Errorf("var %q is not defined", name)
+}
+
+// ExpandString expands the references of s.
+func (this *Expander) ExpandString(s string) (string, error) {
+	return this.expandString(s, func(ref string) (string, bool, error) {
+		v, err := this.lookupVar(ref, nil, map[string]bool{})
+		return v, err == nil, nil
+	})
+}
+
+func (this *Expander) expandString(s string, lookupVar func(name string) (string, bool, error)) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var out strings.Builder
+	for {
+		pos := strings.Index(s, "${")
+		if pos < 0 {
+			out.WriteString(s)
+			break
+		}
+		if pos > 0 && s[pos-1] == '$' {
+			out.WriteString(s[:pos-1] + "${")
+			s = s[pos+2:]
+			continue
+		}
+		end := strings.IndexByte(s[pos:], '}')
+		if end < 0 {
+			out.WriteString(s)
+			break
+		}
+		out.WriteString(s[:pos])
+		expr := s[pos+2 : pos+end]
+		value, ok, err := this.eval(expr, lookupVar)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			out.WriteString(value)
+		} else {
+			out.WriteString("${" + expr + "}")
+		}
+		s = s[pos+end+1:]
+	}
+	return out.String(), nil
+}
+
+// eval evaluates the alternatives of expr. Returns false if expr is not a known reference.
+func (this *Expander) eval(expr string, lookupVar func(name string) (string, bool, error)) (value string, ok bool, err error) {
+	var errs []string
+	for _, alt := range strings.Split(expr, "|") {
+		parts := strings.SplitN(alt, ":", 2)
+		if len(parts) != 2 {
+			return "", false, nil
+		}
+		kind, arg := strings.TrimSpace(parts[0]), parts[1]
+		switch kind {
+		case "env":
+			name, def, hasDef := arg, "", false
+			if pos := strings.Index(arg, ":-"); pos >= 0 {
+				name, def, hasDef = arg[:pos], arg[pos+2:], true
+			}
+			v, found := this.LookupEnv(strings.TrimSpace(name))
+			if found && (v != "" || !hasDef) {
+				return v, true, nil
+			}
+			if hasDef {
+				return def, true, nil
+			}
+			errs = append(errs, fmt.Sprintf("environment variable %q is not set", name))
+		case "file":
+			pth := strings.TrimSpace(arg)
+			if !filepath.IsAbs(pth) && this.Dir != "" {
+				pth = filepath.Join(this.Dir, pth)
+			}
+			data, rerr := this.ReadFile(pth)
+			if rerr == nil {
+				if v := strings.TrimSpace(string(data)); v != "" {
+					return v, true, nil
+				}
+				errs = append(errs, fmt.Sprintf("file %q is empty", pth))
+			} else {
+				errs = append(errs, rerr.Error())
+			}
+		case "var":
+			v, found, verr := lookupVar(strings.TrimSpace(arg))
+			if verr != nil {
+				return "", false, verr
+			}
+			if found {
+				return v, true, nil
+			}
+			errs = append(errs, fmt.Sprintf("var %q is not defined", arg))
+		case "default":
+			return arg, true, nil
+		default:
+			return "", false, nil
+		}
+	}
+	return "", false, fmt.Errorf("${%s}: %s", expr, strings.Join(errs, "; "))
+}
+
+// Expand expands recursively the strings of value, skipping the map keys of skip.
+func (this *Expander) Expand(value interface{}, skip ...string) (_ interface{}, err error) {
+	switch t := value.(type) {
+	case string:
+		var s string
+		if s, err = this.ExpandString(t); err != nil || s == t || !isSingleRef(t) {
+			return s, err
+		}
+		return scalarValue(s), nil
+	case maps.MapSI:
+	keys:
+		for key, v := range t {
+			for _, s := range skip {
+				if s == key {
+					continue keys
+				}
+			}
+			if t[key], err = this.Expand(v); err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	case []interface{}:
+		for i, v := range t {
+			if t[i], err = this.Expand(v); err != nil {
+				return nil, fmt.Errorf("%d: %v", i, err)
+			}
+		}
+	}
+	return value, nil
+}
+
+// isSingleRef returns if s is a single reference, as `${env:PORT}`.
+func isSingleRef(s string) bool {
+	return strings.HasPrefix(s, "${") && strings.HasSuffix(s, "}") && strings.Count(s, "${") == 1 &&
+		strings.IndexByte(s, '}') == len(s)-1
+}
+
+// scalarValue returns the boolean or number of the YAML scalar s, or s.
+func scalarValue(s string) interface{} {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(s), &v); err == nil {
+		switch v.(type) {
+		case bool, int, int64, uint64, float64:
+			return v
+		}
+	}
+	return s
+}
+
+// ExpandConfig expands cfg using its top level vars, skipping the keys of
+// skip. The relative file references are relative to dir.
+func ExpandConfig(cfg maps.MapSI, dir string, skip ...string) (expander *Expander, err error) {
+	vars, _ := cfg[VarsKey].(maps.MapSI)
+	base := &Expander{Dir: dir, LookupEnv: os.LookupEnv, ReadFile: ioutil.ReadFile}
+	if expander, err = base.Child(vars); err != nil {
+		return
+	}
+	if len(vars) > 0 {
+		expanded := maps.MapSI{}
+		for name, value := range expander.Vars {
+			expanded[name] = value
+		}
+		cfg[VarsKey] = expanded
+	}
+	_, err = expander.Expand(cfg, append([]string{VarsKey}, skip...)...)
+	return
+}
@@ -0,0 +1,98 @@
+package dir_config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/moisespsena-go/maps"
+)
+
+func testExpander(t *testing.T, env map[string]string, vars maps.MapSI) *Expander {
+	base := &Expander{
+		LookupEnv: func(key string) (v string, ok bool) {
+			v, ok = env[key]
+			return
+		},
+		ReadFile: func(pth string) ([]byte, error) {
+			if pth == "/etc/app/token" {
+				return []byte(" secret\n"), nil
+			}
+			return nil, os.ErrNotExist
+		},
+	}
+	e, err := base.Child(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestExpandString(t *testing.T) {
+	e := testExpander(t, map[string]string{"HOST": "db", "EMPTY": ""}, maps.MapSI{
+		"name": "app",
+		"dsn":  "${env:HOST}/${var:name}",
+	})
+	for s, want := range map[string]string{
+		"${var:dsn}":                       "db/app",
+		"${file:/etc/app/token}":           "secret",
+		"${env:MISSING|default:x}":         "x",
+		"${env:EMPTY|default:x}":           "",
+		"${env:EMPTY:-x}":                  "x",
+		"${env:MISSING:-y}":                "y",
+		"${env:HOST:-y}":                   "db",
+		"$${env:HOST}":                     "${env:HOST}",
+		"${NAME} kept":                     "${NAME} kept",
+		"http://${env:HOST}:${default:80}": "http://db:80",
+	} {
+		got, err := e.ExpandString(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+		} else if got != want {
+			t.Errorf("%s = %q, want %q", s, got, want)
+		}
+	}
+	if _, err := e.ExpandString("${env:MISSING}"); err == nil {
+		t.Error("expected unset variable error")
+	}
+}
+
+func TestExpandVarsCycle(t *testing.T) {
+	if _, err := NewExpander(maps.MapSI{"a": "${var:b}", "b": "${var:a}"}); err == nil {
+		t.Fatal("expected reference cycle error")
+	}
+}
+
+func TestExpandScalarTypes(t *testing.T) {
+	e := testExpander(t, map[string]string{"PORT": "5432", "DEBUG": "true", "NAME": "x"}, nil)
+	cfg := maps.MapSI{
+		"port":  "${env:PORT}",
+		"debug": "${env:DEBUG}",
+		"name":  "${env:NAME}",
+		"addr":  "h:${env:PORT}",
+		"ratio": "${default:0.5}",
+		"yes":   "${default:yes}",
+	}
+	if _, err := e.Expand(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]interface{}{
+		"port":  5432,
+		"debug": true,
+		"name":  "x",
+		"addr":  "h:5432",
+		"ratio": 0.5,
+		"yes":   "yes",
+	} {
+		if cfg[key] != want {
+			t.Errorf("%s = %#v, want %#v", key, cfg[key], want)
+		}
+	}
+}
+
+func TestLoaderSkipExpand(t *testing.T) {
+	loader := &Loader{ExpandSkip: DefaultExpandSkip}
+	loader.SkipExpand("templates", "sites")
+	if len(loader.ExpandSkip) != len(DefaultExpandSkip)+1 || len(DefaultExpandSkip) != 2 {
+		t.Fatalf("ExpandSkip = %v, DefaultExpandSkip = %v", loader.ExpandSkip, DefaultExpandSkip)
+	}
+}
@@ -0,0 +1,545 @@
+package dir_config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/moisespsena-go/maps"
+	"gopkg.in/yaml.v3"
+)
+
+type ChangeOp int
+
+const (
+	ChangeSet ChangeOp = iota
+	ChangeRename
+	ChangeDelete
+)
+
+// Change is a change of a config tree, made by a migration.
+type Change struct {
+	Op   ChangeOp
+	Path []string
+	// To the new path of a ChangeRename
+	To []string
+	// Value the value of a ChangeSet
+	Value interface{}
+	// Reason why the change was made
+	Reason string
+}
+
+func (this Change) String() string {
+	var s string
+	switch this.Op {
+	case ChangeRename:
+		s = fmt.Sprintf("%s: renamed to %s", KeyPath(this.Path...), KeyPath(this.To...))
+	case ChangeDelete:
+		s = fmt.Sprintf("%s: deleted", KeyPath(this.Path...))
+	default:
+		s = fmt.Sprintf("%s: set to %v", KeyPath(this.Path...), this.Value)
+	}
+	if this.Reason != "" {
+		s += " (" + this.Reason + ")"
+	}
+	return s
+}
+
+// Changes records the changes made to the config tree at Prefix.
+type Changes struct {
+	Prefix []string
+	List   []Change
+}
+
+// Rename moves the value of the dotted path from to the dotted path to.
+// If to is already set, from is deleted. Returns false if from is not set.
+func (this *Changes) Rename(cfg maps.MapSI, from, to string) bool {
+	change, ok := RenameKey(cfg, from, to)
+	if ok {
+		this.add(change)
+	}
+	return ok
+}
+
+// Delete deletes the value of the dotted path key. Returns false if key is not set.
+func (this *Changes) Delete(cfg maps.MapSI, key string) bool {
+	path := strings.Split(key, ".")
+	parent, ok := lookupParent(cfg, path, false)
+	if !ok {
+		return false
+	}
+	if _, ok = parent[path[len(path)-1]]; ok {
+		delete(parent, path[len(path)-1])
+		this.add(Change{Op: ChangeDelete, Path: path})
+	}
+	return ok
+}
+
+// Set sets the value of the dotted path key, creating the intermediate maps.
+func (this *Changes) Set(cfg maps.MapSI, key string, value interface{}) {
+	path := strings.Split(key, ".")
+	parent, _ := lookupParent(cfg, path, true)
+	parent[path[len(path)-1]] = value
+	this.add(Change{Op: ChangeSet, Path: path, Value: value})
+}
+
+func (this *Changes) add(change Change) {
+	change.Path = appendPath(this.Prefix, change.Path...)
+	if change.To != nil {
+		change.To = appendPath(this.Prefix, change.To...)
+	}
+	this.List = append(this.List, change)
+}
+
+// RenameKey moves the value of the dotted path from to the dotted path to.
+// If to is already set, from is deleted. Returns false if from is not set.
+func RenameKey(cfg maps.MapSI, from, to string) (change Change, ok bool) {
+	var (
+		fromPath = strings.Split(from, ".")
+		toPath   = strings.Split(to, ".")
+		parent   maps.MapSI
+		value    interface{}
+	)
+	if parent, ok = lookupParent(cfg, fromPath, false); !ok {
+		return
+	}
+	if value, ok = parent[fromPath[len(fromPath)-1]]; !ok {
+		return
+	}
+	delete(parent, fromPath[len(fromPath)-1])
+	dst, _ := lookupParent(cfg, toPath, true)
+	if _, exists := dst[toPath[len(toPath)-1]]; exists {
+		return Change{Op: ChangeDelete, Path: fromPath, Reason: "overridden by " + to}, true
+	}
+	dst[toPath[len(toPath)-1]] = value
+	return Change{Op: ChangeRename, Path: fromPath, To: toPath}, true
+}
+
+// lookupParent returns the map of the parent of path. If create, creates the
+// missing intermediate maps.
+func lookupParent(cfg maps.MapSI, path []string, create bool) (parent maps.MapSI, ok bool) {
+	parent = cfg
+	for _, key := range path[:len(path)-1] {
+		child, ok := parent[key].(maps.MapSI)
+		if !ok {
+			if !create {
+				return nil, false
+			}
+			child = maps.MapSI{}
+			parent[key] = child
+		}
+		parent = child
+	}
+	return parent, true
+}
+
+// File is a config file and the key path of its content in the config tree.
+type File struct {
+	Path   string
+	Prefix []string
+}
+
+// Files returns the config files of the tree of dir, with the overlay files
+// of all environments, if the overlays are enabled.
+func (this *Loader) Files(dir string) (files []File, err error) {
+	if files, err = this.files(dir, nil); err != nil || this.Env == "" {
+		return
+	}
+	var envs []os.FileInfo
+	if envs, err = ioutil.ReadDir(filepath.Join(dir, EnvDir)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, env := range envs {
+		if env.IsDir() {
+			var envFiles []File
+			if envFiles, err = this.files(filepath.Join(dir, EnvDir, env.Name()), nil); err != nil {
+				return
+			}
+			files = append(files, envFiles...)
+		}
+	}
+	return
+}
+
+func (this *Loader) files(dir string, prefix []string) (files []File, err error) {
+	var fileInfos []os.FileInfo
+	if fileInfos, err = ioutil.ReadDir(dir); err != nil {
+		return
+	}
+	for _, f := range fileInfos {
+		if f.IsDir() {
+			if this.skipDir(f.Name(), prefix) {
+				continue
+			}
+			var sub []File
+			if sub, err = this.files(filepath.Join(dir, f.Name()), appendPath(prefix, this.keyName(dir, f.Name(), true))); err != nil {
+				return
+			}
+			files = append(files, sub...)
+			continue
+		}
+		if !ValidConfigFile(f.Name()) {
+			continue
+		}
+		name := f.Name()
+		if base, _, ok := this.splitEnv(name); ok {
+			name = base
+		}
+		keyPath := prefix
+		if keyName := this.keyName(dir, name, false); keyName != "config" {
+			keyPath = appendPath(prefix, keyName)
+		}
+		files = append(files, File{filepath.Join(dir, f.Name()), keyPath})
+	}
+	return
+}
+
+// Rewrite applies the changes of the config tree under the prefix of the file
+// to the file, keeping the comments and the order of the YAML files. Returns
+// the changes applied.
+func (this File) Rewrite(changes []Change) (applied []Change, err error) {
+	if filepath.Ext(this.Path) == ".json" || filepath.Ext(this.Path) == ".toml" {
+		return this.rewriteMap(changes)
+	}
+	var node *yaml.Node
+	if node, err = parseYAML(this.Path); err != nil {
+		return
+	}
+	if node == nil {
+		node = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := node.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: root value is not a map", this.Path)
+	}
+	for _, change := range changes {
+		path, ok := this.relative(change.Path)
+		if !ok {
+			continue
+		}
+		switch change.Op {
+		case ChangeSet:
+			value := &yaml.Node{}
+			if err = value.Encode(change.Value); err != nil {
+				return
+			}
+			parent := nodeParent(root, path, true)
+			if i := nodeIndex(parent, path[len(path)-1]); i >= 0 {
+				parent.Content[i+1] = value
+			} else {
+				parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: path[len(path)-1]}, value)
+			}
+		case ChangeRename, ChangeDelete:
+			parent := nodeParent(root, path, false)
+			if parent == nil {
+				continue
+			}
+			i := nodeIndex(parent, path[len(path)-1])
+			if i < 0 {
+				continue
+			}
+			key, value := parent.Content[i], parent.Content[i+1]
+			parent.Content = append(parent.Content[:i], parent.Content[i+2:]...)
+			if change.Op == ChangeRename {
+				to, ok := this.relative(change.To)
+				if !ok {
+					return applied, fmt.Errorf("%s: %s: the new path is out of the file", this.Path, change)
+				}
+				dst := nodeParent(root, to, true)
+				if j := nodeIndex(dst, to[len(to)-1]); j >= 0 {
+					dst.Content[j+1] = value
+				} else if dst == parent {
+					key.Value = to[len(to)-1]
+					parent.Content = append(parent.Content[:i], append([]*yaml.Node{key, value}, parent.Content[i:]...)...)
+				} else {
+					key.Value = to[len(to)-1]
+					dst.Content = append(dst.Content, key, value)
+				}
+			}
+		}
+		applied = append(applied, change)
+	}
+	if len(applied) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err = enc.Encode(node); err != nil {
+		return nil, err
+	}
+	return applied, ioutil.WriteFile(this.Path, buf.Bytes(), 0644)
+}
+
+func (this File) rewriteMap(changes []Change) (applied []Change, err error) {
+	var value interface{}
+	if value, err = decodeFile(this.Path); err != nil {
+		return
+	}
+	data, _ := value.(maps.MapSI)
+	if data == nil {
+		data = maps.MapSI{}
+	}
+	for _, change := range changes {
+		path, ok := this.relative(change.Path)
+		if !ok {
+			continue
+		}
+		var c Changes
+		switch change.Op {
+		case ChangeSet:
+			c.Set(data, KeyPath(path...), change.Value)
+		case ChangeRename:
+			to, ok := this.relative(change.To)
+			if !ok {
+				return applied, fmt.Errorf("%s: %s: the new path is out of the file", this.Path, change)
+			}
+			c.Rename(data, KeyPath(path...), KeyPath(to...))
+		case ChangeDelete:
+			c.Delete(data, KeyPath(path...))
+		}
+		if len(c.List) > 0 {
+			applied = append(applied, change)
+		}
+	}
+	if len(applied) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	if filepath.Ext(this.Path) == ".json" {
+		var b []byte
+		if b, err = json.MarshalIndent(data, "", "  "); err != nil {
+			return nil, err
+		}
+		buf.Write(append(b, '\n'))
+	} else if err = toml.NewEncoder(&buf).Encode(data); err != nil {
+		return nil, err
+	}
+	return applied, ioutil.WriteFile(this.Path, buf.Bytes(), 0644)
+}
+
+// relative returns path relative to the prefix of the file. Returns false if
+// path is not under the prefix.
+func (this File) relative(path []string) ([]string, bool) {
+	if len(path) <= len(this.Prefix) {
+		return nil, false
+	}
+	for i, key := range this.Prefix {
+		if path[i] != key {
+			return nil, false
+		}
+	}
+	return path[len(this.Prefix):], true
+}
+
+// Decode returns the content of the file under its prefix in the config tree,
+// without resolving its directives.
+func (this File) Decode() (tree maps.MapSI, err error) {
+	var value interface{}
+	if ext := filepath.Ext(this.Path); ext == ".json" || ext == ".toml" {
+		value, err = decodeFile(this.Path)
+	} else {
+		var data []byte
+		if data, err = ioutil.ReadFile(this.Path); err == nil {
+			var cfg map[string]interface{}
+			if err = yaml.Unmarshal(data, &cfg); err == nil && cfg != nil {
+				value = Normalize(cfg)
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", this.Path, err)
+	}
+	data, _ := value.(maps.MapSI)
+	if data == nil {
+		data = maps.MapSI{}
+	}
+	if len(this.Prefix) == 0 {
+		return data, nil
+	}
+	tree = maps.MapSI{}
+	parent, _ := lookupParent(tree, this.Prefix, true)
+	parent[this.Prefix[len(this.Prefix)-1]] = data
+	return
+}
+
+// nodeParent returns the mapping node of the parent of path. If create,
+// creates the missing intermediate mappings.
+func nodeParent(root *yaml.Node, path []string, create bool) *yaml.Node {
+	node := root
+	for _, key := range path[:len(path)-1] {
+		i := nodeIndex(node, key)
+		if i < 0 || node.Content[i+1].Kind != yaml.MappingNode {
+			if !create {
+				return nil
+			}
+			child := &yaml.Node{Kind: yaml.MappingNode}
+			if i < 0 {
+				node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, child)
+			} else {
+				node.Content[i+1] = child
+			}
+			node = child
+			continue
+		}
+		node = node.Content[i+1]
+	}
+	return node
+}
+
+// nodeIndex returns the index of the key node of key in the mapping node, or -1.
+func nodeIndex(node *yaml.Node, key string) int {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// RenameFilesKey renames the key path from to the key to, under the same
+// parent, in the config files of dir: the files and dirs named by the key are
+// renamed and the files that declare it are rewritten. Returns the func that
+// undoes the changes.
+func (this *Loader) RenameFilesKey(dir string, from []string, to string) (undo func(), err error) {
+	var (
+		files   []File
+		undos   []func()
+		renames = map[string]string{}
+		change  = Change{Op: ChangeRename, Path: from, To: appendPath(from[:len(from)-1], to)}
+	)
+	rollback := func() {
+		for i := len(undos) - 1; i >= 0; i-- {
+			undos[i]()
+		}
+	}
+	defer func() {
+		if err != nil {
+			rollback()
+		}
+	}()
+	if files, err = this.Files(dir); err != nil {
+		return
+	}
+	for _, file := range files {
+		if _, ok := file.relative(from); ok {
+			var restore func()
+			if restore, err = backupFile(file.Path); err != nil {
+				return
+			}
+			var applied []Change
+			if applied, err = file.Rewrite([]Change{change}); err != nil {
+				restore()
+				return
+			}
+			if len(applied) > 0 {
+				undos = append(undos, restore)
+			}
+		} else if hasPrefix(file.Prefix, from) {
+			src, dst := this.keyFile(dir, file.Path, len(from), to)
+			renames[src] = dst
+		}
+	}
+	for src, dst := range renames {
+		if _, err = os.Stat(dst); err == nil {
+			return nil, fmt.Errorf("rename %q: %q exists", src, dst)
+		}
+		if err = os.Rename(src, dst); err != nil {
+			return
+		}
+		src, dst := src, dst
+		undos = append(undos, func() { os.Rename(dst, src) })
+	}
+	return rollback, nil
+}
+
+// keyFile returns the file or dir of pth named by the key of the depth of the
+// config tree, and its new path named by to.
+func (this *Loader) keyFile(dir, pth string, depth int, to string) (src, dst string) {
+	root := filepath.Clean(dir)
+	rel, _ := filepath.Rel(root, pth)
+	parts := strings.Split(rel, string(filepath.Separator))
+	if this.Env != "" && len(parts) > 2 && parts[0] == EnvDir {
+		root, parts = filepath.Join(root, parts[0], parts[1]), parts[2:]
+	}
+	parent := filepath.Join(append([]string{root}, parts[:depth-1]...)...)
+	name := parts[depth-1]
+	if depth == len(parts) {
+		// the file itself
+		ext := filepath.Ext(name)
+		if _, env, ok := this.splitEnv(name); ok {
+			return filepath.Join(parent, name), filepath.Join(parent, to+"."+env+ext)
+		}
+		return filepath.Join(parent, name), filepath.Join(parent, to+ext)
+	}
+	return filepath.Join(parent, name), filepath.Join(parent, to)
+}
+
+// SetFilesKey sets the value of the key path in the most specific config file
+// of dir that declares its parents, out of the environment overlays. Returns
+// the func that undoes it.
+func (this *Loader) SetFilesKey(dir string, path []string, value interface{}) (undo func(), err error) {
+	var (
+		files []File
+		file  *File
+	)
+	if files, err = this.files(dir, nil); err != nil {
+		return
+	}
+	for i, f := range files {
+		if _, _, ok := this.splitEnv(filepath.Base(f.Path)); ok {
+			continue
+		}
+		if _, ok := f.relative(path); ok && (file == nil || len(f.Prefix) > len(file.Prefix)) {
+			file = &files[i]
+		}
+	}
+	if file == nil {
+		return nil, fmt.Errorf("%s: no config file declares %s", dir, KeyPath(path...))
+	}
+	if undo, err = backupFile(file.Path); err != nil {
+		return
+	}
+	if _, err = file.Rewrite([]Change{{Op: ChangeSet, Path: path, Value: value}}); err != nil {
+		undo()
+		return nil, err
+	}
+	return
+}
+
+// backupFile returns the func that restores the current content of the file.
+func backupFile(pth string) (restore func(), err error) {
+	var (
+		data []byte
+		info os.FileInfo
+	)
+	if info, err = os.Stat(pth); err != nil {
+		return
+	}
+	if data, err = ioutil.ReadFile(pth); err != nil {
+		return
+	}
+	return func() {
+		ioutil.WriteFile(pth, data, info.Mode())
+	}, nil
+}
+
+func hasPrefix(path, prefix []string) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i, key := range prefix {
+		if path[i] != key {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package dir_config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/moisespsena-go/maps"
+)
+
+func TestRenameFilesKey(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml":            "sites:\n  a:\n    title: A # the title\n",
+		"sites/b.yaml":           "title: B\n",
+		"sites/c/config.yaml":    "title: C\n",
+		"sites/c/db.yaml":        "name: c\n",
+		"env/prod/sites/b.yaml":  "title: B prod\n",
+		"sites/b.prod.yaml":      "debug: true\n",
+		"sites/other/other.yaml": "x: 1\n",
+	})
+	defer os.RemoveAll(dir)
+	loader := NewLoader()
+	loader.Env = "prod"
+
+	for _, c := range [][2]string{{"a", "a2"}, {"b", "b2"}, {"c", "c2"}} {
+		if _, err := loader.RenameFilesKey(dir, []string{"sites", c[0]}, c[1]); err != nil {
+			t.Fatalf("rename %s: %v", c[0], err)
+		}
+	}
+	cfg, err := loader.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sites := cfg["sites"].(maps.MapSI)
+	for name, title := range map[string]string{"a2": "A", "b2": "B prod", "c2": "C"} {
+		site, _ := sites[name].(maps.MapSI)
+		if site == nil || site["title"] != title {
+			t.Errorf("site %s = %v", name, site)
+		}
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if _, ok := sites[name]; ok {
+			t.Errorf("site %s not renamed", name)
+		}
+	}
+	if lookup(cfg, "sites", "b2", "debug") != true || lookup(cfg, "sites", "c2", "db", "name") != "c" {
+		t.Errorf("sites = %v", sites)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "config.yaml")); !strings.Contains(string(data), "# the title") {
+		t.Errorf("comment lost:\n%s", data)
+	}
+}
+
+func TestRenameFilesKeyUndo(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml":  "sites:\n  a:\n    title: A\n",
+		"sites/a.yaml": "db:\n  name: a\n",
+		"sites/b.yaml": "title: B\n",
+	})
+	defer os.RemoveAll(dir)
+	loader := NewLoader()
+
+	if _, err := loader.RenameFilesKey(dir, []string{"sites", "a"}, "b"); err == nil {
+		t.Fatal("renamed over an existing file")
+	}
+	undo, err := loader.RenameFilesKey(dir, []string{"sites", "a"}, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	undo()
+	cfg, err := loader.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lookup(cfg, "sites", "a", "title") != "A" || lookup(cfg, "sites", "a", "db", "name") != "a" || lookup(cfg, "sites", "c") != nil {
+		t.Errorf("not undone: %v", cfg["sites"])
+	}
+}
+
+func TestSetFilesKey(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml":       "sites:\n  a:\n    title: A\n",
+		"sites/b.yaml":      "title: B\n",
+		"sites/b.prod.yaml": "title: B prod\n",
+	})
+	defer os.RemoveAll(dir)
+	loader := NewLoader()
+	loader.Env = "prod"
+
+	if _, err := loader.SetFilesKey(dir, []string{"sites", "a", "db", "default", "name"}, "db_a"); err != nil {
+		t.Fatal(err)
+	}
+	undo, err := loader.SetFilesKey(dir, []string{"sites", "b", "db", "default", "name"}, "db_b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "sites", "b.yaml")); !strings.Contains(string(data), "db_b") {
+		t.Errorf("not set in the site file:\n%s", data)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "sites", "b.prod.yaml")); strings.Contains(string(data), "db_b") {
+		t.Errorf("set in the overlay:\n%s", data)
+	}
+	cfg, err := loader.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lookup(cfg, "sites", "a", "db", "default", "name") != "db_a" {
+		t.Errorf("sites = %v", cfg["sites"])
+	}
+	undo()
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "sites", "b.yaml")); string(data) != "title: B\n" {
+		t.Errorf("not undone:\n%s", data)
+	}
+}
+
+func lookup(cfg maps.MapSI, path ...string) (value interface{}) {
+	value = cfg
+	for _, key := range path {
+		m, ok := value.(maps.MapSI)
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return
+}
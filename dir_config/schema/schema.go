@@ -0,0 +1,305 @@
+// Package schema validates the config trees loaded by dir_config against
+// typed schemas, reporting the source location of each error.
+package schema
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ecletus/sites/dir_config"
+)
+
+type Type string
+
+const (
+	Any     Type = ""
+	Object  Type = "object"
+	Array   Type = "array"
+	String  Type = "string"
+	Integer Type = "integer"
+	Number  Type = "number"
+	Boolean Type = "boolean"
+)
+
+// Schema describes a config value.
+type Schema struct {
+	Type        Type
+	Description string
+	// Properties of the object
+	Properties map[string]*Schema
+	// AdditionalProperties schema of the object values not in Properties.
+	// If nil, they are accepted unless Strict.
+	AdditionalProperties *Schema
+	// Strict rejects the object properties not in Properties. If not strict,
+	// they are reported as warnings, unless the object has no Properties.
+	Strict   bool
+	Required []string
+	// Partial validates the value with the schema Of, without checking the
+	// required properties, as for the templates merged later.
+	Partial bool
+	Of      *Schema
+	Items   *Schema
+	Enum    []interface{}
+	// Check a custom validation
+	Check func(value interface{}) error
+
+	mu sync.RWMutex
+}
+
+func New(typ Type, description ...string) *Schema {
+	return &Schema{Type: typ, Description: strings.Join(description, " ")}
+}
+
+func NewObject(properties map[string]*Schema) *Schema {
+	return &Schema{Type: Object, Properties: properties}
+}
+
+// MapOf returns a object schema with values of the schema value.
+func MapOf(value *Schema) *Schema {
+	return &Schema{Type: Object, AdditionalProperties: value}
+}
+
+// PartialOf returns a schema that validates with s without checking the
+// required properties.
+func PartialOf(s *Schema) *Schema {
+	return &Schema{Type: s.Type, Partial: true, Of: s}
+}
+
+// ArrayOf returns a array schema with items of the schema item.
+func ArrayOf(item *Schema) *Schema {
+	return &Schema{Type: Array, Items: item}
+}
+
+// Set sets the fragment schema of the dotted property path, creating the
+// intermediate objects. Plugins use it to contribute the schema of their keys.
+func (this *Schema) Set(path string, fragment *Schema) *Schema {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	parts := strings.SplitN(path, ".", 2)
+	if this.Properties == nil {
+		this.Properties = map[string]*Schema{}
+	}
+	if len(parts) == 1 {
+		this.Properties[parts[0]] = fragment
+		return this
+	}
+	child := this.Properties[parts[0]]
+	if child == nil {
+		child = &Schema{Type: Object}
+		this.Properties[parts[0]] = child
+	}
+	child.Set(parts[1], fragment)
+	return this
+}
+
+// Get returns the schema of the dotted property path.
+func (this *Schema) Get(path string) *Schema {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	parts := strings.SplitN(path, ".", 2)
+	child := this.Properties[parts[0]]
+	if child == nil || len(parts) == 1 {
+		return child
+	}
+	return child.Get(parts[1])
+}
+
+// Error is a validation error.
+type Error struct {
+	Path     []string
+	Location dir_config.Location
+	Message  string
+	// Warning is a error that does not fail the validation
+	Warning bool
+}
+
+func (this *Error) Error() string {
+	msg := dir_config.KeyPath(this.Path...) + ": " + this.Message
+	if this.Warning {
+		msg = "warning: " + msg
+	}
+	if this.Location.IsZero() {
+		return msg
+	}
+	return this.Location.String() + ": " + msg
+}
+
+type Errors []*Error
+
+func (this Errors) Error() string {
+	var msgs = make([]string, len(this))
+	for i, err := range this {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Err returns nil if has no errors. The warnings are ignored.
+func (this Errors) Err() error {
+	var errs Errors
+	for _, err := range this {
+		if !err.Warning {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Warnings returns the warnings.
+func (this Errors) Warnings() (warnings Errors) {
+	for _, err := range this {
+		if err.Warning {
+			warnings = append(warnings, err)
+		}
+	}
+	return
+}
+
+// Validate validates value, using locator to find the location of the errors.
+func (this *Schema) Validate(value interface{}, locator dir_config.Locator) (errs Errors) {
+	this.validate(value, nil, locator, &errs, false)
+	return
+}
+
+func (this *Schema) validate(value interface{}, path []string, locator dir_config.Locator, errs *Errors, partial bool) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	if this.Of != nil {
+		this.Of.validate(value, path, locator, errs, partial || this.Partial)
+		return
+	}
+
+	addErr := func(format string, args ...interface{}) {
+		err := &Error{Path: path, Message: fmt.Sprintf(format, args...)}
+		if locator != nil {
+			err.Location, _ = locator.Locate(path)
+		}
+		*errs = append(*errs, err)
+	}
+
+	if value == nil {
+		return
+	}
+
+	if !this.matchType(value) {
+		addErr("expected %s, got %s", this.Type, typeName(value))
+		return
+	}
+
+	if len(this.Enum) > 0 {
+		var found bool
+		for _, v := range this.Enum {
+			if fmt.Sprint(v) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			addErr("value %v is not one of %v", value, this.Enum)
+		}
+	}
+
+	if this.Check != nil {
+		if err := this.Check(value); err != nil {
+			addErr("%v", err)
+		}
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Map:
+		for _, name := range this.Required {
+			if partial {
+				break
+			}
+			if v := rv.MapIndex(reflect.ValueOf(name)); !v.IsValid() {
+				addErr("property %q is required", name)
+			}
+		}
+		var keys []string
+		for _, key := range rv.MapKeys() {
+			keys = append(keys, fmt.Sprint(key.Interface()))
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			var (
+				v         = rv.MapIndex(reflect.ValueOf(key)).Interface()
+				childPath = append(append([]string{}, path...), key)
+			)
+			if prop := this.Properties[key]; prop != nil {
+				prop.validate(v, childPath, locator, errs, partial)
+			} else if this.AdditionalProperties != nil {
+				this.AdditionalProperties.validate(v, childPath, locator, errs, partial)
+			} else if this.Strict || len(this.Properties) > 0 {
+				err := &Error{Path: childPath, Message: "unknown property", Warning: !this.Strict}
+				if locator != nil {
+					err.Location, _ = locator.Locate(childPath)
+				}
+				*errs = append(*errs, err)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if this.Items != nil {
+			for i := 0; i < rv.Len(); i++ {
+				this.Items.validate(rv.Index(i).Interface(), append(append([]string{}, path...), fmt.Sprint(i)), locator, errs, partial)
+			}
+		}
+	}
+}
+
+func (this *Schema) matchType(value interface{}) bool {
+	kind := reflect.ValueOf(value).Kind()
+	switch this.Type {
+	case Any:
+		return true
+	case Object:
+		return kind == reflect.Map || kind == reflect.Struct || kind == reflect.Ptr
+	case Array:
+		return kind == reflect.Slice || kind == reflect.Array
+	case String:
+		return kind == reflect.String
+	case Boolean:
+		return kind == reflect.Bool
+	case Integer:
+		switch kind {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return true
+		case reflect.Float32, reflect.Float64:
+			f := reflect.ValueOf(value).Float()
+			return f == float64(int64(f))
+		}
+	case Number:
+		switch kind {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			return true
+		}
+	}
+	return false
+}
+
+func typeName(value interface{}) string {
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Map, reflect.Struct, reflect.Ptr:
+		return string(Object)
+	case reflect.Slice, reflect.Array:
+		return string(Array)
+	case reflect.String:
+		return string(String)
+	case reflect.Bool:
+		return string(Boolean)
+	case reflect.Float32, reflect.Float64:
+		return string(Number)
+	default:
+		return string(Integer)
+	}
+}
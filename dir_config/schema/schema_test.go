@@ -0,0 +1,74 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/ecletus/sites/dir_config"
+)
+
+func testSchema() *Schema {
+	db := NewObject(map[string]*Schema{
+		"name": New(String),
+		"port": New(Integer),
+	})
+	db.Strict = true
+	db.Required = []string{"name"}
+	return NewObject(map[string]*Schema{
+		"db":    db,
+		"debug": New(Boolean),
+	})
+}
+
+func TestValidateTypes(t *testing.T) {
+	errs := testSchema().Validate(map[string]interface{}{
+		"db":    map[string]interface{}{"name": "x", "port": "5432"},
+		"debug": "yes",
+	}, nil)
+	if len(errs) != 2 {
+		t.Fatalf("errors = %v, want 2", errs)
+	}
+	if got := dir_config.KeyPath(errs[0].Path...); got != "db.port" {
+		t.Errorf("first error path = %s", got)
+	}
+	if errs.Err() == nil {
+		t.Error("expected Err")
+	}
+}
+
+func TestValidateUnknownProperties(t *testing.T) {
+	errs := testSchema().Validate(map[string]interface{}{
+		"db":    map[string]interface{}{"name": "x", "prot": 1},
+		"debgu": true,
+	}, nil)
+	if err := errs.Err(); err == nil || len(err.(Errors)) != 1 {
+		t.Fatalf("Err() = %v, want the strict db.prot error", err)
+	}
+	warnings := errs.Warnings()
+	if len(warnings) != 1 || dir_config.KeyPath(warnings[0].Path...) != "debgu" {
+		t.Fatalf("warnings = %v, want debgu", warnings)
+	}
+}
+
+func TestValidatePartial(t *testing.T) {
+	s := testSchema()
+	value := map[string]interface{}{"db": map[string]interface{}{"port": 1}}
+	if err := s.Validate(value, nil).Err(); err == nil {
+		t.Error("expected the required name error")
+	}
+	if err := PartialOf(s).Validate(value, nil).Err(); err != nil {
+		t.Errorf("partial: %v", err)
+	}
+	value["db"].(map[string]interface{})["port"] = "x"
+	if err := PartialOf(s).Validate(value, nil).Err(); err == nil {
+		t.Error("partial: expected the type error")
+	}
+}
+
+func TestValidateLocation(t *testing.T) {
+	sources := dir_config.Sources{}
+	sources.Add([]string{"debug"}, dir_config.Location{File: "config.yaml", Line: 3, Column: 8})
+	errs := testSchema().Validate(map[string]interface{}{"debug": 1}, sources)
+	if len(errs) != 1 || errs[0].Error() != "config.yaml:3:8: debug: expected boolean, got integer" {
+		t.Fatalf("errors = %v", errs)
+	}
+}
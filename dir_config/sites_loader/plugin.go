@@ -1,6 +1,7 @@
 package sites_loader
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/ecletus/plug"
@@ -13,6 +14,7 @@ import (
 	"github.com/ecletus/core"
 	"github.com/ecletus/core/site_config"
 	"github.com/ecletus/sites"
+	"github.com/ecletus/sites/secrets"
 )
 
 type Plugin struct {
@@ -22,54 +24,102 @@ type Plugin struct {
 	ContextFactoryKey,
 	ConfigGettersKey,
 	SitesConfigKey string
+	// SiteFactoryKey if not blank, provides the sites.SiteFactory
+	SiteFactoryKey string
 
 	DBNames []string
+
+	mainConfig      *sites.Config
+	args            *stringvar.StringVar
+	cf              *core.ContextFactory
+	configGetter    getters.Getter
+	secretsProvider secrets.Provider
 }
 
 func (p *Plugin) RequireOptions() []string {
 	return []string{p.ContextFactoryKey, p.ConfigGettersKey, p.SitesRegisterKey, p.SitesConfigKey}
 }
 
-func (p *Plugin) Init(options *plug.Options) (err error) {
-	mainConfig := options.GetInterface(p.SitesConfigKey).(*sites.Config)
-	defaultSiteConfig := mainConfig.SiteTemplate
+func (p *Plugin) ProvideOptions() []string {
+	if p.SiteFactoryKey != "" {
+		return []string{p.SiteFactoryKey}
+	}
+	return nil
+}
+
+func (p *Plugin) ProvidesOptions(options *plug.Options) {
+	if p.SiteFactoryKey != "" {
+		options.Set(p.SiteFactoryKey, sites.SiteFactory(p.NewSite))
+	}
+}
 
-	args := stringvar.New(
+func (p *Plugin) Init(options *plug.Options) (err error) {
+	p.mainConfig = options.GetInterface(p.SitesConfigKey).(*sites.Config)
+	// the config is not migrated if not loaded by the dir_config.Loader
+	if _, err = p.mainConfig.Migrate(); err != nil {
+		return errwrap.Wrap(err, "migrate sites config")
+	}
+	p.args = stringvar.New(
 		"HOME", "work/home",
 		"ROOT", ".",
-		"DATA_DIR", mainConfig.DataDir,
-		"SHARED_DATA_DIR", mainConfig.SharedDataDir(),
-		"SHARED_SITE_DATA_DIR", mainConfig.SharedSiteDataDir(),
+		"DATA_DIR", p.mainConfig.DataDir,
+		"SHARED_DATA_DIR", p.mainConfig.SharedDataDir(),
+		"SHARED_SITE_DATA_DIR", p.mainConfig.SharedSiteDataDir(),
 	)
+	p.cf = options.GetInterface(p.ContextFactoryKey).(*core.ContextFactory)
+	p.configGetter = options.GetInterface(p.ConfigGettersKey).(getters.Getter)
+
+	if p.secretsProvider, err = p.mainConfig.SecretsProvider(); err != nil {
+		return err
+	}
 
-	if mainConfig.Sites == nil || len(mainConfig.Sites) == 0 {
+	if p.mainConfig.Sites == nil || len(p.mainConfig.Sites) == 0 {
 		return nil
 	}
-	cf := options.GetInterface(p.ContextFactoryKey).(*core.ContextFactory)
 	register := options.GetInterface(p.SitesRegisterKey).(*core.SitesRegister)
-	configGetter := options.GetInterface(p.ConfigGettersKey).(getters.Getter)
 
-	for siteName, cfgi := range mainConfig.Sites {
-		var cfg = make(maps.MapSI)
-		if err = defaultSiteConfig.Raw.DeepCopy(cfg); err != nil {
-			return errors.WrapPrefix(err, fmt.Sprintf("site %q: copy main config failed", siteName), 1)
-		}
-		if err = cfgi.(maps.MapSI).DeepCopy(cfg); err != nil {
-			return errors.WrapPrefix(err, fmt.Sprintf("site %q: copy site config failed", siteName), 1)
-		}
-		delete(cfg, "sites")
-		var siteConfig = &site_config.Config{Raw: cfg}
-		if err = cfg.CopyTo(siteConfig); err != nil {
-			return errors.WrapPrefix(err, fmt.Sprintf("site %q: unmarshall config failed", siteName), 1)
+	if err = sites.ValidateConfig(p.mainConfig); err != nil {
+		return err
+	}
+
+	for _, siteName := range p.mainConfig.SiteNames() {
+		var (
+			cfg  maps.MapSI
+			site *core.Site
+		)
+		if cfg, err = p.mainConfig.MergeSiteConfig(siteName); err != nil {
+			return
 		}
-		Args := args.Child("SITE_NAME", siteName)
-		if err := siteConfig.Prepare(defaultSiteConfig.Db, siteName, Args); err != nil {
-			return errwrap.Wrap(err, "Site %q", siteName)
+		if site, err = p.NewSite(siteName, cfg); err != nil {
+			return
 		}
-		site := core.NewSite(siteName, *siteConfig, configGetter, cf)
 		if err := register.Add(site); err != nil {
 			panic(err)
 		}
 	}
 	return nil
 }
+
+// NewSite creates the site from its raw config merged over its templates,
+// resolving its secrets. The site is not registered.
+func (p *Plugin) NewSite(siteName string, cfg maps.MapSI) (site *core.Site, err error) {
+	var tmpl *sites.SiteConfig
+	if tmpl, err = p.mainConfig.SiteTemplateConfig(siteName); err != nil {
+		return
+	}
+	if _, err = secrets.Resolve(context.Background(), p.secretsProvider, cfg); err != nil {
+		return nil, errwrap.Wrap(err, "Site %q: resolve secrets", siteName)
+	}
+	var siteConfig = &site_config.Config{Raw: cfg}
+	if err = cfg.CopyTo(siteConfig); err != nil {
+		return nil, errors.WrapPrefix(err, fmt.Sprintf("site %q: unmarshall config failed", siteName), 1)
+	}
+	Args := p.args.Child("SITE_NAME", siteName)
+	if err = siteConfig.Prepare(tmpl.Db, siteName, Args); err != nil {
+		return nil, errwrap.Wrap(err, "Site %q", siteName)
+	}
+	if err = sites.PrepareAuthConfig(siteConfig.Raw, siteName, Args); err != nil {
+		return nil, errwrap.Wrap(err, "Site %q", siteName)
+	}
+	return core.NewSite(siteName, *siteConfig, p.configGetter, p.cf), nil
+}
@@ -0,0 +1,121 @@
+package dir_config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Location is the position of a config value in its source file.
+type Location struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (this Location) IsZero() bool {
+	return this.File == ""
+}
+
+func (this Location) String() string {
+	if this.Line == 0 {
+		return this.File
+	}
+	return fmt.Sprintf("%s:%d:%d", this.File, this.Line, this.Column)
+}
+
+// Conflict is a key set by a file and overridden by another file or directory of the same directory.
+type Conflict struct {
+	Path         []string
+	Location     Location
+	OverriddenBy Location
+}
+
+func (this Conflict) String() string {
+	return fmt.Sprintf("%s: set by %s, overridden by %s", KeyPath(this.Path...), this.Location, this.OverriddenBy)
+}
+
+// Locator finds the location of a config key path.
+type Locator interface {
+	Locate(path []string) (loc Location, ok bool)
+}
+
+// Sources maps the config key paths to their locations.
+type Sources map[string]Location
+
+func KeyPath(path ...string) string {
+	return strings.Join(path, ".")
+}
+
+func (this Sources) Add(path []string, loc Location) {
+	this[KeyPath(path...)] = loc
+}
+
+// Locate returns the location of path, or of its nearest parent.
+func (this Sources) Locate(path []string) (loc Location, ok bool) {
+	for i := len(path); i >= 0; i-- {
+		if loc, ok = this[KeyPath(path[:i]...)]; ok {
+			return
+		}
+	}
+	return
+}
+
+// snapshot returns the locations of prefix and the paths under it.
+func (this Sources) snapshot(prefix []string) Sources {
+	var (
+		p    = KeyPath(prefix...)
+		snap = Sources{}
+	)
+	for key, loc := range this {
+		if key == p || strings.HasPrefix(key, p+".") {
+			snap[key] = loc
+		}
+	}
+	return snap
+}
+
+// Sub returns a locator of the paths under prefix. Only the paths set under
+// prefix are found, not their parents, as the value of a path merged from
+// many trees is set by the first tree that has the exact path.
+func (this Sources) Sub(prefix ...string) Locator {
+	return subLocator{this, prefix}
+}
+
+type subLocator struct {
+	sources Sources
+	prefix  []string
+}
+
+func (this subLocator) Locate(path []string) (loc Location, ok bool) {
+	loc, ok = this.sources[KeyPath(append(append([]string{}, this.prefix...), path...)...)]
+	return
+}
+
+// Locators returns the first location found by its items.
+type Locators []Locator
+
+func (this Locators) Locate(path []string) (loc Location, ok bool) {
+	for _, l := range this {
+		if l == nil {
+			continue
+		}
+		if loc, ok = l.Locate(path); ok {
+			return
+		}
+	}
+	return
+}
+
+type LocatorFunc func(path []string) (loc Location, ok bool)
+
+func (f LocatorFunc) Locate(path []string) (loc Location, ok bool) {
+	return f(path)
+}
+
+// Move moves the locations of from and the paths under it to the path to.
+func (this Sources) Move(from, to []string) {
+	for key, loc := range this.snapshot(from) {
+		delete(this, key)
+		this[KeyPath(to...)+strings.TrimPrefix(key, KeyPath(from...))] = loc
+	}
+}
@@ -0,0 +1,29 @@
+package dir_config
+
+import "testing"
+
+func TestSubLocatorExactKeys(t *testing.T) {
+	var (
+		site    = Location{File: "sites/a.yaml", Line: 2, Column: 1}
+		tmpl    = Location{File: "config.yaml", Line: 7, Column: 3}
+		sources = Sources{}
+	)
+	sources.Add([]string{"sites", "a", "db"}, site)
+	sources.Add([]string{"site_template", "db", "port"}, tmpl)
+
+	locator := Locators{sources.Sub("sites", "a"), sources.Sub("site_template")}
+	if loc, _ := locator.Locate([]string{"db", "port"}); loc != tmpl {
+		t.Errorf("db.port located at %s, want %s", loc, tmpl)
+	}
+	if loc, _ := locator.Locate([]string{"db"}); loc != site {
+		t.Errorf("db located at %s, want %s", loc, site)
+	}
+	if _, ok := locator.Locate([]string{"db", "host"}); ok {
+		t.Error("unset key located")
+	}
+
+	// the top level sources find the nearest parent
+	if loc, _ := sources.Locate([]string{"sites", "a", "db", "host"}); loc != site {
+		t.Errorf("top level db.host located at %s", loc)
+	}
+}
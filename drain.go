@@ -0,0 +1,156 @@
+package sites
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ecletus/core"
+)
+
+// DefaultDrainTimeout is the default time a removed site waits for its in flight requests.
+const DefaultDrainTimeout = 30 * time.Second
+
+type siteInFlight struct {
+	mu        sync.Mutex
+	count     int
+	draining  bool
+	forgotten bool
+	idle      chan struct{}
+}
+
+// InFlight tracks the in flight requests of each site instance. A site re-added
+// with the same name (as by rename or restore) has a new state.
+type InFlight struct {
+	mu    sync.Mutex
+	sites map[*core.Site]*siteInFlight
+}
+
+func (this *InFlight) site(site *core.Site) *siteInFlight {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.sites == nil {
+		this.sites = map[*core.Site]*siteInFlight{}
+	}
+	s := this.sites[site]
+	if s == nil {
+		s = &siteInFlight{}
+		this.sites[site] = s
+	}
+	return s
+}
+
+// Acquire registers a new request of the site. Returns false if the site is
+// draining, else the release func of the request.
+func (this *InFlight) Acquire(site *core.Site) (release func(), ok bool) {
+	s := this.site(site)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return nil, false
+	}
+	s.count++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			this.release(site, s)
+		})
+	}, true
+}
+
+func (this *InFlight) release(site *core.Site, s *siteInFlight) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count--; s.count == 0 {
+		if s.idle != nil {
+			close(s.idle)
+			s.idle = nil
+		}
+		if s.forgotten {
+			this.delete(site, s)
+		}
+	}
+}
+
+func (this *InFlight) delete(site *core.Site, s *siteInFlight) {
+	this.mu.Lock()
+	if this.sites[site] == s {
+		delete(this.sites, site)
+	}
+	this.mu.Unlock()
+}
+
+// Count returns the number of in flight requests of the site.
+func (this *InFlight) Count(site *core.Site) int {
+	s := this.site(site)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Draining reports whether the site is draining.
+func (this *InFlight) Draining(site *core.Site) bool {
+	s := this.site(site)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// Drain rejects the new requests of the site and waits for the in flight
+// requests until timeout. Returns false if the timeout expires.
+func (this *InFlight) Drain(site *core.Site, timeout time.Duration) bool {
+	s := this.site(site)
+	s.mu.Lock()
+	s.draining = true
+	if s.count == 0 {
+		s.mu.Unlock()
+		return true
+	}
+	if s.idle == nil {
+		s.idle = make(chan struct{})
+	}
+	idle := s.idle
+	s.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Forget drops the state of the site. If requests are still in flight, as
+// after a drain timeout, the state is kept draining until the last one ends.
+func (this *InFlight) Forget(site *core.Site) {
+	s := this.site(site)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+	if s.count > 0 {
+		s.forgotten = true
+		return
+	}
+	this.delete(site, s)
+}
+
+// CloseSiteDBs closes the DB connections of the site.
+func CloseSiteDBs(site *core.Site) error {
+	return site.EachDB(func(DB *core.DB) error {
+		return DB.DB.Close()
+	})
+}
+
+// CloseSiteDBs closes the DB connections of the site, releasing the shared pools.
+func (this *SitesRouter) CloseSiteDBs(site *core.Site) error {
+	if this.DBPools == nil {
+		return CloseSiteDBs(site)
+	}
+	return site.EachDB(func(DB *core.DB) error {
+		if shared, err := this.DBPools.Release(site, DB); shared || err != nil {
+			return err
+		}
+		return DB.DB.Close()
+	})
+}
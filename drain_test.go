@@ -0,0 +1,69 @@
+package sites
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInFlightDrain(t *testing.T) {
+	var (
+		inFlight InFlight
+		site     = newTestSite("a", nil)
+	)
+	release, ok := inFlight.Acquire(site)
+	if !ok {
+		t.Fatal("acquire failed")
+	}
+	if n := inFlight.Count(site); n != 1 {
+		t.Fatalf("count = %d, want 1", n)
+	}
+
+	done := make(chan bool)
+	go func() {
+		done <- inFlight.Drain(site, time.Minute)
+	}()
+	for !inFlight.Draining(site) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := inFlight.Acquire(site); ok {
+		t.Fatal("acquired while draining")
+	}
+	release()
+	release() // twice is a no-op
+	if !<-done {
+		t.Fatal("drain timed out")
+	}
+	if n := inFlight.Count(site); n != 0 {
+		t.Fatalf("count = %d, want 0", n)
+	}
+}
+
+func TestInFlightForgetAfterTimeout(t *testing.T) {
+	var (
+		inFlight InFlight
+		old      = newTestSite("a", nil)
+		renamed  = newTestSite("a", nil)
+	)
+	release, _ := inFlight.Acquire(old)
+	if inFlight.Drain(old, time.Millisecond) {
+		t.Fatal("expected drain timeout")
+	}
+	inFlight.Forget(old)
+
+	// the old instance keeps draining until its last request ends
+	if _, ok := inFlight.Acquire(old); ok {
+		t.Fatal("acquired a forgotten site with requests in flight")
+	}
+	release()
+
+	// a new instance with the same name has a clean state
+	if inFlight.Draining(renamed) {
+		t.Fatal("new site instance is draining")
+	}
+	if !inFlight.Drain(renamed, time.Minute) {
+		t.Fatal("new site instance drain waited")
+	}
+	if n := inFlight.Count(renamed); n != 0 {
+		t.Fatalf("count = %d, want 0", n)
+	}
+}
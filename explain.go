@@ -0,0 +1,78 @@
+package sites
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/moisespsena-go/maps"
+
+	"github.com/ecletus/sites/dir_config"
+)
+
+// ExplainEntry is a resolved config value and the location that set it.
+type ExplainEntry struct {
+	Path  []string
+	Value interface{}
+	// Ref the reference expanded into the value, as `${env:DB_PASSWORD}`. The
+	// value is not written, as it can be a secret.
+	Ref      string
+	Location dir_config.Location
+}
+
+// ExplainSite returns the resolved config values of the site, sorted by path,
+// with the location that set each one.
+func (this *Config) ExplainSite(siteName string) (entries []ExplainEntry, err error) {
+	var raw, unexpanded maps.MapSI
+	if unexpanded, err = this.mergeSiteConfig(siteName); err != nil {
+		return
+	}
+	if raw, err = this.MergeSiteConfig(siteName); err != nil {
+		return
+	}
+	locator := siteLocator(this, siteName)
+	var walk func(path []string, value interface{})
+	walk = func(path []string, value interface{}) {
+		if m, ok := value.(maps.MapSI); ok && len(m) > 0 {
+			for key, v := range m {
+				walk(append(append([]string{}, path...), key), v)
+			}
+			return
+		}
+		entry := ExplainEntry{Path: path, Value: value}
+		if ref, ok := lookup(unexpanded, path).(string); ok && strings.Contains(ref, "${") && ref != fmt.Sprint(value) {
+			entry.Ref = ref
+		}
+		if locator != nil {
+			entry.Location, _ = locator.Locate(path)
+		}
+		entries = append(entries, entry)
+	}
+	walk(nil, raw)
+	sort.Slice(entries, func(i, j int) bool {
+		return dir_config.KeyPath(entries[i].Path...) < dir_config.KeyPath(entries[j].Path...)
+	})
+	return
+}
+
+// WriteExplain writes the entries as `path = value  # location` lines.
+func WriteExplain(w io.Writer, entries []ExplainEntry) (err error) {
+	for _, entry := range entries {
+		var value []byte
+		if entry.Ref != "" {
+			value = []byte(entry.Ref + " (expanded)")
+		} else if value, err = json.Marshal(entry.Value); err != nil {
+			value = []byte(fmt.Sprint(entry.Value))
+		}
+		line := dir_config.KeyPath(entry.Path...) + " = " + string(value)
+		if !entry.Location.IsZero() {
+			line += "  # " + entry.Location.String()
+		}
+		if _, err = fmt.Fprintln(w, line); err != nil {
+			return
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package sites
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/moisespsena-go/maps"
+
+	"github.com/ecletus/sites/dir_config"
+)
+
+func TestExplainSite(t *testing.T) {
+	os.Setenv("EXPLAIN_TEST_PASSWORD", "s3cret")
+	defer os.Unsetenv("EXPLAIN_TEST_PASSWORD")
+
+	var (
+		siteFile = dir_config.Location{File: "sites/a.yaml", Line: 1, Column: 1}
+		tmplFile = dir_config.Location{File: "config.yaml", Line: 4, Column: 5}
+		config   = &Config{
+			Raw: maps.MapSI{},
+			Sites: maps.MapSI{"a": maps.MapSI{
+				"db": maps.MapSI{"default": maps.MapSI{"password": "${env:EXPLAIN_TEST_PASSWORD}"}},
+			}},
+			Sources: dir_config.Sources{},
+		}
+	)
+	config.SiteTemplate.Raw = maps.MapSI{"db": maps.MapSI{"default": maps.MapSI{"host": "localhost"}}}
+	config.Sources.Add([]string{"sites", "a"}, siteFile)
+	config.Sources.Add([]string{"sites", "a", "db"}, siteFile)
+	config.Sources.Add([]string{"sites", "a", "db", "default", "password"}, siteFile)
+	config.Sources.Add([]string{"site_template", "db", "default", "host"}, tmplFile)
+
+	entries, err := config.ExplainSite("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = WriteExplain(&out, entries); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	if strings.Contains(got, "s3cret") {
+		t.Errorf("expanded value written:\n%s", got)
+	}
+	for _, line := range []string{
+		`db.default.host = "localhost"  # config.yaml:4:5`,
+		`db.default.password = ${env:EXPLAIN_TEST_PASSWORD} (expanded)  # sites/a.yaml:1:1`,
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("missing line %q in:\n%s", line, got)
+		}
+	}
+}
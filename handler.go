@@ -2,10 +2,12 @@ package sites
 
 import (
 	"context"
-	"github.com/ecletus/core/utils/url"
+	"net"
 	"net/http"
+	"path"
 	"strings"
 
+	"github.com/ecletus/core/utils/url"
 	"github.com/moisespsena-go/httpu"
 
 	"github.com/ecletus/core"
@@ -14,7 +16,13 @@ import (
 
 type rootPath uint8
 
-const RootPathKey rootPath = iota
+const (
+	RootPathKey rootPath = iota
+	HostKey
+	SchemeKey
+	ClientIPKey
+	SiteMountKey
+)
 
 func RootPath(r *http.Request) string {
 	if v := r.Context().Value(RootPathKey); v != nil {
@@ -23,6 +31,51 @@ func RootPath(r *http.Request) string {
 	return "/"
 }
 
+// SiteMount returns the path where the site of the request is mounted,
+// including the sites prefix.
+func SiteMount(r *http.Request) string {
+	if v := r.Context().Value(SiteMountKey); v != nil {
+		return v.(string)
+	}
+	return RootPath(r)
+}
+
+func withSiteMount(r *http.Request, elem ...string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), SiteMountKey, path.Join(append([]string{"/", RootPath(r)}, elem...)...)))
+}
+
+// SiteURL returns the absolute URL of pth under the site mount of the request.
+func SiteURL(r *http.Request, pth string) string {
+	return Scheme(r) + "://" + Host(r) + strings.TrimSuffix(SiteMount(r), "/") + "/" + strings.TrimPrefix(pth, "/")
+}
+
+// Host returns the request host resolved through the trusted proxies.
+func Host(r *http.Request) string {
+	if v := r.Context().Value(HostKey); v != nil {
+		return v.(string)
+	}
+	return r.Host
+}
+
+// Scheme returns the request scheme resolved through the trusted proxies.
+func Scheme(r *http.Request) string {
+	if v := r.Context().Value(SchemeKey); v != nil {
+		return v.(string)
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// ClientIP returns the client IP resolved through the trusted proxies.
+func ClientIP(r *http.Request) net.IP {
+	if v := r.Context().Value(ClientIPKey); v != nil {
+		return v.(net.IP)
+	}
+	return remoteIP(r)
+}
+
 type SitesHandler struct {
 	Sites       *SitesRouter
 	middlewares *xroute.MiddlewaresStack
@@ -54,7 +107,12 @@ func (this *SitesHandler) ServeContext(w http.ResponseWriter, r *http.Request, r
 
 	ContextSetSiteHandler(rctx, this.SiteHandler)
 
-	r = r.WithContext(context.WithValue(r.Context(), RootPathKey, this.Sites.Prefix))
+	host, scheme := this.Sites.TrustedProxies.Resolve(r)
+	ctx := context.WithValue(r.Context(), RootPathKey, this.Sites.Prefix)
+	ctx = context.WithValue(ctx, HostKey, host)
+	ctx = context.WithValue(ctx, SchemeKey, scheme)
+	ctx = context.WithValue(ctx, ClientIPKey, this.Sites.TrustedProxies.ClientIP(r))
+	r = r.WithContext(ctx)
 
 	if this.Sites.Register.Alone {
 		if site = this.Sites.Register.Site(); site != nil {
@@ -62,7 +120,15 @@ func (this *SitesHandler) ServeContext(w http.ResponseWriter, r *http.Request, r
 			return true
 		}
 		return
-	} else if path := r.URL.Path; path == "/" {
+	}
+
+	// the host mapped sites own all of their paths, including the root
+	if site = this.Sites.GetByHost(host); site != nil {
+		this.SiteHandler(w, withSiteMount(r), rctx, site)
+		return true
+	}
+
+	if path := r.URL.Path; path == "/" {
 		if this.Sites.DefaultSite != "" {
 			http.Redirect(w, r, path+this.Sites.DefaultSite+"/", http.StatusSeeOther)
 			return true
@@ -77,7 +143,6 @@ func (this *SitesHandler) ServeContext(w http.ResponseWriter, r *http.Request, r
 
 	if site == nil {
 		sites := this.Sites
-		site = sites.GetByHost(r.Host)
 		parts := strings.SplitN(strings.Trim(r.RequestURI, "/"), "/", 2)
 		if len(parts) == 1 && !strings.HasSuffix(r.URL.Path, "/") {
 			newUrl := url.MustJoinURL(r.RequestURI, "/")
@@ -91,6 +156,11 @@ func (this *SitesHandler) ServeContext(w http.ResponseWriter, r *http.Request, r
 		if ok {
 			r.URL.Path = strings.TrimPrefix(r.URL.Path, "/"+sitePath)
 			r = httpu.PushPrefixR(r, sitePath)
+			r = withSiteMount(r, sitePath)
+		} else if target, isAlias := sites.Paths.Alias(sitePath); isAlias {
+			// the new site path is under the sites prefix, as the alias
+			http.Redirect(w, r, path.Join("/", RootPath(r), target)+strings.TrimPrefix(strings.TrimLeft(r.RequestURI, "/"), sitePath), http.StatusPermanentRedirect)
+			return true
 		} else if this.Sites.RedirectSiteNotFoundToIndex {
 			this.Sites.HandleIndex.ServeHTTPContext(w, r, rctx)
 			return true
@@ -107,6 +177,32 @@ func (this *SitesHandler) ServeContext(w http.ResponseWriter, r *http.Request, r
 
 func (this *SitesHandler) SiteHandler(w http.ResponseWriter, r *http.Request, rctx *xroute.RouteContext, site *core.Site) {
 	ContextSetSite(rctx, site)
+	release, ok := this.Sites.InFlight.Acquire(site)
+	if !ok {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+	if current, _ := this.Sites.Register.ByName.Get(site.Name()); current != site {
+		// removed (and maybe drained and forgotten) while routing
+		release()
+		this.Sites.InFlight.Forget(site)
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if this.Sites.Maintenance != nil && this.Sites.Maintenance.Serve(w, r, site) {
+		return
+	}
+	if this.Sites.Lazy != nil {
+		if err := this.Sites.Lazy.Ensure(site); err != nil {
+			log.Errorf("[%s] init failed: %v", site.Name(), err)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+	}
 	chain := this.middlewares.Items.Handler(xroute.NewContextHandler(func(w http.ResponseWriter, r *http.Request, rctx *xroute.RouteContext) {
 		site.ServeHTTPContext(w, r, rctx)
 	}))
@@ -145,4 +241,4 @@ func ContextSetSite(rctx *xroute.RouteContext, site *core.Site) {
 
 func ContextGetSite(rctx *xroute.RouteContext) *core.Site {
 	return rctx.Data[PKG+".site"].(*core.Site)
-}
\ No newline at end of file
+}
@@ -0,0 +1,14 @@
+package sites
+
+import (
+	"github.com/ecletus/core"
+	"github.com/ecletus/core/site_config"
+	"github.com/moisespsena-go/maps"
+)
+
+func newTestSite(name string, raw maps.MapSI) *core.Site {
+	if raw == nil {
+		raw = maps.MapSI{}
+	}
+	return core.NewSite(name, site_config.Config{Raw: raw}, nil, nil)
+}
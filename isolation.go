@@ -0,0 +1,282 @@
+package sites
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ecletus/core"
+	"github.com/moisespsena-go/aorm"
+)
+
+// IsolationConfigKey is the site config key of the DB isolation:
+//
+//	db_isolation:
+//	  strategy: schema   # or table_prefix
+//	  name: shop         # the schema or the table prefix. Defaults to the site name
+//	  dbs: [system]      # the isolated DBs. Defaults to all
+const IsolationConfigKey = "db_isolation"
+
+type IsolationStrategy string
+
+const (
+	IsolationNone IsolationStrategy = ""
+	// IsolationSchema puts the tables of the site into its own schema (Postgres)
+	IsolationSchema IsolationStrategy = "schema"
+	// IsolationTablePrefix prefixes the tables of the site
+	IsolationTablePrefix IsolationStrategy = "table_prefix"
+)
+
+type IsolationConfig struct {
+	Strategy IsolationStrategy `mapstructure:"strategy"`
+	Name     string            `mapstructure:"name"`
+	DBs      []string          `mapstructure:"dbs"`
+}
+
+// Applies reports whether the DB is isolated.
+func (this *IsolationConfig) Applies(dbName string) bool {
+	if this.Strategy == IsolationNone {
+		return false
+	}
+	if len(this.DBs) == 0 {
+		return true
+	}
+	for _, name := range this.DBs {
+		if name == dbName {
+			return true
+		}
+	}
+	return false
+}
+
+var invalidIdentChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// Isolation returns the isolation of the site DBs.
+func (this *IsolationConfig) Isolation(siteName string) (*DBIsolation, error) {
+	name := this.Name
+	if name == "" {
+		name = invalidIdentChars.ReplaceAllString(strings.ToLower(siteName), "_")
+	} else if invalidIdentChars.MatchString(name) {
+		return nil, fmt.Errorf("invalid %s name %q: only a-z, 0-9 and _ are allowed", this.Strategy, name)
+	}
+	switch this.Strategy {
+	case IsolationSchema:
+	case IsolationTablePrefix:
+		if !strings.HasSuffix(name, "_") {
+			name += "_"
+		}
+	default:
+		return nil, fmt.Errorf("unknown isolation strategy %q", this.Strategy)
+	}
+	return &DBIsolation{Strategy: this.Strategy, Namespace: name}, nil
+}
+
+// DBIsolation is the isolation applied to a site DB.
+type DBIsolation struct {
+	Strategy IsolationStrategy `json:"strategy"`
+	// Namespace the schema or the table prefix
+	Namespace string `json:"namespace"`
+	// Exclude the longer table prefixes of the other sites of the DB, that
+	// start with the table prefix: their tables are not of the isolation
+	Exclude []string `json:"-"`
+}
+
+// Equal reports whether the isolations have the same strategy and namespace.
+func (this *DBIsolation) Equal(other *DBIsolation) bool {
+	return this.Strategy == other.Strategy && this.Namespace == other.Namespace
+}
+
+// Owns reports whether the table is of the table prefix isolation.
+func (this *DBIsolation) Owns(table string) bool {
+	if !strings.HasPrefix(table, this.Namespace) {
+		return false
+	}
+	for _, prefix := range this.Exclude {
+		if strings.HasPrefix(table, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// TableName returns the isolated name of the table. The names qualified by a
+// schema are not changed by the schema isolation. The table prefix is always
+// added: the tables out of the isolation are queried with WithoutIsolation.
+func (this *DBIsolation) TableName(name string) string {
+	if this.Strategy == IsolationSchema {
+		if strings.ContainsRune(name, '.') {
+			return name
+		}
+		return this.Namespace + "." + name
+	}
+	return this.Namespace + name
+}
+
+// Overlaps reports whether the isolations share tables of the same DB: the
+// same schema, or table prefixes where one is a prefix of the other.
+func (this *DBIsolation) Overlaps(other *DBIsolation) bool {
+	if this.Strategy != other.Strategy {
+		return false
+	}
+	if this.Strategy == IsolationSchema {
+		return this.Namespace == other.Namespace
+	}
+	return strings.HasPrefix(this.Namespace, other.Namespace) || strings.HasPrefix(other.Namespace, this.Namespace)
+}
+
+const (
+	dbIsolationKey   = PKG + ".db_isolation"
+	dbNoIsolationKey = PKG + ".db_no_isolation"
+)
+
+// GetDBIsolation returns the isolation applied to the DB, or nil.
+func GetDBIsolation(DB *aorm.DB) *DBIsolation {
+	if _, ok := DB.Get(dbNoIsolationKey); ok {
+		return nil
+	}
+	if v, ok := DB.Get(dbIsolationKey); ok {
+		return v.(*DBIsolation)
+	}
+	return nil
+}
+
+// WithoutIsolation returns the DB whose table names are not isolated, to query
+// the tables shared by the sites.
+func WithoutIsolation(DB *aorm.DB) *aorm.DB {
+	return DB.Set(dbNoIsolationKey, true)
+}
+
+// SiteIsolation returns the isolation of the site DB, or nil if the DB is not
+// isolated.
+func SiteIsolation(site *core.Site, dbName string) (isolation *DBIsolation, err error) {
+	var cfg IsolationConfig
+	if _, err = DecodeSiteConfig(site, IsolationConfigKey, &cfg); err != nil || !cfg.Applies(dbName) {
+		return
+	}
+	return cfg.Isolation(site.Name())
+}
+
+var isolationHandlerOnce sync.Once
+
+// installIsolationTableNameHandler makes the table names of the isolated DBs
+// resolve to their schema or prefix.
+func installIsolationTableNameHandler() {
+	isolationHandlerOnce.Do(func() {
+		next := aorm.DefaultTableNameHandler
+		aorm.DefaultTableNameHandler = func(db *aorm.DB, defaultTableName string) string {
+			if next != nil {
+				defaultTableName = next(db, defaultTableName)
+			}
+			if isolation := GetDBIsolation(db); isolation != nil {
+				return isolation.TableName(defaultTableName)
+			}
+			return defaultTableName
+		}
+	})
+}
+
+// DBIsolations are the isolations of the initialized sites, by physical DB
+// (see DBLockKey), to reject the isolations that overlap the ones of other
+// sites.
+type DBIsolations struct {
+	mu   sync.Mutex
+	byDB map[string]map[string]*DBIsolation
+}
+
+// Add adds the isolation of the site in the DB. Returns error if it overlaps
+// the isolation of other site of the DB.
+func (this *DBIsolations) Add(dbKey, siteName string, isolation *DBIsolation) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	sites := this.byDB[dbKey]
+	for _, other := range sortedIsolationSites(sites) {
+		if other != siteName && sites[other].Overlaps(isolation) {
+			return fmt.Errorf("the %s %q overlaps the %q of the site %q", isolation.Strategy, isolation.Namespace, sites[other].Namespace, other)
+		}
+	}
+	if sites == nil {
+		if this.byDB == nil {
+			this.byDB = map[string]map[string]*DBIsolation{}
+		}
+		sites = map[string]*DBIsolation{}
+		this.byDB[dbKey] = sites
+	}
+	sites[siteName] = isolation
+	return nil
+}
+
+// Forget removes the isolations of the site.
+func (this *DBIsolations) Forget(site *core.Site) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for dbKey, sites := range this.byDB {
+		delete(sites, site.Name())
+		if len(sites) == 0 {
+			delete(this.byDB, dbKey)
+		}
+	}
+}
+
+func sortedIsolationSites(sites map[string]*DBIsolation) (names []string) {
+	for name := range sites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// IsolateSite applies the isolation of the site config to its DBs, under the
+// lock of their physical DB, as the startup events. Returns error if an
+// isolation overlaps the one of other site of the same DB.
+func (this *SitesRouter) IsolateSite(site *core.Site) (err error) {
+	var dbNames []string
+	for dbName := range site.Config().Db {
+		dbNames = append(dbNames, dbName)
+	}
+	sort.Strings(dbNames)
+	for _, dbName := range dbNames {
+		unlock := this.DBLocks.Lock(DBLockKey(site, dbName))
+		err = this.isolateDB(site, dbName, site.GetDB(dbName))
+		unlock()
+		if err != nil {
+			this.Isolations.Forget(site)
+			return fmt.Errorf("DB %q: %v", dbName, err)
+		}
+	}
+	return nil
+}
+
+// isolateDB adds the isolation of the site DB to the isolations and applies
+// it to DB, if not nil. The caller holds the lock of the DB.
+func (this *SitesRouter) isolateDB(site *core.Site, dbName string, DB *core.DB) (err error) {
+	var isolation *DBIsolation
+	if isolation, err = SiteIsolation(site, dbName); err != nil || isolation == nil {
+		return
+	}
+	if err = this.Isolations.Add(DBLockKey(site, dbName), site.Name(), isolation); err != nil || DB == nil {
+		return
+	}
+	return IsolateDB(site, DB)
+}
+
+// IsolateDB applies the isolation of the site config to the DB, once. The
+// schema is created if not exists.
+func IsolateDB(site *core.Site, DB *core.DB) (err error) {
+	if _, ok := DB.DB.Get(dbIsolationKey); ok {
+		return nil
+	}
+	var isolation *DBIsolation
+	if isolation, err = SiteIsolation(site, DB.Name); err != nil || isolation == nil {
+		return
+	}
+	if isolation.Strategy == IsolationSchema {
+		if err = DB.DB.Exec(`CREATE SCHEMA IF NOT EXISTS "` + isolation.Namespace + `"`).Error; err != nil {
+			return fmt.Errorf("create schema %q: %v", isolation.Namespace, err)
+		}
+	}
+	installIsolationTableNameHandler()
+	DB.DB = DB.DB.Set(dbIsolationKey, isolation)
+	return nil
+}
@@ -0,0 +1,99 @@
+package sites
+
+import (
+	"testing"
+
+	"github.com/ecletus/core"
+	"github.com/ecletus/core/db/dbconfig"
+	"github.com/ecletus/core/site_config"
+	"github.com/moisespsena-go/maps"
+)
+
+func TestDBIsolationTableName(t *testing.T) {
+	schema := &DBIsolation{Strategy: IsolationSchema, Namespace: "shop"}
+	for name, want := range map[string]string{
+		"orders":        "shop.orders",
+		"public.orders": "public.orders",
+	} {
+		if got := schema.TableName(name); got != want {
+			t.Errorf("schema TableName(%q) = %q, want %q", name, got, want)
+		}
+	}
+	prefix := &DBIsolation{Strategy: IsolationTablePrefix, Namespace: "shop_"}
+	for name, want := range map[string]string{
+		"orders": "shop_orders",
+		// a table whose name starts with the prefix is prefixed too
+		"shop_items": "shop_shop_items",
+	} {
+		if got := prefix.TableName(name); got != want {
+			t.Errorf("prefix TableName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestDBIsolationOverlaps(t *testing.T) {
+	for _, c := range []struct {
+		a, b DBIsolation
+		want bool
+	}{
+		{DBIsolation{Strategy: IsolationSchema, Namespace: "a"}, DBIsolation{Strategy: IsolationSchema, Namespace: "a"}, true},
+		{DBIsolation{Strategy: IsolationSchema, Namespace: "a"}, DBIsolation{Strategy: IsolationSchema, Namespace: "a_b"}, false},
+		{DBIsolation{Strategy: IsolationTablePrefix, Namespace: "a_"}, DBIsolation{Strategy: IsolationTablePrefix, Namespace: "a_b_"}, true},
+		{DBIsolation{Strategy: IsolationTablePrefix, Namespace: "a_"}, DBIsolation{Strategy: IsolationTablePrefix, Namespace: "b_"}, false},
+		{DBIsolation{Strategy: IsolationSchema, Namespace: "a"}, DBIsolation{Strategy: IsolationTablePrefix, Namespace: "a"}, false},
+	} {
+		if got := c.a.Overlaps(&c.b); got != c.want {
+			t.Errorf("%v overlaps %v = %v", c.a, c.b, got)
+		}
+	}
+}
+
+func TestSiteIsolation(t *testing.T) {
+	site := newTestSite("My-Shop", maps.MapSI{IsolationConfigKey: maps.MapSI{
+		"strategy": "table_prefix",
+		"dbs":      []interface{}{"system"},
+	}})
+	isolation, err := SiteIsolation(site, "system")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isolation == nil || !isolation.Equal(&DBIsolation{Strategy: IsolationTablePrefix, Namespace: "my_shop_"}) {
+		t.Errorf("isolation = %v", isolation)
+	}
+	if isolation, err = SiteIsolation(site, "logs"); err != nil || isolation != nil {
+		t.Errorf("isolation of the not isolated DB = %v, %v", isolation, err)
+	}
+	if isolation, err = SiteIsolation(newTestSite("a", nil), "system"); err != nil || isolation != nil {
+		t.Errorf("isolation of the site without config = %v, %v", isolation, err)
+	}
+}
+
+func TestIsolateSiteAddedAfterBoot(t *testing.T) {
+	router := NewSitesRouter(&core.SitesRegister{}, nil)
+	shared := &dbconfig.DBConfig{Adapter: "postgres", Host: "db", Name: "shared"}
+	newSite := func(name, prefix string) *core.Site {
+		raw := maps.MapSI{IsolationConfigKey: maps.MapSI{"strategy": "table_prefix", "name": prefix}}
+		return core.NewSite(name, site_config.Config{Raw: raw, Db: map[string]*dbconfig.DBConfig{"default": shared}}, nil, nil)
+	}
+	shop := newSite("shop", "shop")
+	if err := router.IsolateSite(shop); err != nil {
+		t.Fatal(err)
+	}
+	// the site added later overlaps the prefix of the booted site
+	shop2 := newSite("shop2", "shop_2")
+	if err := router.IsolateSite(shop2); err == nil {
+		t.Error("isolated the overlapping prefix")
+	}
+	if err := router.IsolateSite(newSite("blog", "blog")); err != nil {
+		t.Errorf("other prefix: %v", err)
+	}
+	// the isolation of the site itself does not overlap
+	if err := router.IsolateSite(shop); err != nil {
+		t.Errorf("isolate again: %v", err)
+	}
+
+	router.Isolations.Forget(shop)
+	if err := router.IsolateSite(shop2); err != nil {
+		t.Errorf("isolate after forget: %v", err)
+	}
+}
@@ -0,0 +1,299 @@
+package sites
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ecletus/core"
+)
+
+// DefaultMaxIdleConns is the max idle connections restored to the DBs of the
+// sites waking from idle. It is the database/sql default.
+const DefaultMaxIdleConns = 2
+
+const (
+	// DefaultInitRetryMin is the wait to retry the first failed Init of a site.
+	DefaultInitRetryMin = time.Second
+	// DefaultInitRetryMax is the max wait to retry the failed Init of a site.
+	DefaultInitRetryMax = 5 * time.Minute
+)
+
+type lazyCall struct {
+	done chan struct{}
+	err  error
+}
+
+type lazyState struct {
+	loaded bool
+	idle   bool
+	// inited the Init of the site succeeded
+	inited bool
+	// err the error of the last Init of the site, returned until retryAt
+	err      error
+	failures int
+	retryAt  time.Time
+	call     *lazyCall
+	pending  []func() error
+	lastUsed int64
+}
+
+// LazySites initializes the sites on their first use, instead of when they are
+// registered. The concurrent first uses wait for the same initialization. A
+// failed Init is retried by the next use after a wait, doubled by each failure
+// from InitRetryMin up to InitRetryMax: the uses before return its error.
+// If IdleTimeout is set, the sites not used for it release their idle DB
+// connections, the shared pools used only by idle sites too, and call the
+// OnIdle hooks.
+//
+// The jobs of a site are scheduled by its initialization: the jobs of the
+// sites never used are not run.
+type LazySites struct {
+	Init        func(site *core.Site) error
+	IdleTimeout time.Duration
+	// MaxIdleConns restored to the DBs of the sites waking from idle.
+	// Defaults to DefaultMaxIdleConns.
+	MaxIdleConns int
+	// DBPools the shared pools, that are not released by the idle sites
+	DBPools *DBPools
+	// InitRetryMin and InitRetryMax bound the wait to retry a failed Init.
+	// Default to DefaultInitRetryMin and DefaultInitRetryMax.
+	InitRetryMin, InitRetryMax time.Duration
+
+	mu     sync.Mutex
+	states map[string]*lazyState
+	onIdle []func(site *core.Site)
+	stop   chan struct{}
+}
+
+func NewLazySites(init func(site *core.Site) error) *LazySites {
+	return &LazySites{
+		Init:         init,
+		MaxIdleConns: DefaultMaxIdleConns,
+		InitRetryMin: DefaultInitRetryMin,
+		InitRetryMax: DefaultInitRetryMax,
+		states:       map[string]*lazyState{},
+	}
+}
+
+func (this *LazySites) state(siteName string) *lazyState {
+	st := this.states[siteName]
+	if st == nil {
+		st = &lazyState{}
+		this.states[siteName] = st
+	}
+	return st
+}
+
+// OnIdle registers a hook called when a site becomes idle, to release its caches.
+func (this *LazySites) OnIdle(f func(site *core.Site)) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.onIdle = append(this.onIdle, f)
+}
+
+// Loaded reports whether the site was initialized.
+func (this *LazySites) Loaded(siteName string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	st := this.states[siteName]
+	return st != nil && st.loaded
+}
+
+// Defer runs f after the site initialization, or now if initialized, returning
+// its error.
+func (this *LazySites) Defer(siteName string, f func() error) error {
+	this.mu.Lock()
+	st := this.state(siteName)
+	if !st.loaded {
+		st.pending = append(st.pending, f)
+		this.mu.Unlock()
+		return nil
+	}
+	this.mu.Unlock()
+	return f()
+}
+
+// Ensure initializes the site if not initialized and marks it as used. If the
+// Init succeeded but a deferred func failed, the next call runs the deferred
+// funcs not run, without Init.
+func (this *LazySites) Ensure(site *core.Site) error {
+	this.mu.Lock()
+	st := this.state(site.Name())
+	now := time.Now()
+	atomic.StoreInt64(&st.lastUsed, now.UnixNano())
+	if st.err != nil && st.call == nil && now.Before(st.retryAt) {
+		this.mu.Unlock()
+		return st.err
+	}
+	if st.loaded {
+		wake := st.idle
+		st.idle = false
+		this.mu.Unlock()
+		if wake {
+			this.wake(site)
+		}
+		return nil
+	}
+	if call := st.call; call != nil {
+		this.mu.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &lazyCall{done: make(chan struct{})}
+	st.call = call
+	inited := st.inited
+	this.mu.Unlock()
+
+	defer close(call.done)
+	if !inited {
+		call.err = this.Init(site)
+	}
+	this.mu.Lock()
+	if call.err != nil {
+		st.err = call.err
+		st.failures++
+		st.retryAt = time.Now().Add(this.retryWait(st.failures))
+	} else {
+		st.inited, st.err, st.failures = true, nil, 0
+	}
+	this.mu.Unlock()
+	if call.err == nil {
+		call.err = this.runPending(st)
+	}
+	this.mu.Lock()
+	st.call = nil
+	this.mu.Unlock()
+	return call.err
+}
+
+// retryWait returns the wait to retry the Init failed the failures times.
+func (this *LazySites) retryWait(failures int) time.Duration {
+	wait := this.InitRetryMin
+	for i := 1; i < failures && wait < this.InitRetryMax; i++ {
+		wait *= 2
+	}
+	if this.InitRetryMax > 0 && wait > this.InitRetryMax {
+		wait = this.InitRetryMax
+	}
+	return wait
+}
+
+// runPending runs the deferred funcs, until none is pending, and marks the
+// site as loaded. If a func fails, it and the funcs not run are kept pending.
+func (this *LazySites) runPending(st *lazyState) error {
+	for {
+		this.mu.Lock()
+		pending := st.pending
+		st.pending = nil
+		if len(pending) == 0 {
+			st.loaded = true
+			this.mu.Unlock()
+			return nil
+		}
+		this.mu.Unlock()
+		for i, f := range pending {
+			if err := f(); err != nil {
+				this.mu.Lock()
+				st.pending = append(pending[i:], st.pending...)
+				this.mu.Unlock()
+				return err
+			}
+		}
+	}
+}
+
+// Forget drops the state of the site.
+func (this *LazySites) Forget(site *core.Site) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	delete(this.states, site.Name())
+}
+
+// sleep releases the idle DB connections of the idle site. The shared pools
+// are released by DBPools, if all of their sites are idle.
+func (this *LazySites) sleep(site *core.Site) {
+	this.setMaxIdleConns(site, 0)
+	if this.DBPools != nil {
+		this.DBPools.Idle(site.Name())
+	}
+}
+
+// wake restores the idle DB connections of the site waking from idle.
+func (this *LazySites) wake(site *core.Site) {
+	this.setMaxIdleConns(site, this.MaxIdleConns)
+	if this.DBPools != nil {
+		this.DBPools.Wake(site.Name())
+	}
+}
+
+func (this *LazySites) setMaxIdleConns(site *core.Site, n int) {
+	site.EachDB(func(DB *core.DB) error {
+		if this.DBPools == nil || !this.DBPools.IsShared(site.Name(), DB.Name) {
+			DB.DB.DB().SetMaxIdleConns(n)
+		}
+		return nil
+	})
+}
+
+// Start starts the idle watcher, if IdleTimeout is set.
+func (this *LazySites) Start(register *core.SitesRegister) {
+	if this.IdleTimeout <= 0 {
+		return
+	}
+	this.mu.Lock()
+	if this.stop != nil {
+		this.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	this.stop = stop
+	this.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(this.IdleTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				this.unloadIdle(register, now)
+			}
+		}
+	}()
+}
+
+func (this *LazySites) Stop() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.stop != nil {
+		close(this.stop)
+		this.stop = nil
+	}
+}
+
+func (this *LazySites) unloadIdle(register *core.SitesRegister, now time.Time) {
+	var idle []string
+	this.mu.Lock()
+	for siteName, st := range this.states {
+		if st.loaded && !st.idle && now.Sub(time.Unix(0, atomic.LoadInt64(&st.lastUsed))) >= this.IdleTimeout {
+			st.idle = true
+			idle = append(idle, siteName)
+		}
+	}
+	hooks := this.onIdle
+	this.mu.Unlock()
+
+	for _, siteName := range idle {
+		site, ok := register.ByName.Get(siteName)
+		if !ok {
+			continue
+		}
+		log.Infof("[%s] idle: releasing DB connections", siteName)
+		this.sleep(site)
+		for _, f := range hooks {
+			f(site)
+		}
+	}
+}
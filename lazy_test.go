@@ -0,0 +1,210 @@
+package sites
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ecletus/core"
+)
+
+func TestLazySitesEnsureCoalesces(t *testing.T) {
+	var (
+		inits   int32
+		release = make(chan struct{})
+	)
+	lazy := NewLazySites(func(site *core.Site) error {
+		atomic.AddInt32(&inits, 1)
+		<-release
+		return nil
+	})
+	site := newTestSite("a", nil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- lazy.Ensure(site)
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if inits != 1 {
+		t.Errorf("Init ran %d times", inits)
+	}
+	if !lazy.Loaded("a") {
+		t.Error("site not loaded")
+	}
+}
+
+func TestLazySitesEnsureInitError(t *testing.T) {
+	var inits int
+	lazy := NewLazySites(func(site *core.Site) error {
+		inits++
+		return errors.New("init failed")
+	})
+	site := newTestSite("a", nil)
+	for i := 0; i < 2; i++ {
+		if err := lazy.Ensure(site); err == nil || err.Error() != "init failed" {
+			t.Errorf("ensure %d: %v", i, err)
+		}
+	}
+	if inits != 1 {
+		t.Errorf("Init ran %d times", inits)
+	}
+
+	lazy.Forget(site)
+	if lazy.Ensure(site); inits != 2 {
+		t.Errorf("Init of the forgotten site ran %d times", inits)
+	}
+}
+
+func TestLazySitesEnsureInitRetry(t *testing.T) {
+	var (
+		inits int
+		fail  = true
+		runs  int
+	)
+	lazy := NewLazySites(func(site *core.Site) error {
+		inits++
+		if fail {
+			return errors.New("init failed")
+		}
+		return nil
+	})
+	site := newTestSite("a", nil)
+	lazy.Defer("a", func() error {
+		runs++
+		return nil
+	})
+	if err := lazy.Ensure(site); err == nil {
+		t.Fatal("init error not returned")
+	}
+	st := lazy.states["a"]
+	if wait := st.retryAt.Sub(time.Now()); wait <= 0 || wait > DefaultInitRetryMin {
+		t.Errorf("retry wait = %s", wait)
+	}
+
+	// the retry time passed: Init runs again, and the wait doubles
+	st.retryAt = time.Time{}
+	if err := lazy.Ensure(site); err == nil || inits != 2 {
+		t.Fatalf("retry: %v, Init ran %d times", err, inits)
+	}
+	if wait := st.retryAt.Sub(time.Now()); wait <= DefaultInitRetryMin || wait > 2*DefaultInitRetryMin {
+		t.Errorf("retry wait = %s", wait)
+	}
+
+	fail = false
+	st.retryAt = time.Time{}
+	if err := lazy.Ensure(site); err != nil {
+		t.Fatal(err)
+	}
+	if inits != 3 || runs != 1 || !lazy.Loaded("a") {
+		t.Errorf("Init ran %d times, deferred ran %d times, loaded %v", inits, runs, lazy.Loaded("a"))
+	}
+}
+
+func TestLazySitesRetryWait(t *testing.T) {
+	lazy := NewLazySites(nil)
+	lazy.InitRetryMin, lazy.InitRetryMax = time.Second, 5*time.Second
+	for failures, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 50: 5 * time.Second} {
+		if got := lazy.retryWait(failures); got != want {
+			t.Errorf("retryWait(%d) = %s, want %s", failures, got, want)
+		}
+	}
+}
+
+func TestLazySitesEnsurePendingError(t *testing.T) {
+	var (
+		inits int
+		runs  []string
+		fail  = true
+	)
+	lazy := NewLazySites(func(site *core.Site) error {
+		inits++
+		return nil
+	})
+	site := newTestSite("a", nil)
+	lazy.Defer("a", func() error {
+		runs = append(runs, "1")
+		return nil
+	})
+	lazy.Defer("a", func() error {
+		if fail {
+			return errors.New("failed")
+		}
+		runs = append(runs, "2")
+		return nil
+	})
+	lazy.Defer("a", func() error {
+		runs = append(runs, "3")
+		return nil
+	})
+
+	if err := lazy.Ensure(site); err == nil {
+		t.Fatal("the deferred error was not returned")
+	}
+	if lazy.Loaded("a") {
+		t.Error("loaded with deferred funcs failed")
+	}
+	fail = false
+	if err := lazy.Ensure(site); err != nil {
+		t.Fatal(err)
+	}
+	if inits != 1 {
+		t.Errorf("Init ran %d times", inits)
+	}
+	if got := len(runs); got != 3 || runs[0] != "1" || runs[1] != "2" || runs[2] != "3" {
+		t.Errorf("runs = %v", runs)
+	}
+	if !lazy.Loaded("a") {
+		t.Error("site not loaded")
+	}
+}
+
+func TestLazySitesUnloadIdle(t *testing.T) {
+	register := &core.SitesRegister{}
+	site := newTestSite("a", nil)
+	if err := register.Add(site); err != nil {
+		t.Fatal(err)
+	}
+	lazy := NewLazySites(func(site *core.Site) error { return nil })
+	lazy.IdleTimeout = time.Minute
+	var idle []string
+	lazy.OnIdle(func(site *core.Site) {
+		idle = append(idle, site.Name())
+	})
+	if err := lazy.Ensure(site); err != nil {
+		t.Fatal(err)
+	}
+
+	lazy.unloadIdle(register, time.Now())
+	if len(idle) != 0 {
+		t.Fatalf("used site is idle")
+	}
+	lazy.unloadIdle(register, time.Now().Add(time.Minute))
+	lazy.unloadIdle(register, time.Now().Add(2*time.Minute))
+	if len(idle) != 1 || idle[0] != "a" {
+		t.Fatalf("idle = %v", idle)
+	}
+
+	// the use wakes the site
+	if err := lazy.Ensure(site); err != nil {
+		t.Fatal(err)
+	}
+	lazy.unloadIdle(register, time.Now().Add(2*time.Minute))
+	if len(idle) != 2 {
+		t.Errorf("idle = %v", idle)
+	}
+}
@@ -0,0 +1,190 @@
+package sites
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ecletus/core"
+)
+
+// MaintenanceFlagFile is the name of the file that, when present in the data
+// dir (global) or in the site data dir, puts it into maintenance.
+const MaintenanceFlagFile = "maintenance"
+
+type MaintenanceConfig struct {
+	// RetryAfter in seconds. Defaults to 300.
+	RetryAfter int `mapstructure:"retry_after"`
+	// Allow CIDRs (or IPs) of the clients served during the maintenance
+	Allow []string `mapstructure:"allow"`
+	// Page path of the HTML file served during the maintenance
+	Page string `mapstructure:"page"`
+}
+
+// DefaultMaintenanceCheckInterval is the time the state of a flag file is cached.
+const DefaultMaintenanceCheckInterval = time.Second
+
+// Maintenance is the runtime switch of the sites maintenance mode. The flag
+// files are the only state, so changes done by the CLI are seen by the server.
+// The state of each flag file is cached for CheckInterval.
+type Maintenance struct {
+	Config        *Config
+	RetryAfter    time.Duration
+	Allow         IPNets
+	Page          []byte
+	CheckInterval time.Duration
+
+	mu    sync.RWMutex
+	flags map[string]flagState
+}
+
+type flagState struct {
+	exists  bool
+	checked time.Time
+}
+
+func NewMaintenance(config *Config) (m *Maintenance, err error) {
+	m = &Maintenance{
+		Config:        config,
+		RetryAfter:    5 * time.Minute,
+		CheckInterval: DefaultMaintenanceCheckInterval,
+		flags:         map[string]flagState{},
+	}
+	if cfg := config.Maintenance; cfg != nil {
+		if cfg.RetryAfter > 0 {
+			m.RetryAfter = time.Duration(cfg.RetryAfter) * time.Second
+		}
+		if m.Allow, err = ParseIPNets(cfg.Allow...); err != nil {
+			return nil, fmt.Errorf("maintenance allow %v", err)
+		}
+		if cfg.Page != "" {
+			if m.Page, err = ioutil.ReadFile(cfg.Page); err != nil {
+				return nil, fmt.Errorf("read maintenance page: %v", err)
+			}
+		}
+	}
+	return
+}
+
+func (this *Maintenance) globalFlagFile() string {
+	return filepath.Join(this.Config.DataDir, MaintenanceFlagFile)
+}
+
+func (this *Maintenance) siteFlagFile(siteName string) (string, error) {
+	dir, err := this.Config.SiteDataDir(siteName)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, MaintenanceFlagFile), nil
+}
+
+// flag reports whether the flag file exists, using the cached state if not
+// older than CheckInterval.
+func (this *Maintenance) flag(pth string) bool {
+	now := time.Now()
+	this.mu.RLock()
+	state, ok := this.flags[pth]
+	this.mu.RUnlock()
+	if ok && now.Sub(state.checked) < this.CheckInterval {
+		return state.exists
+	}
+	exists := fileExists(pth)
+	this.mu.Lock()
+	this.flags[pth] = flagState{exists, now}
+	this.mu.Unlock()
+	return exists
+}
+
+func (this *Maintenance) setFlag(pth string, enabled bool) (err error) {
+	if err = setFlagFile(pth, enabled); err != nil {
+		return
+	}
+	this.mu.Lock()
+	this.flags[pth] = flagState{enabled, time.Now()}
+	this.mu.Unlock()
+	return
+}
+
+// Global reports whether all sites are into maintenance.
+func (this *Maintenance) Global() bool {
+	return this.flag(this.globalFlagFile())
+}
+
+// Enabled reports whether the site is into maintenance. The sites with
+// invalid names are only into the global maintenance.
+func (this *Maintenance) Enabled(siteName string) bool {
+	if this.Global() {
+		return true
+	}
+	pth, err := this.siteFlagFile(siteName)
+	if err != nil {
+		log.Warningf("maintenance flag: %v", err)
+		return false
+	}
+	return this.flag(pth)
+}
+
+// SetGlobal puts all sites into (or out of) maintenance.
+func (this *Maintenance) SetGlobal(enabled bool) error {
+	return this.setFlag(this.globalFlagFile(), enabled)
+}
+
+// Set puts the site into (or out of) maintenance.
+func (this *Maintenance) Set(siteName string, enabled bool) error {
+	pth, err := this.siteFlagFile(siteName)
+	if err != nil {
+		return err
+	}
+	return this.setFlag(pth, enabled)
+}
+
+// Serve writes the maintenance page if the site is into maintenance and the
+// client is not allowed. Returns true if the request was answered.
+func (this *Maintenance) Serve(w http.ResponseWriter, r *http.Request, site *core.Site) bool {
+	if !this.Enabled(site.Name()) || this.Allow.Contains(ClientIP(r)) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(this.RetryAfter.Seconds())))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if this.Page != nil {
+		w.Write(this.Page)
+	} else {
+		w.Write([]byte(`<!doctype html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Under maintenance</title>
+</head>
+<body>
+<h1>Under maintenance</h1>
+<p>We will be back soon.</p>
+</body>
+</html>`))
+	}
+	return true
+}
+
+func fileExists(pth string) bool {
+	_, err := os.Stat(pth)
+	return err == nil
+}
+
+func setFlagFile(pth string, enabled bool) (err error) {
+	if !enabled {
+		if err = os.Remove(pth); os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return
+	}
+	return ioutil.WriteFile(pth, []byte(time.Now().Format(time.RFC3339)+"\n"), 0644)
+}
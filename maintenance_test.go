@@ -0,0 +1,112 @@
+package sites
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceFlagFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := NewMaintenance(&Config{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.CheckInterval = 0
+
+	if m.Enabled("a") {
+		t.Fatal("enabled without flag files")
+	}
+	if err = m.Set("a", true); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Enabled("a") || m.Enabled("b") {
+		t.Fatal("expected only site a enabled")
+	}
+
+	// removed by other process, as the CLI
+	pth, err := m.siteFlagFile("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(pth); err != nil {
+		t.Fatal(err)
+	}
+	if m.Enabled("a") {
+		t.Fatal("enabled after the flag file was removed")
+	}
+
+	if err = m.SetGlobal(true); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Enabled("b") {
+		t.Fatal("expected global maintenance")
+	}
+	if err = m.SetGlobal(false); err != nil {
+		t.Fatal(err)
+	}
+	if m.Enabled("b") {
+		t.Fatal("enabled after global maintenance off")
+	}
+}
+
+func TestMaintenanceInvalidSiteName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := NewMaintenance(&Config{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.CheckInterval = 0
+	for _, name := range []string{"", "..", "a/b"} {
+		if m.Enabled(name) {
+			t.Errorf("site %q enabled", name)
+		}
+		if err = m.Set(name, true); err == nil {
+			t.Errorf("site %q set", name)
+		}
+	}
+	if err = m.SetGlobal(true); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Enabled("..") {
+		t.Error("invalid site name out of the global maintenance")
+	}
+}
+
+func TestMaintenanceCachesFlagState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := NewMaintenance(&Config{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.CheckInterval = time.Hour
+	if m.Global() {
+		t.Fatal("unexpected global maintenance")
+	}
+	if err = setFlagFile(m.globalFlagFile(), true); err != nil {
+		t.Fatal(err)
+	}
+	if m.Global() {
+		t.Fatal("expected the cached state")
+	}
+	m.CheckInterval = 0
+	if !m.Global() {
+		t.Fatal("expected the flag file seen after the interval")
+	}
+}
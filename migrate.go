@@ -0,0 +1,277 @@
+package sites
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/moisespsena-go/maps"
+
+	"github.com/ecletus/sites/dir_config"
+)
+
+// ConfigVersionKey is the top level key of the version of the config format.
+// A config without it has the version 0.
+const ConfigVersionKey = "config_version"
+
+// Migration upgrades the config from the previous version to Version.
+type Migration struct {
+	Version     int
+	Description string
+	// Global migrates the top level config
+	Global func(cfg maps.MapSI, changes *dir_config.Changes) error
+	// Site migrates the site template, each named template and each site
+	Site func(cfg maps.MapSI, changes *dir_config.Changes) error
+}
+
+type Migrations []*Migration
+
+// ConfigMigrations are the migrations of the sites config. Plugins that rename
+// their keys add a migration with the next version.
+var ConfigMigrations = Migrations{
+	{
+		Version:     1,
+		Description: "auth keys are snake case",
+		Site: func(cfg maps.MapSI, changes *dir_config.Changes) error {
+			auth, _ := cfg[AuthConfigKey].(maps.MapSI)
+			for _, key := range sortedKeys(auth) {
+				if name, ok := authLegacyKeys[strings.ToLower(key)]; ok {
+					changes.Rename(cfg, AuthConfigKey+"."+key, AuthConfigKey+"."+name)
+				}
+			}
+			return nil
+		},
+	},
+}
+
+func init() {
+	dir_config.DefaultMigrate = func(cfg maps.MapSI) ([]dir_config.Change, error) {
+		return ConfigMigrations.Migrate(cfg)
+	}
+}
+
+func warnDeprecated(changes []dir_config.Change) {
+	for _, change := range changes {
+		if change.Path[0] != ConfigVersionKey {
+			log.Warningf("config: deprecated key %s. Run `config upgrade` to rewrite the config files.", change)
+		}
+	}
+}
+
+// Migrate upgrades the raw config, if built without the dir_config.Loader
+// or with the migration disabled, and decodes it again. Returns the changes made.
+func (this *Config) Migrate() (changes []dir_config.Change, err error) {
+	if this.Raw == nil {
+		return
+	}
+	if changes, err = ConfigMigrations.Migrate(this.Raw); err != nil || len(changes) == 0 {
+		return
+	}
+	warnDeprecated(changes)
+	for _, change := range changes {
+		if change.Op == dir_config.ChangeRename && this.Sources != nil {
+			this.Sources.Move(change.Path, change.To)
+		}
+	}
+	migrated := &Config{
+		Raw:             this.Raw,
+		Sources:         this.Sources,
+		Conflicts:       this.Conflicts,
+		Dir:             this.Dir,
+		secretsProvider: this.secretsProvider,
+	}
+	if err = this.Raw.CopyTo(migrated); err != nil {
+		return nil, fmt.Errorf("unmarshall migrated config failed: %v", err)
+	}
+	migrated.SiteTemplate.Raw, _ = this.Raw["site_template"].(maps.MapSI)
+	*this = *migrated
+	return
+}
+
+// Latest returns the latest version.
+func (this Migrations) Latest() (version int) {
+	for _, m := range this {
+		if m.Version > version {
+			version = m.Version
+		}
+	}
+	return
+}
+
+// Version returns the version of the config.
+func (this Migrations) Version(cfg maps.MapSI) (version int, err error) {
+	switch t := cfg[ConfigVersionKey].(type) {
+	case nil:
+	case int:
+		version = t
+	case int64:
+		version = int(t)
+	case uint64:
+		version = int(t)
+	case float64:
+		version = int(t)
+	case string:
+		if version, err = strconv.Atoi(t); err != nil {
+			return 0, fmt.Errorf("%s: %v", ConfigVersionKey, err)
+		}
+	default:
+		return 0, fmt.Errorf("%s: invalid value %v", ConfigVersionKey, t)
+	}
+	if latest := this.Latest(); version > latest {
+		return 0, fmt.Errorf("%s: version %d is newer than the supported version %d", ConfigVersionKey, version, latest)
+	}
+	return
+}
+
+// Migrate upgrades the config to the latest version. Returns the changes made.
+func (this Migrations) Migrate(cfg maps.MapSI) (changes []dir_config.Change, err error) {
+	var version int
+	if version, err = this.Version(cfg); err != nil || version == this.Latest() {
+		return
+	}
+	if changes, err = this.MigrateFrom(cfg, version); err != nil {
+		return
+	}
+	var c dir_config.Changes
+	c.Set(cfg, ConfigVersionKey, this.Latest())
+	return append(changes, c.List...), nil
+}
+
+// MigrateFrom applies to cfg the migrations newer than version, without
+// setting the config version. Returns the changes made.
+func (this Migrations) MigrateFrom(cfg maps.MapSI, version int) (changes []dir_config.Change, err error) {
+	migrations := append(Migrations{}, this...)
+	sort.SliceStable(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		var scopes = []dir_config.Changes{{}}
+		if m.Site != nil {
+			scopes = append(scopes, siteScopes(cfg)...)
+		}
+		for i, scope := range scopes {
+			if i == 0 {
+				if m.Global != nil {
+					err = m.Global(cfg, &scope)
+				}
+			} else if scopeCfg, ok := lookup(cfg, scope.Prefix).(maps.MapSI); ok {
+				err = m.Site(scopeCfg, &scope)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("migration to version %d: %s: %v", m.Version, dir_config.KeyPath(scope.Prefix...), err)
+			}
+			for _, change := range scope.List {
+				change.Reason = fmt.Sprintf("version %d: %s", m.Version, m.Description)
+				changes = append(changes, change)
+			}
+		}
+	}
+	return
+}
+
+// siteScopes returns the changes recorders of the site template, the named
+// templates and the sites.
+func siteScopes(cfg maps.MapSI) (scopes []dir_config.Changes) {
+	if _, ok := cfg["site_template"].(maps.MapSI); ok {
+		scopes = append(scopes, dir_config.Changes{Prefix: []string{"site_template"}})
+	}
+	for _, key := range []string{TemplatesKey, "sites"} {
+		m, _ := cfg[key].(maps.MapSI)
+		for _, name := range sortedKeys(m) {
+			scopes = append(scopes, dir_config.Changes{Prefix: []string{key, name}})
+		}
+	}
+	return
+}
+
+func lookup(cfg maps.MapSI, path []string) (value interface{}) {
+	value = cfg
+	for _, key := range path {
+		m, ok := value.(maps.MapSI)
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return
+}
+
+func sortedKeys(m maps.MapSI) (keys []string) {
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// UpgradeConfigFiles rewrites the config files of dir to the latest version
+// of migrations. Returns the changes applied.
+func UpgradeConfigFiles(loader *dir_config.Loader, dir string, migrations Migrations) (applied []dir_config.Change, err error) {
+	var (
+		raw     maps.MapSI
+		version int
+		files   []dir_config.File
+		manual  []string
+		root    *dir_config.File
+	)
+	loader.NoExpand = true
+	loader.NoMigrate = true
+	if raw, err = loader.Load(dir); err != nil {
+		return
+	}
+	if version, err = migrations.Version(raw); err != nil || version == migrations.Latest() {
+		return
+	}
+	if files, err = loader.Files(dir); err != nil {
+		return
+	}
+	for i, file := range files {
+		name := filepath.Base(file.Path)
+		if filepath.Dir(file.Path) == filepath.Clean(dir) && strings.TrimSuffix(name, filepath.Ext(name)) == "config" {
+			root = &files[i]
+		}
+		var (
+			tree    maps.MapSI
+			changes []dir_config.Change
+			done    []dir_config.Change
+		)
+		if tree, err = file.Decode(); err != nil {
+			return
+		}
+		if changes, err = migrations.MigrateFrom(tree, version); err != nil || len(changes) == 0 {
+			if err != nil {
+				return applied, fmt.Errorf("%s: %v", file.Path, err)
+			}
+			continue
+		}
+		if done, err = file.Rewrite(changes); err != nil {
+			return
+		}
+		applied = append(applied, done...)
+		if len(done) < len(changes) {
+			manual = append(manual, fmt.Sprintf("%s: %d changes must be made by hand", file.Path, len(changes)-len(done)))
+		}
+	}
+
+	versionChange := dir_config.Change{Op: dir_config.ChangeSet, Path: []string{ConfigVersionKey}, Value: migrations.Latest()}
+	if root == nil {
+		pth := filepath.Join(dir, "config.yaml")
+		if err = ioutil.WriteFile(pth, []byte(fmt.Sprintf("%s: %d\n", ConfigVersionKey, migrations.Latest())), 0644); err != nil {
+			return
+		}
+	} else if _, err = root.Rewrite([]dir_config.Change{versionChange}); err != nil {
+		return
+	}
+	applied = append(applied, versionChange)
+
+	if len(manual) > 0 {
+		err = fmt.Errorf("%s", strings.Join(manual, "\n"))
+	}
+	return
+}
@@ -0,0 +1,67 @@
+package sites
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moisespsena-go/maps"
+
+	"github.com/ecletus/sites/dir_config"
+)
+
+func TestLoadMainConfigMigrates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.MkdirAll(filepath.Join(dir, "sites"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "sites", "a.yaml"), []byte("auth:\n  userRegistration: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := dir_config.LoadMainConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := lookup(raw, []string{"sites", "a", AuthConfigKey}).(maps.MapSI)
+	if auth["user_registration"] != true {
+		t.Errorf("auth = %v", auth)
+	}
+	if raw[ConfigVersionKey] != ConfigMigrations.Latest() {
+		t.Errorf("%s = %v", ConfigVersionKey, raw[ConfigVersionKey])
+	}
+
+	loader := dir_config.NewLoader()
+	loader.NoMigrate = true
+	if raw, err = loader.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := raw[ConfigVersionKey]; ok {
+		t.Error("migrated with NoMigrate")
+	}
+}
+
+func TestConfigMigrate(t *testing.T) {
+	config := &Config{Raw: maps.MapSI{
+		"sites": maps.MapSI{"a": maps.MapSI{AuthConfigKey: maps.MapSI{"socialAuthEnabled": true}}},
+	}}
+	changes, err := config.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("changes = %v, want the rename and the version", changes)
+	}
+	site := config.Sites["a"].(maps.MapSI)
+	if site[AuthConfigKey].(maps.MapSI)["social_auth_enabled"] != true {
+		t.Errorf("site = %v", site)
+	}
+	if changes, err = config.Migrate(); err != nil || len(changes) != 0 {
+		t.Errorf("second migrate: %v, %v", changes, err)
+	}
+}
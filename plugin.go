@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"path/filepath"
 	"plugin"
+	"time"
 
 	http_render "github.com/moisespsena-go/http-render"
 	"github.com/moisespsena-go/http-render/ropt"
@@ -31,9 +32,15 @@ type Plugin struct {
 	SitesConfigKey,
 	ConfigDirKey,
 	SitesRegisterKey string
+	// CertManagerKey if not blank, provides the *CertManager. It is configured by the `tls` section.
+	CertManagerKey string
+	// RateLimitStore the rate limit state store. Defaults to memory.
+	RateLimitStore RateLimitStore
 
 	sitesRouter *SitesRouter
 	register    *core.SitesRegister
+	certManager *CertManager
+	startup     *Startup
 
 	config *Config
 	Alone  bool
@@ -44,6 +51,9 @@ func (p *Plugin) RequireOptions() []string {
 }
 
 func (p *Plugin) ProvideOptions() []string {
+	if p.CertManagerKey != "" {
+		return []string{p.SitesRegisterKey, p.SitesRouterKey, p.CertManagerKey}
+	}
 	return []string{p.SitesRegisterKey, p.SitesRouterKey}
 }
 
@@ -51,17 +61,60 @@ func (p *Plugin) ProvidesOptions(options *plug.Options) {
 	contextFactory := options.GetInterface(p.ContextFactoryKey).(*core.ContextFactory)
 	p.config = options.GetInterface(p.SitesConfigKey).(*Config)
 
+	p.startup = NewStartup(p.config.StartupWorkers)
 	p.register = &core.SitesRegister{Alone: p.Alone || p.config.Alone}
 	options.Set(p.SitesRegisterKey, p.register)
 
 	p.sitesRouter = NewSitesRouter(p.register, contextFactory)
 	p.sitesRouter.Prefix = p.config.Prefix
+	p.sitesRouter.Config = p.config
+	p.sitesRouter.Storages = NewStorages(p.config)
+	p.sitesRouter.Control = NewControl(filepath.Join(p.config.DataDir, ControlSocket))
+	p.sitesRouter.Paths.File = filepath.Join(p.config.DataDir, "aliases.json")
+	p.sitesRouter.Scheduler.StatusFile = func(siteName string) (string, error) {
+		return p.config.SiteDirs(siteName).Data("jobs.json")
+	}
 	p.sitesRouter.RedirectSiteNotFoundToIndex = p.config.RedirectSiteNotFoundToIndex
+	p.sitesRouter.TrustedProxies = MustParseTrustedProxies(p.config.TrustedProxies...)
+	if p.config.DrainTimeout > 0 {
+		p.sitesRouter.DrainTimeout = time.Duration(p.config.DrainTimeout) * time.Second
+	}
+	var err error
+	if p.sitesRouter.Maintenance, err = NewMaintenance(p.config); err != nil {
+		panic(errwrap.Wrap(err, "create maintenance"))
+	}
+	if p.config.RateLimit {
+		p.sitesRouter.UseRateLimit(p.RateLimitStore)
+	}
+	if cfg := p.config.DBPools; cfg != nil && cfg.Enabled {
+		p.sitesRouter.DBPools = NewDBPools(cfg)
+		p.sitesRouter.Use(p.sitesRouter.DBPools.Middleware())
+	}
+	if p.config.LazyInit {
+		p.sitesRouter.Lazy = NewLazySites(nil)
+		p.sitesRouter.Lazy.IdleTimeout = time.Duration(p.config.IdleTimeout) * time.Second
+		p.sitesRouter.Lazy.DBPools = p.sitesRouter.DBPools
+		if cfg := p.config.DBPools; cfg != nil && cfg.MaxIdle > 0 {
+			p.sitesRouter.Lazy.MaxIdleConns = cfg.MaxIdle
+		}
+	}
 	options.Set(p.SitesRouterKey, p.sitesRouter)
+
+	if p.CertManagerKey != "" {
+		if p.certManager, err = NewCertManager(p.register, p.config); err != nil {
+			panic(errwrap.Wrap(err, "create cert manager"))
+		}
+		options.Set(p.CertManagerKey, p.certManager)
+	}
 }
 
 func (p *Plugin) Init(options *plug.Options) {
 	p.sitesRouter.Init()
+	if p.certManager != nil {
+		p.certManager.Init()
+	}
+	// the storages and the data dir are released by the router, after the drain
+	p.register.OnSiteDestroy(ForgetAuthConfig)
 }
 
 func (p *Plugin) OnRegister() {
@@ -105,14 +158,45 @@ func (p *Plugin) OnRegister() {
 		}()
 
 		dis := e.PluginDispatcher()
-		sites.Register.OnAdd(func(site *core.Site) {
-			if err = site.Init(); err == nil {
-				err = dis.TriggerPlugins(&SiteEvent{plug.NewPluginEvent(ESite(site.Name())), site, e})
+		initSite := func(site *core.Site) (err error) {
+			if err = p.config.SiteDirs(site.Name()).Create(); err != nil {
+				return errwrap.Wrap(err, "create data dir")
+			}
+			if err = site.Init(); err != nil {
+				return
+			}
+			if sites.DBPools != nil {
+				if err = sites.DBPools.Share(site); err != nil {
+					return errwrap.Wrap(err, "share DB pools")
+				}
+			}
+			// the sites added after the boot, as the restored ones, are
+			// isolated before use too
+			if err = sites.IsolateSite(site); err != nil {
+				return errwrap.Wrap(err, "isolate DBs")
 			}
-			if err != nil {
+			siteEvent := &SiteEvent{plug.NewPluginEvent(ESite(site.Name())), site, e}
+			if err = dis.TriggerPlugins(siteEvent); err == nil {
+				sites.Scheduler.OnSiteEvent(siteEvent)
+			}
+			return
+		}
+		if sites.Lazy != nil {
+			sites.Lazy.Init = initSite
+			// the caches of the idle sites are rebuilt on use
+			sites.Lazy.OnIdle(ForgetAuthConfig)
+			if sites.Storages != nil {
+				sites.Lazy.OnIdle(sites.Storages.Forget)
+			}
+			sites.Lazy.Start(sites.Register)
+			sites.Register.OnSiteDestroy(sites.Lazy.Forget)
+		} else {
+			// the registered sites are initialized by the startup workers, the
+			// sites added later, on add
+			if err := p.startup.Init(sites.Register, initSite); err != nil {
 				log.Error(err)
 			}
-		})
+		}
 		return nil
 	})
 
@@ -136,25 +220,29 @@ func (p *Plugin) do(ename func(name string) string,
 	}
 	return func(e plug.PluginEventInterface) (err error) {
 		if e.Name() == db.E_MIGRATE_DB {
+			var dryRun bool
+			if data := e.Data(); data != nil {
+				if ctx, ok := e.Data().(context.Context); ok {
+					if val := ctx.Value(db.OptCommitDisabled); val != nil && val.(bool) {
+						dryRun = true
+						// the logger is global: set once, before the workers
+						aorm.DefaultLogger.All(func(action string, scope *aorm.Scope) {
+							log.Debug(scope.Query)
+						})
+					}
+				}
+			}
 			old := do
 			do = func(dis plug.PluginEventDispatcherInterface, site *core.Site, DB *core.DB) (err error) {
 				var migrator *aorm.Migrator
 
-				if data := e.Data(); data != nil {
-					if ctx, ok := e.Data().(context.Context); ok {
-						if val := ctx.Value(db.OptCommitDisabled); val != nil && val.(bool) {
-							DB.DB = DB.DB.Unscoped().Begin()
-							migrator = aorm.NewMigrator(DB.DB)
+				if dryRun {
+					DB.DB = DB.DB.Unscoped().Begin()
+					migrator = aorm.NewMigrator(DB.DB)
 
-							aorm.DefaultLogger.All(func(action string, scope *aorm.Scope) {
-								log.Debug(scope.Query)
-							})
-
-							defer func() {
-								DB.DB.Rollback()
-							}()
-						}
-					}
+					defer func() {
+						DB.DB.Rollback()
+					}()
 				}
 				if migrator == nil {
 					migrator = DB.DB.Migrator()
@@ -167,27 +255,36 @@ func (p *Plugin) do(ename func(name string) string,
 			}
 		}
 		sites := e.Options().GetInterface(p.SitesRouterKey).(*SitesRouter)
+		// the sites run concurrently, but the events of the sites on the same
+		// physical DB, as the creation of their schemas and their migrations,
+		// run serially. It holds one connection of each shared pool.
+		// the isolation is applied before the events and the migration transaction
+		run := func(dis plug.PluginEventDispatcherInterface, site *core.Site, DB *core.DB) (err error) {
+			defer sites.DBLocks.Lock(DBLockKey(site, DB.Name))()
+			if err = sites.isolateDB(site, DB.Name, DB); err != nil {
+				return errwrap.Wrap(err, "isolate DB %q", DB.Name)
+			}
+			return do(dis, site, DB)
+		}
 		dis := e.PluginDispatcher()
 		dbNames := p.GetNames()
-		if len(dbNames) == 0 {
-			err = sites.Register.ByName.Each(func(site *core.Site) error {
+		runSite := func(site *core.Site) (err error) {
+			if len(dbNames) == 0 {
 				return site.EachDB(func(DB *core.DB) error {
-					return do(dis, site, DB)
+					return run(dis, site, DB)
 				})
-			})
-		} else {
-			err = sites.Register.ByName.Each(func(site *core.Site) (err error) {
-				for _, dbName := range dbNames {
-					if DB := site.GetDB(dbName); DB != nil {
-						if err = do(dis, site, DB); err != nil {
-							return errwrap.Wrap(err, dbName)
-						}
+			}
+			for _, dbName := range dbNames {
+				if DB := site.GetDB(dbName); DB != nil {
+					if err = run(dis, site, DB); err != nil {
+						return errwrap.Wrap(err, dbName)
 					}
 				}
-				return nil
-			})
+			}
+			return nil
 		}
-		return
+		// the events of the lazy sites run on their first use
+		return p.startup.Run(e.Name(), sites, runSite)
 	}
 }
 
@@ -9,10 +9,16 @@ import (
 type RouterPlugin struct {
 	plug.EventDispatcher
 	RouterKey, SitesRouterKey string
-	Alone                     bool
+	// SiteFactoryKey if not blank, the sites.SiteFactory of the sites renamed
+	// and cloned by the commands of the control socket
+	SiteFactoryKey string
+	Alone          bool
 }
 
 func (p *RouterPlugin) RequireOptions() []string {
+	if p.SiteFactoryKey != "" {
+		return []string{p.RouterKey, p.SitesRouterKey, p.SiteFactoryKey}
+	}
 	return []string{p.RouterKey, p.SitesRouterKey}
 }
 
@@ -37,8 +43,35 @@ func (p *RouterPlugin) OnRegister() {
 			}
 		})
 		sitesRouter.Register.OnSiteDestroy(func(site *core.Site) {
+			if !sitesRouter.InFlight.Drain(site, sitesRouter.DrainTimeout) {
+				log.Warningf("[%s] drain timeout expired with %d requests in flight",
+					site.Name(), sitesRouter.InFlight.Count(site))
+			}
 			site.SetHandler(nil)
+			sitesRouter.InFlight.Forget(site)
+			if err := sitesRouter.CloseSiteDBs(site); err != nil {
+				log.Errorf("[%s] close DBs failed: %v", site.Name(), err)
+			}
+			if sitesRouter.Storages != nil {
+				sitesRouter.Storages.Forget(site)
+			}
+			if err := sitesRouter.SiteDirs(site.Name()).Clean(); err != nil {
+				log.Errorf("[%s] clean data dir failed: %v", site.Name(), err)
+			}
 		})
 		Router.Handler = Handler
+		// only the serving process runs the scheduled jobs
+		sitesRouter.Scheduler.Enable()
+		// and serves the commands of its sites
+		if sitesRouter.Control != nil {
+			var factory SiteFactory
+			if p.SiteFactoryKey != "" {
+				factory = e.Options().GetInterface(p.SiteFactoryKey).(SiteFactory)
+			}
+			sitesRouter.HandleControl(factory)
+			if err := sitesRouter.Control.Listen(); err != nil {
+				log.Errorf("control socket: %v", err)
+			}
+		}
 	})
 }
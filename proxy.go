@@ -0,0 +1,216 @@
+package sites
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// IPNets is a set of networks.
+type IPNets []*net.IPNet
+
+// ParseIPNets parses the CIDRs (or single IPs) into a set of networks.
+func ParseIPNets(cidrs ...string) (nets IPNets, err error) {
+	for _, cidr := range cidrs {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip == nil {
+				return nil, fmt.Errorf("%q: invalid IP address", cidr)
+			} else if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return
+}
+
+// Contains reports whether ip belongs to any network of the set.
+func (this IPNets) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range this {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustedProxies is the set of networks whose forwarding headers
+// (Forwarded, X-Forwarded-Host, X-Forwarded-Proto and X-Forwarded-For) are honored.
+type TrustedProxies struct {
+	nets IPNets
+}
+
+// ParseTrustedProxies parses the CIDRs (or single IPs) into a trusted set.
+func ParseTrustedProxies(cidrs ...string) (*TrustedProxies, error) {
+	nets, err := ParseIPNets(cidrs...)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxy %v", err)
+	}
+	return &TrustedProxies{nets}, nil
+}
+
+// MustParseTrustedProxies is like ParseTrustedProxies but panics on error.
+func MustParseTrustedProxies(cidrs ...string) *TrustedProxies {
+	tp, err := ParseTrustedProxies(cidrs...)
+	if err != nil {
+		panic(err)
+	}
+	return tp
+}
+
+// Contains reports whether ip belongs to any trusted network.
+func (this *TrustedProxies) Contains(ip net.IP) bool {
+	if this == nil {
+		return false
+	}
+	return this.nets.Contains(ip)
+}
+
+// Trusted reports whether the direct peer of the request is a trusted proxy.
+func (this *TrustedProxies) Trusted(r *http.Request) bool {
+	return this.Contains(remoteIP(r))
+}
+
+// Resolve returns the host and scheme of the request, honoring the forwarding
+// headers only when the request comes from a trusted proxy. The values are
+// taken from the hop of the client, walked from the nearest hop as ClientIP:
+// each trusted proxy appends its Forwarded element, or its X-Forwarded-Host
+// and X-Forwarded-Proto values, so the leftmost values are sent by the client.
+// The proto other than http and https is ignored.
+func (this *TrustedProxies) Resolve(r *http.Request) (host, scheme string) {
+	host = r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	} else {
+		scheme = "http"
+	}
+
+	if !this.Trusted(r) {
+		return
+	}
+
+	var proto string
+	elems, hops := forwarded(r)
+	i := this.clientHop(hops)
+	if elems != nil {
+		if i < 0 {
+			i = len(elems) - 1
+		}
+		params := parseForwarded(elems[i])
+		if v := params["host"]; v != "" {
+			host = v
+		}
+		proto = params["proto"]
+	} else {
+		var nearest int
+		if i >= 0 {
+			nearest = len(hops) - 1 - i
+		}
+		if v := headerValue(r.Header.Get("X-Forwarded-Host"), nearest); v != "" {
+			host = v
+		}
+		proto = headerValue(r.Header.Get("X-Forwarded-Proto"), nearest)
+	}
+	if proto = strings.ToLower(proto); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return
+}
+
+// ClientIP returns the IP address of the client. Forwarded addresses are
+// walked from the nearest hop and the first untrusted address is returned.
+func (this *TrustedProxies) ClientIP(r *http.Request) net.IP {
+	ip := remoteIP(r)
+	if !this.Contains(ip) {
+		return ip
+	}
+	_, hops := forwarded(r)
+	if i := this.clientHop(hops); i >= 0 {
+		ip = parseIP(hops[i])
+	}
+	return ip
+}
+
+// forwarded returns the elements of the Forwarded header, and their `for`
+// hops, or the hops of the X-Forwarded-For header.
+func forwarded(r *http.Request) (elems, hops []string) {
+	if fwd := r.Header.Get("Forwarded"); fwd != "" {
+		elems = strings.Split(fwd, ",")
+		for _, elem := range elems {
+			hops = append(hops, parseForwarded(elem)["for"])
+		}
+	} else if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops = strings.Split(xff, ",")
+	}
+	return
+}
+
+// clientHop returns the index of the hop of the client: the hops are walked
+// from the nearest one and the first untrusted is returned. Returns -1 if the
+// nearest hop is not an IP address.
+func (this *TrustedProxies) clientHop(hops []string) (index int) {
+	index = -1
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseIP(hops[i])
+		if hop == nil {
+			break
+		}
+		index = i
+		if !this.Contains(hop) {
+			break
+		}
+	}
+	return
+}
+
+func remoteIP(r *http.Request) net.IP {
+	return parseIP(r.RemoteAddr)
+}
+
+func parseIP(addr string) net.IP {
+	addr = strings.Trim(strings.TrimSpace(addr), `"`)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+// headerValue returns the value of the comma separated list at the index from
+// the last. The first is returned if the list is shorter.
+func headerValue(value string, fromLast int) string {
+	if value == "" {
+		return ""
+	}
+	values := strings.Split(value, ",")
+	i := len(values) - 1 - fromLast
+	if i < 0 {
+		i = 0
+	}
+	return strings.TrimSpace(values[i])
+}
+
+// parseForwarded parses an element of a RFC 7239 Forwarded header.
+func parseForwarded(value string) map[string]string {
+	params := map[string]string{}
+	for _, pair := range strings.Split(value, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+	}
+	return params
+}
@@ -0,0 +1,104 @@
+package sites
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStripPort(t *testing.T) {
+	for host, want := range map[string]string{
+		"example.com":      "example.com",
+		"example.com:8080": "example.com",
+		"127.0.0.1:80":     "127.0.0.1",
+		"[::1]:443":        "::1",
+		"[::1]":            "::1",
+	} {
+		if got := StripPort(host); got != want {
+			t.Errorf("StripPort(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestTrustedProxiesResolve(t *testing.T) {
+	tp := MustParseTrustedProxies("10.0.0.0/8")
+
+	r := httptest.NewRequest("GET", "http://internal/", nil)
+	r.RemoteAddr = "10.1.2.3:5000"
+	r.Header.Set("X-Forwarded-Host", "shop.example.com:8443")
+	r.Header.Set("X-Forwarded-Proto", "HTTPS")
+	if host, scheme := tp.Resolve(r); host != "shop.example.com:8443" || scheme != "https" {
+		t.Errorf("trusted: got %q %q", host, scheme)
+	}
+
+	r.RemoteAddr = "192.168.0.1:5000"
+	if host, scheme := tp.Resolve(r); host != "internal" || scheme != "http" {
+		t.Errorf("untrusted: got %q %q", host, scheme)
+	}
+
+	r = httptest.NewRequest("GET", "http://internal/", nil)
+	r.RemoteAddr = "10.1.2.3:5000"
+	r.Header.Set("Forwarded", `for=1.2.3.4;host="a.example.com";proto=https`)
+	if host, scheme := tp.Resolve(r); host != "a.example.com" || scheme != "https" {
+		t.Errorf("forwarded: got %q %q", host, scheme)
+	}
+}
+
+func TestTrustedProxiesResolveClientHop(t *testing.T) {
+	tp := MustParseTrustedProxies("10.0.0.0/8")
+	for _, tt := range []struct {
+		name         string
+		headers      map[string]string
+		host, scheme string
+	}{
+		{"forwarded spoofed by client", map[string]string{
+			"Forwarded": `for=6.6.6.6;host=evil.com;proto=https, for=1.2.3.4;host=shop.com;proto=http, for=10.0.0.1;host=internal;proto=https`,
+		}, "shop.com", "http"},
+		{"forwarded of trusted hops", map[string]string{
+			"Forwarded": `for=10.0.0.3;host=shop.com;proto=https, for=10.0.0.1;host=internal`,
+		}, "shop.com", "https"},
+		{"forwarded without for", map[string]string{
+			"Forwarded": `host=evil.com, host=shop.com;proto=https`,
+		}, "shop.com", "https"},
+		{"x-forwarded spoofed by client", map[string]string{
+			"X-Forwarded-For":   "6.6.6.6, 1.2.3.4, 10.0.0.1",
+			"X-Forwarded-Host":  "evil.com, shop.com, internal",
+			"X-Forwarded-Proto": "http, https, http",
+		}, "shop.com", "https"},
+		{"x-forwarded without for", map[string]string{
+			"X-Forwarded-Host":  "evil.com, shop.com",
+			"X-Forwarded-Proto": "http, https",
+		}, "shop.com", "https"},
+		{"invalid proto", map[string]string{
+			"X-Forwarded-Host":  "shop.com",
+			"X-Forwarded-Proto": "javascript",
+		}, "shop.com", "http"},
+		{"invalid forwarded proto", map[string]string{
+			"Forwarded": `for=1.2.3.4;host=shop.com;proto=ftp`,
+		}, "shop.com", "http"},
+	} {
+		r := httptest.NewRequest("GET", "http://internal/", nil)
+		r.RemoteAddr = "10.0.0.2:5000"
+		for key, value := range tt.headers {
+			r.Header.Set(key, value)
+		}
+		if host, scheme := tp.Resolve(r); host != tt.host || scheme != tt.scheme {
+			t.Errorf("%s: got %q %q, want %q %q", tt.name, host, scheme, tt.host, tt.scheme)
+		}
+	}
+}
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	tp := MustParseTrustedProxies("10.0.0.0/8")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:5000"
+	r.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4, 10.0.0.1")
+	if ip := tp.ClientIP(r); ip.String() != "1.2.3.4" {
+		t.Errorf("got %v, want 1.2.3.4", ip)
+	}
+
+	r.RemoteAddr = "1.1.1.1:5000"
+	if ip := tp.ClientIP(r); ip.String() != "1.1.1.1" {
+		t.Errorf("untrusted peer: got %v", ip)
+	}
+}
@@ -0,0 +1,272 @@
+package sites
+
+import (
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/moisespsena-go/xroute"
+
+	"github.com/ecletus/core"
+)
+
+const RateLimitConfigKey = "rate_limit"
+
+// RateLimit is a token bucket refilled with Rate tokens per second, holding up to Burst tokens.
+type RateLimit struct {
+	Rate  float64 `mapstructure:"rate"`
+	Burst int     `mapstructure:"burst"`
+}
+
+func (this RateLimit) Enabled() bool {
+	return this.Rate > 0
+}
+
+func (this RateLimit) burst() float64 {
+	if this.Burst < 1 {
+		return math.Max(1, this.Rate)
+	}
+	return float64(this.Burst)
+}
+
+type PathRateLimit struct {
+	RateLimit `mapstructure:",squash"`
+	// Pattern of the path relative to the site mount. A trailing `**` matches any suffix.
+	Pattern string `mapstructure:"pattern"`
+	// PerClient limits each client IP separately on this pattern
+	PerClient bool `mapstructure:"per_client"`
+}
+
+func (this *PathRateLimit) Match(pth string) bool {
+	if strings.HasSuffix(this.Pattern, "**") {
+		return strings.HasPrefix(pth, strings.TrimSuffix(this.Pattern, "**"))
+	}
+	ok, _ := path.Match(this.Pattern, pth)
+	return ok
+}
+
+// RateLimitConfig is the `rate_limit` key of the site config.
+type RateLimitConfig struct {
+	Site   RateLimit       `mapstructure:"site"`
+	Client RateLimit       `mapstructure:"client"`
+	Paths  []PathRateLimit `mapstructure:"paths"`
+}
+
+// RateLimitBucket is a bucket used by a request.
+type RateLimitBucket struct {
+	Key   string
+	Limit RateLimit
+}
+
+// RateLimitStore holds the limit state. The default store lives in memory,
+// a shared store allows limiting across processes.
+type RateLimitStore interface {
+	// Take consumes one token of each bucket, atomically: if a bucket has no
+	// token available, none is consumed, and returns false and the wait until
+	// the next token of the limited buckets.
+	Take(buckets []RateLimitBucket, now time.Time) (ok bool, retryAfter time.Duration)
+	// Reset removes the buckets with the key prefix.
+	Reset(prefix string)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*bucket{}}
+}
+
+func (this *MemoryRateLimitStore) Take(buckets []RateLimitBucket, now time.Time) (ok bool, retryAfter time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.takes++; this.takes%10000 == 0 {
+		this.gc(now)
+	}
+
+	var bs = make([]*bucket, len(buckets))
+	for i, rb := range buckets {
+		burst := rb.Limit.burst()
+		b := this.buckets[rb.Key]
+		if b == nil {
+			b = &bucket{tokens: burst, last: now}
+			this.buckets[rb.Key] = b
+		} else {
+			b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rb.Limit.Rate)
+			b.last = now
+		}
+		if b.tokens < 1 {
+			if wait := time.Duration((1 - b.tokens) / rb.Limit.Rate * float64(time.Second)); wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+		bs[i] = b
+	}
+	if retryAfter > 0 {
+		return false, retryAfter
+	}
+	for _, b := range bs {
+		b.tokens--
+	}
+	return true, 0
+}
+
+func (this *MemoryRateLimitStore) Reset(prefix string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for key := range this.buckets {
+		if strings.HasPrefix(key, prefix) {
+			delete(this.buckets, key)
+		}
+	}
+}
+
+// gc removes the buckets untouched for a minute, they are full again anyway.
+func (this *MemoryRateLimitStore) gc(now time.Time) {
+	for key, b := range this.buckets {
+		if now.Sub(b.last) > time.Minute {
+			delete(this.buckets, key)
+		}
+	}
+}
+
+type RateLimitCounters struct {
+	Allowed uint64
+	Limited uint64
+}
+
+type rateLimitSite struct {
+	config  *RateLimitConfig
+	allowed uint64
+	limited uint64
+}
+
+// RateLimiter limits the requests per site, per client IP and per site path pattern.
+type RateLimiter struct {
+	Store RateLimitStore
+	sites sync.Map
+}
+
+func NewRateLimiter(store RateLimitStore) *RateLimiter {
+	if store == nil {
+		store = NewMemoryRateLimitStore()
+	}
+	return &RateLimiter{Store: store}
+}
+
+func (this *RateLimiter) site(site *core.Site) *rateLimitSite {
+	if v, ok := this.sites.Load(site.Name()); ok {
+		return v.(*rateLimitSite)
+	}
+	s := &rateLimitSite{config: &RateLimitConfig{}}
+	if _, err := DecodeSiteConfig(site, RateLimitConfigKey, s.config); err != nil {
+		log.Errorf("[%s] decode rate limit config failed: %v", site.Name(), err)
+	}
+	v, _ := this.sites.LoadOrStore(site.Name(), s)
+	return v.(*rateLimitSite)
+}
+
+// Forget drops the state of the site.
+func (this *RateLimiter) Forget(site *core.Site) {
+	this.sites.Delete(site.Name())
+	this.Store.Reset(site.Name() + "|")
+}
+
+// Counters returns the counters of each site.
+func (this *RateLimiter) Counters() map[string]RateLimitCounters {
+	counters := map[string]RateLimitCounters{}
+	this.sites.Range(func(key, value interface{}) bool {
+		s := value.(*rateLimitSite)
+		counters[key.(string)] = RateLimitCounters{
+			Allowed: atomic.LoadUint64(&s.allowed),
+			Limited: atomic.LoadUint64(&s.limited),
+		}
+		return true
+	})
+	return counters
+}
+
+// Allow reports whether the request can be served by site. The tokens of the
+// site, client and path buckets are consumed only if all of them allow the
+// request, so the requests limited by the client or path limits do not
+// consume the site limit.
+func (this *RateLimiter) Allow(site *core.Site, r *http.Request) (ok bool, retryAfter time.Duration) {
+	var (
+		s       = this.site(site)
+		cfg     = s.config
+		key     = site.Name() + "|"
+		ip      string
+		buckets []RateLimitBucket
+	)
+
+	add := func(bucket string, limit RateLimit) {
+		if limit.Enabled() {
+			buckets = append(buckets, RateLimitBucket{key + bucket, limit})
+		}
+	}
+
+	if cfg.Client.Enabled() || len(cfg.Paths) > 0 {
+		ip = ClientIP(r).String()
+	}
+
+	add("site", cfg.Site)
+	add("client|"+ip, cfg.Client)
+	for i := range cfg.Paths {
+		p := &cfg.Paths[i]
+		if !p.Match(r.URL.Path) {
+			continue
+		}
+		bucket := "path|" + p.Pattern
+		if p.PerClient {
+			bucket += "|" + ip
+		}
+		add(bucket, p.RateLimit)
+	}
+	if len(buckets) > 0 {
+		if ok, retryAfter = this.Store.Take(buckets, time.Now()); !ok {
+			atomic.AddUint64(&s.limited, 1)
+			return
+		}
+	}
+	atomic.AddUint64(&s.allowed, 1)
+	return true, 0
+}
+
+// Middleware returns the middleware to be registered on SitesRouter.Middlewares.
+func (this *RateLimiter) Middleware() *xroute.Middleware {
+	md := xroute.NewMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if site := RequestSite(r); site != nil {
+				if ok, retryAfter := this.Allow(site, r); !ok {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+					http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	md.Name = PKG + ".RateLimit"
+	return md
+}
+
+// UseRateLimit registers the rate limit middleware. If store is nil, the state lives in memory.
+func (this *SitesRouter) UseRateLimit(store RateLimitStore) *RateLimiter {
+	this.RateLimiter = NewRateLimiter(store)
+	this.Register.OnSiteDestroy(this.RateLimiter.Forget)
+	this.Use(this.RateLimiter.Middleware())
+	return this.RateLimiter
+}
@@ -0,0 +1,125 @@
+package sites
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/moisespsena-go/maps"
+)
+
+func TestMemoryRateLimitStoreTake(t *testing.T) {
+	var (
+		store = NewMemoryRateLimitStore()
+		limit = RateLimit{Rate: 2, Burst: 3}
+		now   = time.Now()
+		a     = []RateLimitBucket{{"a", limit}}
+	)
+	for i := 0; i < 3; i++ {
+		if ok, _ := store.Take(a, now); !ok {
+			t.Fatalf("take %d: limited inside the burst", i)
+		}
+	}
+	ok, retryAfter := store.Take(a, now)
+	if ok {
+		t.Fatal("expected limited after the burst")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Errorf("retryAfter = %v, want 500ms", retryAfter)
+	}
+	if ok, _ = store.Take([]RateLimitBucket{{"b", limit}}, now); !ok {
+		t.Error("other key limited")
+	}
+	if ok, _ = store.Take(a, now.Add(500*time.Millisecond)); !ok {
+		t.Error("expected a token refilled")
+	}
+
+	store.Reset("a")
+	for i := 0; i < 3; i++ {
+		if ok, _ = store.Take(a, now); !ok {
+			t.Fatalf("take %d after reset: limited", i)
+		}
+	}
+}
+
+func TestMemoryRateLimitStoreTakeAll(t *testing.T) {
+	var (
+		store = NewMemoryRateLimitStore()
+		now   = time.Now()
+		wide  = RateLimitBucket{"wide", RateLimit{Rate: 1, Burst: 10}}
+		tight = RateLimitBucket{"tight", RateLimit{Rate: 1, Burst: 1}}
+	)
+	if ok, _ := store.Take([]RateLimitBucket{wide, tight}, now); !ok {
+		t.Fatal("limited inside the burst")
+	}
+	if ok, retryAfter := store.Take([]RateLimitBucket{wide, tight}, now); ok || retryAfter != time.Second {
+		t.Fatalf("take over the tight burst = %v, %v", ok, retryAfter)
+	}
+	// the limited take did not consume the wide bucket
+	for i := 0; i < 9; i++ {
+		if ok, _ := store.Take([]RateLimitBucket{wide}, now); !ok {
+			t.Fatalf("wide take %d: limited", i)
+		}
+	}
+	if ok, _ := store.Take([]RateLimitBucket{wide}, now); ok {
+		t.Error("wide bucket not limited after its burst")
+	}
+}
+
+func TestRateLimiterClientFloodKeepsSiteBudget(t *testing.T) {
+	limiter := NewRateLimiter(nil)
+	site := newTestSite("a", maps.MapSI{RateLimitConfigKey: maps.MapSI{
+		"site":   maps.MapSI{"rate": 0.001, "burst": 10},
+		"client": maps.MapSI{"rate": 0.001, "burst": 2},
+	}})
+	request := func(ip string) bool {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = ip + ":5000"
+		ok, _ := limiter.Allow(site, r)
+		return ok
+	}
+
+	var allowed int
+	for i := 0; i < 100; i++ {
+		if request("6.6.6.6") {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Fatalf("flood: %d allowed, want 2", allowed)
+	}
+	// the other clients use the rest of the site budget
+	for i := 0; i < 4; i++ {
+		ip := fmt.Sprintf("1.1.1.%d", i)
+		for j := 0; j < 2; j++ {
+			if !request(ip) {
+				t.Fatalf("client %s request %d limited", ip, j)
+			}
+		}
+	}
+	if request("2.2.2.2") {
+		t.Error("site not limited after its burst")
+	}
+	if counters := limiter.Counters()["a"]; counters.Allowed != 10 || counters.Limited != 99 {
+		t.Errorf("counters = %+v", counters)
+	}
+}
+
+func TestPathRateLimitMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, path string
+		match         bool
+	}{
+		{"/login", "/login", true},
+		{"/login", "/login/x", false},
+		{"/api/**", "/api/a/b", true},
+		{"/api/**", "/apix", false},
+		{"/user/*/edit", "/user/1/edit", true},
+	} {
+		p := &PathRateLimit{Pattern: c.pattern}
+		if got := p.Match(c.path); got != c.match {
+			t.Errorf("%q.Match(%q) = %v, want %v", c.pattern, c.path, got, c.match)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package sites
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/moisespsena-go/xroute"
+
+	"github.com/ecletus/core"
+)
+
+type RegistrationMode string
+
+const (
+	// RegistrationClosed nobody can register
+	RegistrationClosed RegistrationMode = "closed"
+	// RegistrationOpen anyone can register
+	RegistrationOpen RegistrationMode = "open"
+	// RegistrationInvite requires a valid invite
+	RegistrationInvite RegistrationMode = "invite"
+	// RegistrationDomain requires an email of the allowed domains
+	RegistrationDomain RegistrationMode = "domain"
+	// RegistrationApproval anyone can register, but the account waits an admin approval
+	RegistrationApproval RegistrationMode = "approval"
+)
+
+// InviteChecker validates the invite code of email on the site.
+type InviteChecker func(site *core.Site, email, code string) (ok bool, err error)
+
+// RegistrationPolicy is the `auth.registration` key of the site config.
+type RegistrationPolicy struct {
+	Mode RegistrationMode `mapstructure:"mode"`
+	// AllowedDomains of the emails on the `domain` mode
+	AllowedDomains []string `mapstructure:"allowed_domains"`
+	// Paths of the registration routes, relative to the site mount. The
+	// middleware rejects them if the registration is closed.
+	Paths []string `mapstructure:"paths"`
+}
+
+type RegistrationRequest struct {
+	Email      string
+	InviteCode string
+}
+
+type RegistrationDecision struct {
+	Allowed bool
+	// PendingApproval the account must be approved by an admin before use
+	PendingApproval bool
+	Reason          string
+}
+
+// AllowDomain reports whether the email domain is allowed.
+func (this *RegistrationPolicy) AllowDomain(email string) bool {
+	pos := strings.LastIndexByte(email, '@')
+	if pos < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[pos+1:])
+	for _, allowed := range this.AllowedDomains {
+		allowed = strings.ToLower(allowed)
+		if domain == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(domain, allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check decides whether the registration request is allowed on the site.
+func (this *RegistrationPolicy) Check(site *core.Site, req *RegistrationRequest, invites InviteChecker) (d RegistrationDecision, err error) {
+	switch this.Mode {
+	case RegistrationOpen:
+		d.Allowed = true
+	case RegistrationApproval:
+		d.Allowed, d.PendingApproval = true, true
+	case RegistrationDomain:
+		if d.Allowed = this.AllowDomain(req.Email); !d.Allowed {
+			d.Reason = "email domain not allowed"
+		}
+	case RegistrationInvite:
+		if req.InviteCode == "" {
+			d.Reason = "invite required"
+		} else if invites == nil {
+			err = fmt.Errorf("site %q: no invite checker", site.Name())
+		} else if d.Allowed, err = invites(site, req.Email, req.InviteCode); err == nil && !d.Allowed {
+			d.Reason = "invalid invite"
+		}
+	case RegistrationClosed:
+		d.Reason = "registration closed"
+	default:
+		err = fmt.Errorf("site %q: bad registration mode %q", site.Name(), this.Mode)
+	}
+	return
+}
+
+// Registrations is the registration policies query API consulted by the auth plugins.
+type Registrations struct {
+	// Invites validates the invites on the `invite` mode
+	Invites InviteChecker
+}
+
+// Policy returns the registration policy of the site. If not defined, the
+// mode is `open` if `auth.user_registration` is enabled, otherwise `closed`.
+func (this *Registrations) Policy(site *core.Site) (*RegistrationPolicy, error) {
+	cfg, err := SiteAuthConfig(site)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Registration != nil && cfg.Registration.Mode != "" {
+		return cfg.Registration, nil
+	}
+	policy := &RegistrationPolicy{Mode: RegistrationClosed}
+	if cfg.Registration != nil {
+		*policy = *cfg.Registration
+	}
+	if cfg.UserRegistration {
+		policy.Mode = RegistrationOpen
+	}
+	return policy, nil
+}
+
+// Check decides whether the registration request is allowed on the site.
+func (this *Registrations) Check(site *core.Site, req *RegistrationRequest) (d RegistrationDecision, err error) {
+	var policy *RegistrationPolicy
+	if policy, err = this.Policy(site); err != nil {
+		return
+	}
+	return policy.Check(site, req, this.Invites)
+}
+
+// Middleware rejects the registration paths of the sites where the
+// registration is closed. It only gates the closed registration: the requests
+// of the other modes are passed, and the auth plugins must decide them with
+// Check, as the middleware does not know the email or the invite.
+func (this *Registrations) Middleware() *xroute.Middleware {
+	md := xroute.NewMiddleware(this.handler)
+	md.Name = PKG + ".Registration"
+	return md
+}
+
+func (this *Registrations) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if site := RequestSite(r); site != nil {
+			policy, err := this.Policy(site)
+			if err != nil {
+				log.Errorf("[%s] registration policy: %v", site.Name(), err)
+			} else if policy.Mode == RegistrationClosed && policy.MatchPath(r.URL.Path) {
+				http.Error(w, "registration closed", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MatchPath reports whether the path is, or is under, a registration path.
+// The path is cleaned, so that `//register` or `/./register` match `/register`.
+func (this *RegistrationPolicy) MatchPath(pth string) bool {
+	pth = path.Clean("/" + pth)
+	for _, registration := range this.Paths {
+		registration = path.Clean("/" + registration)
+		if pth == registration || strings.HasPrefix(pth, strings.TrimSuffix(registration, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// UseRegistrations registers the registration policies middleware.
+func (this *SitesRouter) UseRegistrations(invites InviteChecker) *Registrations {
+	this.Registrations = &Registrations{Invites: invites}
+	this.Use(this.Registrations.Middleware())
+	return this.Registrations
+}
@@ -0,0 +1,110 @@
+package sites
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ecletus/core"
+	"github.com/moisespsena-go/maps"
+	"github.com/moisespsena-go/xroute"
+)
+
+func newTestRegistrationSite(name string, registration maps.MapSI) *core.Site {
+	auth := maps.MapSI{}
+	if registration != nil {
+		auth["registration"] = registration
+	}
+	return newTestSite(name, maps.MapSI{AuthConfigKey: auth})
+}
+
+func TestRegistrationsMiddleware(t *testing.T) {
+	var (
+		registrations = &Registrations{}
+		next          = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		paths         = []interface{}{"/register", "/auth/signup/"}
+	)
+	for _, mode := range []RegistrationMode{RegistrationClosed, RegistrationOpen, RegistrationInvite, RegistrationDomain, RegistrationApproval} {
+		site := newTestRegistrationSite("site-"+string(mode), maps.MapSI{"mode": string(mode), "paths": paths})
+		for pth, registration := range map[string]bool{
+			"/register":             true,
+			"/register/":            true,
+			"/register/confirm":     true,
+			"//register":            true,
+			"/./register":           true,
+			"/x/../register":        true,
+			"/auth/signup":          true,
+			"/auth//signup/step":    true,
+			"/registered":           false,
+			"/login":                false,
+			"/auth/signup-required": false,
+		} {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.URL.Path = pth
+			r, rctx := xroute.GetOrNewRouteContextForRequest(r)
+			ContextSetSite(rctx, site)
+			w := httptest.NewRecorder()
+			registrations.handler(next).ServeHTTP(w, r)
+
+			forbidden := mode == RegistrationClosed && registration
+			if got := w.Code == http.StatusForbidden; got != forbidden {
+				t.Errorf("%s %q: status %d", mode, pth, w.Code)
+			}
+		}
+	}
+}
+
+func TestRegistrationsPolicy(t *testing.T) {
+	registrations := &Registrations{}
+	for _, c := range []struct {
+		name string
+		auth maps.MapSI
+		mode RegistrationMode
+	}{
+		{"default", maps.MapSI{}, RegistrationClosed},
+		{"user registration", maps.MapSI{"user_registration": true}, RegistrationOpen},
+		{"policy overrides", maps.MapSI{"user_registration": true, "registration": maps.MapSI{"mode": "invite"}}, RegistrationInvite},
+		{"policy without mode", maps.MapSI{"registration": maps.MapSI{"paths": []interface{}{"/register"}}}, RegistrationClosed},
+	} {
+		policy, err := registrations.Policy(newTestSite("policy-"+c.name, maps.MapSI{AuthConfigKey: c.auth}))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if policy.Mode != c.mode {
+			t.Errorf("%s: mode %q, want %q", c.name, policy.Mode, c.mode)
+		}
+	}
+}
+
+func TestRegistrationPolicyCheck(t *testing.T) {
+	site := newTestSite("a", nil)
+	invites := func(site *core.Site, email, code string) (bool, error) {
+		if code == "fail" {
+			return false, errors.New("failed")
+		}
+		return code == "valid", nil
+	}
+	for _, c := range []struct {
+		policy  RegistrationPolicy
+		req     RegistrationRequest
+		allowed bool
+		pending bool
+		err     bool
+	}{
+		{RegistrationPolicy{Mode: RegistrationClosed}, RegistrationRequest{}, false, false, false},
+		{RegistrationPolicy{Mode: RegistrationOpen}, RegistrationRequest{}, true, false, false},
+		{RegistrationPolicy{Mode: RegistrationApproval}, RegistrationRequest{}, true, true, false},
+		{RegistrationPolicy{Mode: RegistrationDomain, AllowedDomains: []string{"*.example.com"}}, RegistrationRequest{Email: "a@b.example.com"}, true, false, false},
+		{RegistrationPolicy{Mode: RegistrationDomain, AllowedDomains: []string{"example.com"}}, RegistrationRequest{Email: "a@other.com"}, false, false, false},
+		{RegistrationPolicy{Mode: RegistrationInvite}, RegistrationRequest{}, false, false, false},
+		{RegistrationPolicy{Mode: RegistrationInvite}, RegistrationRequest{InviteCode: "valid"}, true, false, false},
+		{RegistrationPolicy{Mode: RegistrationInvite}, RegistrationRequest{InviteCode: "other"}, false, false, false},
+		{RegistrationPolicy{Mode: RegistrationInvite}, RegistrationRequest{InviteCode: "fail"}, false, false, true},
+		{RegistrationPolicy{Mode: "bad"}, RegistrationRequest{}, false, false, true},
+	} {
+		d, err := c.policy.Check(site, &c.req, invites)
+		if (err != nil) != c.err || d.Allowed != c.allowed || d.PendingApproval != c.pending {
+			t.Errorf("%s %+v: %+v, %v", c.policy.Mode, c.req, d, err)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package sites
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/ecletus/core"
+	"github.com/moisespsena-go/maps"
+)
+
+// SitePaths tracks the paths mounted by each site and the alias paths of the
+// renamed sites, that redirect to the new site path.
+type SitePaths struct {
+	// File if not blank, the JSON file where the aliases are saved
+	File string
+
+	mu      sync.RWMutex
+	paths   map[string]map[string]bool
+	aliases map[string]string
+}
+
+func (this *SitePaths) init(register *core.SitesRegister) {
+	if err := this.load(); err != nil {
+		log.Errorf("load site aliases: %v", err)
+	}
+	register.OnPathAdd(func(site *core.Site, pth string) {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		if this.paths == nil {
+			this.paths = map[string]map[string]bool{}
+		}
+		if this.paths[site.Name()] == nil {
+			this.paths[site.Name()] = map[string]bool{}
+		}
+		this.paths[site.Name()][pth] = true
+	})
+	register.OnPathDel(func(site *core.Site, pth string) {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		delete(this.paths[site.Name()], pth)
+	})
+	register.OnSiteDestroy(func(site *core.Site) {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		delete(this.paths, site.Name())
+	})
+}
+
+// Paths returns the sorted paths mounted by the site.
+func (this *SitePaths) Paths(siteName string) (paths []string) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	for pth := range this.paths[siteName] {
+		paths = append(paths, pth)
+	}
+	sort.Strings(paths)
+	return
+}
+
+// AddAlias redirects the requests of pth to the site, saving the aliases.
+func (this *SitePaths) AddAlias(pth, siteName string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.aliases == nil {
+		this.aliases = map[string]string{}
+	}
+	this.aliases[pth] = siteName
+	// the aliases of the aliases follow the rename
+	for alias, target := range this.aliases {
+		if target == pth {
+			this.aliases[alias] = siteName
+		}
+	}
+	return this.save()
+}
+
+func (this *SitePaths) DelAlias(pth string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	delete(this.aliases, pth)
+	return this.save()
+}
+
+// load reads the aliases of File.
+func (this *SitePaths) load() (err error) {
+	if this.File == "" {
+		return nil
+	}
+	var data []byte
+	if data, err = ioutil.ReadFile(this.File); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return json.Unmarshal(data, &this.aliases)
+}
+
+// save writes the aliases into File.
+func (this *SitePaths) save() (err error) {
+	if this.File == "" {
+		return nil
+	}
+	var (
+		data []byte
+		f    *os.File
+	)
+	if data, err = json.MarshalIndent(this.aliases, "", "  "); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(this.File), 0755); err != nil {
+		return
+	}
+	if f, err = ioutil.TempFile(filepath.Dir(this.File), "."+filepath.Base(this.File)+".*.tmp"); err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	return os.Rename(f.Name(), this.File)
+}
+
+// Alias returns the site name of the alias path.
+func (this *SitePaths) Alias(pth string) (siteName string, ok bool) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	siteName, ok = this.aliases[pth]
+	return
+}
+
+// Rename renames the site, creating the new site with factory. The data dir
+// is moved, the DBs are kept, the site entry of the config files is renamed,
+// the paths of the site are mounted by the new site and the old name path
+// redirects to the new one. The old site is removed, and drained, before the
+// data dir is moved, so that its in flight requests do not write into the
+// moved dir. If the rename fails, the old site is created again with factory
+// and registered.
+func (this *SitesRouter) Rename(oldName, newName string, factory SiteFactory) (site *core.Site, err error) {
+	old, ok := this.Register.ByName.Get(oldName)
+	if !ok {
+		return nil, fmt.Errorf("site %q does not exists", oldName)
+	}
+	if err = ValidateSiteName(newName); err != nil {
+		return
+	}
+	if this.Register.Has(newName) {
+		return nil, fmt.Errorf("site %q already exists", newName)
+	}
+	var (
+		cfg    maps.MapSI
+		paths  = this.Paths.Paths(oldName)
+		pins   = map[string]string{}
+		oldDir = this.Config.SiteDirs(oldName).Root
+		newDir = this.Config.SiteDirs(newName).Root
+		undo   func()
+	)
+	if _, err = os.Stat(newDir); err == nil {
+		return nil, fmt.Errorf("data dir %q exists", newDir)
+	}
+	if cfg, err = this.Config.MergeSiteConfig(oldName); err != nil {
+		return
+	}
+	pinDBs(cfg, old, pins)
+	if err = pinIsolation(cfg, old, pins); err != nil {
+		return
+	}
+	if site, err = factory(newName, cfg); err != nil {
+		return
+	}
+	if undo, err = this.Config.RenameSiteConfig(oldName, newName, pins); err != nil {
+		return
+	}
+
+	this.Register.Remove(oldName)
+	// reAdd registers the old site again, created by factory: the removed one
+	// was destroyed
+	reAdd := func() {
+		undo()
+		var (
+			cfg maps.MapSI
+			err error
+		)
+		if cfg, err = this.Config.MergeSiteConfig(oldName); err == nil {
+			if old, err = factory(oldName, cfg); err == nil {
+				err = this.Register.Add(old)
+			}
+		}
+		if err != nil {
+			log.Errorf("[%s] register the site again after the failed rename: %v", oldName, err)
+			return
+		}
+		for _, pth := range paths {
+			if pth != oldName {
+				this.Register.AddPath(oldName, pth)
+			}
+		}
+	}
+
+	if _, err = os.Stat(oldDir); err == nil {
+		if err = os.MkdirAll(filepath.Dir(newDir), 0755); err == nil {
+			err = moveDir(oldDir, newDir)
+		}
+		if err != nil {
+			os.RemoveAll(newDir)
+			reAdd()
+			return nil, fmt.Errorf("move data dir: %v", err)
+		}
+		// the left files of a copied dir
+		os.RemoveAll(oldDir)
+	} else if !os.IsNotExist(err) {
+		reAdd()
+		return
+	}
+
+	if err = this.Register.Add(site); err != nil {
+		if err := moveDir(newDir, oldDir); err != nil {
+			log.Errorf("[%s] move back the data dir after the failed rename: %v", oldName, err)
+		}
+		reAdd()
+		return nil, err
+	}
+	for _, pth := range paths {
+		if pth != oldName {
+			this.Register.AddPath(newName, pth)
+		}
+	}
+	if err = this.Paths.AddAlias(oldName, newName); err != nil {
+		log.Errorf("[%s] save alias %q: %v", newName, oldName, err)
+	}
+	return site, nil
+}
+
+// pinDBs sets the names of the DBs of the site into cfg, so that the names
+// derived from the site name are kept, and adds them to pins.
+func pinDBs(cfg maps.MapSI, site *core.Site, pins map[string]string) {
+	dbs, _ := cfg["db"].(maps.MapSI)
+	for name, dbCfg := range site.Config().Db {
+		if db, ok := dbs[name].(maps.MapSI); ok {
+			db["name"] = dbCfg.Name
+			pins["db."+name+".name"] = dbCfg.Name
+		}
+	}
+}
+
+// pinIsolation sets the isolation name of the site into cfg, if derived from
+// the site name, so that the schema or the table prefix of the site is kept,
+// and adds it to pins.
+func pinIsolation(cfg maps.MapSI, site *core.Site, pins map[string]string) (err error) {
+	var (
+		isolationCfg IsolationConfig
+		ok           bool
+	)
+	if ok, err = DecodeSiteConfig(site, IsolationConfigKey, &isolationCfg); err != nil || !ok ||
+		isolationCfg.Strategy == IsolationNone || isolationCfg.Name != "" {
+		return
+	}
+	var isolation *DBIsolation
+	if isolation, err = isolationCfg.Isolation(site.Name()); err != nil {
+		return
+	}
+	raw, ok := configMap(cfg[IsolationConfigKey])
+	if !ok {
+		return fmt.Errorf("%s: not a map", IsolationConfigKey)
+	}
+	raw["name"] = isolation.Namespace
+	cfg[IsolationConfigKey] = raw
+	pins[IsolationConfigKey+".name"] = isolation.Namespace
+	return nil
+}
+
+// Clone creates a copy of the site with the new name, with its config, the
+// content of its DBs and its data dir. The DBs of the new site must not be
+// used by other sites.
+func (this *Backups) Clone(ctx context.Context, site *core.Site, newName string) (*core.Site, error) {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(this.Backup(ctx, site, w))
+	}()
+	defer r.Close()
+	return this.Restore(ctx, r, newName)
+}
+
+type renameArgs struct {
+	Site    string `json:"site"`
+	NewName string `json:"new_name"`
+}
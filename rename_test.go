@@ -0,0 +1,270 @@
+package sites
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ecletus/core"
+	"github.com/ecletus/core/db/dbconfig"
+	"github.com/ecletus/core/site_config"
+	"github.com/moisespsena-go/maps"
+
+	"github.com/ecletus/sites/dir_config"
+)
+
+func newTestRenameRouter(t *testing.T) (router *SitesRouter, cleanup func()) {
+	dir, err := ioutil.TempDir("", "rename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	configDir := filepath.Join(dir, "config")
+	for name, data := range map[string]string{
+		"config.yaml":  "data_dir: " + filepath.Join(dir, "data") + "\n",
+		"sites/a.yaml": "title: A\ndb:\n  default:\n    adapter: postgres\n",
+	} {
+		pth := filepath.Join(configDir, name)
+		if err = os.MkdirAll(filepath.Dir(pth), 0755); err == nil {
+			err = ioutil.WriteFile(pth, []byte(data), 0644)
+		}
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	config, err := LoadConfig(dir_config.NewLoader(), configDir)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	router = NewSitesRouter(&core.SitesRegister{}, nil)
+	router.Config = config
+	router.Paths.File = filepath.Join(config.DataDir, "aliases.json")
+	router.Paths.init(router.Register)
+	site := core.NewSite("a", site_config.Config{
+		Raw: config.Sites["a"].(maps.MapSI),
+		Db:  map[string]*dbconfig.DBConfig{"default": {Adapter: "postgres", Name: "db_a"}},
+	}, nil, nil)
+	if err = router.Register.Add(site); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	if err = config.SiteDirs("a").Create(); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	pth, _ := config.SiteDirs("a").Data("file.txt")
+	if err = ioutil.WriteFile(pth, []byte("content"), 0644); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestRename(t *testing.T) {
+	router, cleanup := newTestRenameRouter(t)
+	defer cleanup()
+	config := router.Config
+
+	var created maps.MapSI
+	site, err := router.Rename("a", "b", func(siteName string, cfg maps.MapSI) (*core.Site, error) {
+		created = cfg
+		return newTestSite(siteName, cfg), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if site.Name() != "b" || !router.Register.Has("b") || router.Register.Has("a") {
+		t.Error("site not renamed in the register")
+	}
+	if name := lookup(created, []string{"db", "default", "name"}); name != "db_a" {
+		t.Errorf("created with DB name %v", name)
+	}
+
+	if data, _ := ioutil.ReadFile(filepath.Join(config.SiteDirs("b").Root, SiteDirData, "file.txt")); string(data) != "content" {
+		t.Errorf("moved file = %q", data)
+	}
+	if _, err = os.Stat(config.SiteDirs("a").Root); !os.IsNotExist(err) {
+		t.Errorf("old data dir kept: %v", err)
+	}
+
+	if _, err = os.Stat(filepath.Join(config.Dir, "sites", "a.yaml")); !os.IsNotExist(err) {
+		t.Errorf("old config file kept: %v", err)
+	}
+	reloaded, err := LoadConfig(dir_config.NewLoader(), config.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Config{config, reloaded} {
+		if _, ok := c.Sites["a"]; ok {
+			t.Error("old site config kept")
+		}
+		b, _ := c.Sites["b"].(maps.MapSI)
+		if b == nil || b["title"] != "A" || lookup(b, []string{"db", "default", "name"}) != "db_a" {
+			t.Errorf("site b config = %v", b)
+		}
+	}
+
+	if target, ok := router.Paths.Alias("a"); !ok || target != "b" {
+		t.Errorf("alias a = %q, %v", target, ok)
+	}
+	paths := &SitePaths{File: router.Paths.File}
+	if err = paths.load(); err != nil {
+		t.Fatal(err)
+	}
+	if target, _ := paths.Alias("a"); target != "b" {
+		t.Errorf("saved alias a = %q", target)
+	}
+}
+
+func TestRenamePinsIsolation(t *testing.T) {
+	router, cleanup := newTestRenameRouter(t)
+	defer cleanup()
+	config := router.Config
+	// the site raw config is the config entry
+	config.Sites["a"].(maps.MapSI)[IsolationConfigKey] = maps.MapSI{"strategy": string(IsolationTablePrefix)}
+
+	var created *core.Site
+	if _, err := router.Rename("a", "b", func(siteName string, cfg maps.MapSI) (*core.Site, error) {
+		created = newTestSite(siteName, cfg)
+		return created, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	isolation, err := SiteIsolation(created, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isolation == nil || isolation.Namespace != "a_" {
+		t.Errorf("isolation of the renamed site = %+v", isolation)
+	}
+	b, _ := config.Sites["b"].(maps.MapSI)
+	if name := lookup(b, []string{IsolationConfigKey, "name"}); name != "a_" {
+		t.Errorf("pinned isolation name = %v", name)
+	}
+	reloaded, err := LoadConfig(dir_config.NewLoader(), config.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = reloaded.Sites["b"].(maps.MapSI)
+	if name := lookup(b, []string{IsolationConfigKey, "name"}); name != "a_" {
+		t.Errorf("saved isolation name = %v", name)
+	}
+}
+
+func TestRenameKeepsOldSite(t *testing.T) {
+	router, cleanup := newTestRenameRouter(t)
+	defer cleanup()
+	config := router.Config
+
+	factory := func(siteName string, cfg maps.MapSI) (*core.Site, error) {
+		return nil, fmt.Errorf("bad config")
+	}
+	if _, err := router.Rename("a", "b", factory); err == nil {
+		t.Fatal("renamed with a bad config")
+	}
+
+	if err := os.MkdirAll(config.SiteDirs("b").Root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	factory = func(siteName string, cfg maps.MapSI) (*core.Site, error) {
+		return newTestSite(siteName, cfg), nil
+	}
+	if _, err := router.Rename("a", "b", factory); err == nil || !strings.Contains(err.Error(), "exists") {
+		t.Fatalf("renamed over the data dir of other site: %v", err)
+	}
+
+	if !router.Register.Has("a") || router.Register.Has("b") {
+		t.Error("old site removed")
+	}
+	if _, ok := config.Sites["a"]; !ok {
+		t.Error("old site config removed")
+	}
+	if _, err := os.Stat(filepath.Join(config.Dir, "sites", "a.yaml")); err != nil {
+		t.Errorf("old config file: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(config.SiteDirs("a").Root, SiteDirData, "file.txt")); string(data) != "content" {
+		t.Errorf("old data file = %q", data)
+	}
+}
+
+func TestRenameDrainsBeforeMove(t *testing.T) {
+	router, cleanup := newTestRenameRouter(t)
+	defer cleanup()
+	config := router.Config
+	oldFile := filepath.Join(config.SiteDirs("a").Root, SiteDirData, "file.txt")
+
+	var drained bool
+	router.Register.OnSiteDestroy(func(site *core.Site) {
+		if site.Name() == "a" {
+			// the in flight requests of the old site write into the old dir
+			_, err := os.Stat(oldFile)
+			drained = err == nil
+		}
+	})
+	if _, err := router.Rename("a", "b", func(siteName string, cfg maps.MapSI) (*core.Site, error) {
+		return newTestSite(siteName, cfg), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !drained {
+		t.Error("the old site was removed after the data dir move")
+	}
+}
+
+func TestRenameReAddsOldSite(t *testing.T) {
+	router, cleanup := newTestRenameRouter(t)
+	defer cleanup()
+	config := router.Config
+	router.Register.AddPath("a", "shop")
+	old, _ := router.Register.ByName.Get("a")
+
+	factory := func(siteName string, cfg maps.MapSI) (*core.Site, error) {
+		if siteName == "b" {
+			// the data dir move fails
+			if err := ioutil.WriteFile(config.SiteDirs("b").Root, nil, 0644); err != nil {
+				return nil, err
+			}
+		}
+		return newTestSite(siteName, cfg), nil
+	}
+	if _, err := router.Rename("a", "b", factory); err == nil {
+		t.Fatal("renamed with a failed data dir move")
+	}
+	site, ok := router.Register.ByName.Get("a")
+	if !ok || router.Register.Has("b") {
+		t.Fatal("old site not registered again")
+	}
+	if site == old {
+		t.Error("the destroyed site registered again")
+	}
+	if paths := router.Paths.Paths("a"); len(paths) != 2 {
+		t.Errorf("old site paths = %v", paths)
+	}
+	if _, ok := config.Sites["a"]; !ok {
+		t.Error("old site config not restored")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(config.SiteDirs("a").Root, SiteDirData, "file.txt")); string(data) != "content" {
+		t.Errorf("old data file = %q", data)
+	}
+}
+
+func TestAliasRedirectKeepsPrefix(t *testing.T) {
+	router := NewSitesRouter(&core.SitesRegister{}, nil)
+	router.Prefix = "admin"
+	router.Paths.AddAlias("a", "b")
+
+	w := httptest.NewRecorder()
+	if !router.CreateHandler().Serve(w, httptest.NewRequest("GET", "/a/x?y=1", nil)) {
+		t.Fatal("alias not served")
+	}
+	if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != "/admin/b/x?y=1" {
+		t.Errorf("redirect = %d %q", w.Code, w.Header().Get("Location"))
+	}
+}
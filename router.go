@@ -3,10 +3,12 @@ package sites
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"path"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/moisespsena-go/middleware"
 
@@ -14,6 +16,8 @@ import (
 	defaultlogger "github.com/moisespsena-go/default-logger"
 	path_helpers "github.com/moisespsena-go/path-helpers"
 	"github.com/moisespsena-go/xroute"
+
+	"github.com/ecletus/sites/storage"
 )
 
 var log = defaultlogger.GetOrCreateLogger(path_helpers.GetCalledDir())
@@ -28,6 +32,22 @@ type SitesRouter struct {
 	DefaultDomain               string
 	DefaultSite                 string
 	Register                    *core.SitesRegister
+	Config                      *Config
+	TrustedProxies              *TrustedProxies
+	RateLimiter                 *RateLimiter
+	SecurityHeaders             *SecurityHeaders
+	Maintenance                 *Maintenance
+	InFlight                    *InFlight
+	DrainTimeout                time.Duration
+	Scheduler                   *Scheduler
+	Storages                    *Storages
+	Paths                       *SitePaths
+	DBPools                     *DBPools
+	Lazy                        *LazySites
+	DBLocks                     *KeyLocks
+	Isolations                  *DBIsolations
+	Registrations               *Registrations
+	Control                     *Control
 	SiteHandler                 xroute.ContextHandler
 	HandleNotFound              xroute.ContextHandler
 	HandleIndex                 xroute.ContextHandler
@@ -40,12 +60,23 @@ func NewSitesRouter(register *core.SitesRegister, contextFactory *core.ContextFa
 		Register:       register,
 		Middlewares:    xroute.NewMiddlewaresStack(PKG+".Middlewares", true),
 		HandleNotFound: xroute.HttpHandler(http.NotFoundHandler()),
+		InFlight:       &InFlight{},
+		DrainTimeout:   DefaultDrainTimeout,
+		Scheduler:      NewScheduler(),
+		Paths:          &SitePaths{},
+		DBLocks:        &KeyLocks{},
+		Isolations:     &DBIsolations{},
 	}
 	r.HandleIndex = xroute.HttpHandler(r.DefaultIndexHandler)
+	// the security headers are the first middleware, so the responses of the
+	// next ones (as the rate limit 429) have the CORS headers too
+	r.SecurityHeaders = &SecurityHeaders{}
+	r.Use(r.SecurityHeaders.Middleware())
 	return r
 }
 
 func (this *SitesRouter) Init() {
+	this.Paths.init(this.Register)
 	if !this.Register.Alone {
 		this.Register.OnPathAdd(func(site *core.Site, pth string) {
 			log.Infof("[%s] path: mounted on %s", site.Name(), path.Join("/", this.Prefix, pth))
@@ -85,6 +116,13 @@ func (this *SitesRouter) Init() {
 	this.Register.OnSiteDestroy(func(site *core.Site) {
 		log.Infof("[%s] deleted", site.Name())
 	})
+	this.Register.OnSiteDestroy(func(site *core.Site) {
+		this.Scheduler.Stop(site.Name())
+	})
+
+	this.Register.OnSiteDestroy(this.SecurityHeaders.Forget)
+	this.Register.OnSiteDestroy(this.Isolations.Forget)
+
 	this.Register.OnPostAdd(func(site *core.Site) {
 		if !this.NotMountNames {
 			this.Register.AddPath(site.Name(), site.Name())
@@ -115,24 +153,49 @@ func (this *SitesRouter) GetMiddleware(name string) *xroute.Middleware {
 	return this.Middlewares.ByName[name]
 }
 
+// GetByHost returns the site mounted on host, with or without port. Use Host(r)
+// to get the host of a request resolved through the trusted proxies.
 func (this *SitesRouter) GetByHost(host string) (site *core.Site) {
-	// host:port
-	parts := strings.SplitN(host, ":", 2)
-	if len(parts) == 1 {
-		var ok bool
-		// by host
-		if site, ok = this.Register.GetByHost(host); ok {
+	var ok bool
+	if site, ok = this.Register.GetByHost(host); ok {
+		return
+	}
+	if name := StripPort(host); name != host {
+		if site, ok = this.Register.GetByHost(name); ok {
 			return
 		}
 	}
-	return
+	return nil
+}
+
+// StripPort returns the host without port. IPv6 brackets are removed.
+func StripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.Trim(host, "[]")
+}
+
+// SiteDirs returns the data dir layout of the site.
+func (this *SitesRouter) SiteDirs(siteName string) SiteDirs {
+	return this.Config.SiteDirs(siteName)
 }
+
 func (this *SitesRouter) CreateSitesIndex() *SitesIndex {
 	return &SitesIndex{Router: this, PageTitle: "Site chooser"}
 }
 
+// SiteStorageName returns the global name of the storage of the site.
 func SiteStorageName(siteName, storageName string) string {
-	return siteName + ":" + siteName
+	return siteName + ":" + storageName
+}
+
+// Storage returns the storage of the site by name.
+func (this *SitesRouter) Storage(site *core.Site, name string) (storage.Storage, error) {
+	if this.Storages == nil {
+		return nil, fmt.Errorf("storages are not configured")
+	}
+	return this.Storages.Get(site, name)
 }
 
 type SitesIndex struct {
@@ -0,0 +1,390 @@
+package sites
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/ecletus/core"
+)
+
+// JobContext is the context of a job run.
+type JobContext struct {
+	context.Context
+	Site *core.Site
+	Job  *Job
+}
+
+// DB returns the site DB by name. Defaults to the system DB.
+func (this *JobContext) DB(name ...string) *core.DB {
+	if len(name) == 0 || name[0] == "" {
+		return this.Site.GetDB("system")
+	}
+	return this.Site.GetDB(name[0])
+}
+
+// Job is a site job. It runs on each site every Interval or on the Cron schedule.
+type Job struct {
+	Name string
+	// Interval between the runs
+	Interval time.Duration
+	// Cron standard spec (`min hour dom month dow` or descriptors as `@daily`), used if Interval is zero
+	Cron string
+	// Filter the sites where the job runs. If nil, runs on all sites.
+	Filter func(site *core.Site) bool
+	Run    func(ctx *JobContext) error
+
+	schedule cron.Schedule
+}
+
+func (this *Job) next(now time.Time) time.Time {
+	if this.Interval > 0 {
+		return now.Add(this.Interval)
+	}
+	return this.schedule.Next(now)
+}
+
+type JobStatus struct {
+	Name     string
+	Running  bool
+	LastRun  time.Time
+	LastErr  error
+	Duration time.Duration
+	NextRun  time.Time
+}
+
+// jobRun is the persisted status of the last run of a job.
+type jobRun struct {
+	LastRun  time.Time     `json:"last_run"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+type siteJob struct {
+	job    *Job
+	mu     sync.Mutex
+	status JobStatus
+}
+
+type siteJobs struct {
+	site   *core.Site
+	ctx    context.Context
+	cancel context.CancelFunc
+	jobs   map[string]*siteJob
+	wg     sync.WaitGroup
+}
+
+// Scheduler runs the jobs registered by plugins on each site. The jobs of a
+// site start after its SiteEvent, once the scheduler is enabled by the serving
+// process, and stop when the site is destroyed. One-shot processes, as the CLI
+// commands, never enable it: their jobs run only by Trigger.
+type Scheduler struct {
+	// StatusFile returns the file where the status of the site jobs is
+	// persisted, so other processes see it. If nil, it is not persisted.
+	StatusFile func(siteName string) (string, error)
+
+	mu      sync.Mutex
+	jobs    []*Job
+	sites   map[string]*siteJobs
+	enabled bool
+	fileMu  sync.Mutex
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{sites: map[string]*siteJobs{}}
+}
+
+// Enable starts the jobs of the sites already started, and of the next ones.
+func (this *Scheduler) Enable() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.enabled {
+		return
+	}
+	this.enabled = true
+	for _, s := range this.sites {
+		for _, job := range this.jobs {
+			this.startJob(s, job)
+		}
+	}
+}
+
+// Enabled reports whether the jobs are started.
+func (this *Scheduler) Enabled() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.enabled
+}
+
+// Register registers the jobs and starts them on the sites already started.
+func (this *Scheduler) Register(jobs ...*Job) (err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, job := range jobs {
+		if job.Name == "" {
+			return fmt.Errorf("job name is blank")
+		}
+		if job.Run == nil {
+			return fmt.Errorf("job %q: Run is nil", job.Name)
+		}
+		if job.Interval <= 0 {
+			if job.schedule, err = cron.ParseStandard(job.Cron); err != nil {
+				return fmt.Errorf("job %q: bad cron spec %q: %v", job.Name, job.Cron, err)
+			}
+		}
+		for _, j := range this.jobs {
+			if j.Name == job.Name {
+				return fmt.Errorf("job %q already registered", job.Name)
+			}
+		}
+		this.jobs = append(this.jobs, job)
+		if this.enabled {
+			for _, s := range this.sites {
+				this.startJob(s, job)
+			}
+		}
+	}
+	return nil
+}
+
+// OnSiteEvent starts the jobs of the site.
+func (this *Scheduler) OnSiteEvent(e *SiteEvent) {
+	this.Start(e.Site)
+}
+
+// Start starts the jobs of the site, if enabled.
+func (this *Scheduler) Start(site *core.Site) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if _, ok := this.sites[site.Name()]; ok {
+		return
+	}
+	s := &siteJobs{site: site, jobs: map[string]*siteJob{}}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	this.sites[site.Name()] = s
+	if this.enabled {
+		for _, job := range this.jobs {
+			this.startJob(s, job)
+		}
+	}
+}
+
+// Stop stops the jobs of the site and waits for the running ones.
+func (this *Scheduler) Stop(siteName string) {
+	this.mu.Lock()
+	s, ok := this.sites[siteName]
+	delete(this.sites, siteName)
+	this.mu.Unlock()
+	if ok {
+		s.cancel()
+		s.wg.Wait()
+	}
+}
+
+func (this *Scheduler) siteJob(s *siteJobs, job *Job) *siteJob {
+	sj := s.jobs[job.Name]
+	if sj == nil {
+		sj = &siteJob{job: job, status: JobStatus{Name: job.Name}}
+		s.jobs[job.Name] = sj
+	}
+	return sj
+}
+
+func (this *Scheduler) startJob(s *siteJobs, job *Job) {
+	if job.Filter != nil && !job.Filter(s.site) {
+		return
+	}
+	sj := this.siteJob(s, job)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			next := job.next(time.Now())
+			sj.mu.Lock()
+			sj.status.NextRun = next
+			sj.mu.Unlock()
+
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-s.ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+				if err := this.run(s, sj); err != nil {
+					log.Errorf("[%s] job %q failed: %v", s.site.Name(), job.Name, err)
+				}
+			}
+		}
+	}()
+}
+
+func (this *Scheduler) run(s *siteJobs, sj *siteJob) (err error) {
+	sj.mu.Lock()
+	if sj.status.Running {
+		sj.mu.Unlock()
+		return fmt.Errorf("already running")
+	}
+	sj.status.Running = true
+	sj.mu.Unlock()
+
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+		sj.mu.Lock()
+		sj.status.Running = false
+		sj.status.LastRun = start
+		sj.status.LastErr = err
+		sj.status.Duration = time.Since(start)
+		run := jobRun{LastRun: start, Duration: sj.status.Duration}
+		sj.mu.Unlock()
+		if err != nil {
+			run.Error = err.Error()
+		}
+		if perr := this.saveRun(s.site.Name(), sj.job.Name, run); perr != nil {
+			log.Errorf("[%s] job %q: save status failed: %v", s.site.Name(), sj.job.Name, perr)
+		}
+	}()
+	return sj.job.Run(&JobContext{s.ctx, s.site, sj.job})
+}
+
+// Jobs returns the status of the jobs of the site, sorted by name. The last
+// run of the jobs not run by this process is read from the status file.
+func (this *Scheduler) Jobs(site *core.Site) (status []JobStatus, err error) {
+	var runs map[string]jobRun
+	if runs, err = this.loadRuns(site.Name()); err != nil {
+		return
+	}
+	this.mu.Lock()
+	s := this.sites[site.Name()]
+	for _, job := range this.jobs {
+		if job.Filter != nil && !job.Filter(site) {
+			continue
+		}
+		var st = JobStatus{Name: job.Name}
+		if s != nil {
+			if sj, ok := s.jobs[job.Name]; ok {
+				sj.mu.Lock()
+				st = sj.status
+				sj.mu.Unlock()
+			}
+		}
+		if run, ok := runs[job.Name]; ok && run.LastRun.After(st.LastRun) {
+			st.LastRun, st.Duration, st.LastErr = run.LastRun, run.Duration, nil
+			if run.Error != "" {
+				st.LastErr = errors.New(run.Error)
+			}
+		}
+		status = append(status, st)
+	}
+	this.mu.Unlock()
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Name < status[j].Name
+	})
+	return
+}
+
+// Trigger runs the job on the site now and waits for it. The scheduler does
+// not need to be enabled.
+func (this *Scheduler) Trigger(site *core.Site, jobName string) error {
+	this.mu.Lock()
+	var job *Job
+	for _, j := range this.jobs {
+		if j.Name == jobName {
+			job = j
+			break
+		}
+	}
+	if job == nil {
+		this.mu.Unlock()
+		return fmt.Errorf("job %q does not exists", jobName)
+	}
+	s, ok := this.sites[site.Name()]
+	if !ok {
+		s = &siteJobs{site: site, jobs: map[string]*siteJob{}}
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		defer s.cancel()
+	}
+	sj := this.siteJob(s, job)
+	this.mu.Unlock()
+	return this.run(s, sj)
+}
+
+func (this *Scheduler) loadRuns(siteName string) (runs map[string]jobRun, err error) {
+	if this.StatusFile == nil {
+		return
+	}
+	var pth string
+	if pth, err = this.StatusFile(siteName); err != nil {
+		return
+	}
+	this.fileMu.Lock()
+	defer this.fileMu.Unlock()
+	return readJobRuns(pth)
+}
+
+// saveRun persists the run into the status file of the site.
+func (this *Scheduler) saveRun(siteName, jobName string, run jobRun) (err error) {
+	if this.StatusFile == nil {
+		return
+	}
+	var pth string
+	if pth, err = this.StatusFile(siteName); err != nil {
+		return
+	}
+	this.fileMu.Lock()
+	defer this.fileMu.Unlock()
+	runs, err := readJobRuns(pth)
+	if err != nil || runs == nil {
+		runs = map[string]jobRun{}
+	}
+	runs[jobName] = run
+
+	var data []byte
+	if data, err = json.MarshalIndent(runs, "", "  "); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return
+	}
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Dir(pth), filepath.Base(pth)+".*.tmp"); err != nil {
+		return
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), pth)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return
+}
+
+func readJobRuns(pth string) (runs map[string]jobRun, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(pth); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(data, &runs); err != nil {
+		return nil, fmt.Errorf("decode %q: %v", pth, err)
+	}
+	return
+}
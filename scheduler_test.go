@@ -0,0 +1,80 @@
+package sites
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSchedulerRunsOnlyWhenEnabled(t *testing.T) {
+	var (
+		scheduler = NewScheduler()
+		site      = newTestSite("a", nil)
+		runs      = make(chan struct{}, 10)
+	)
+	if err := scheduler.Register(&Job{Name: "tick", Interval: time.Millisecond, Run: func(ctx *JobContext) error {
+		runs <- struct{}{}
+		return nil
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start(site)
+	defer scheduler.Stop(site.Name())
+
+	select {
+	case <-runs:
+		t.Fatal("job ran before the scheduler was enabled")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	scheduler.Enable()
+	select {
+	case <-runs:
+	case <-time.After(time.Second):
+		t.Fatal("job did not run after the scheduler was enabled")
+	}
+}
+
+func TestSchedulerPersistsRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newScheduler := func() *Scheduler {
+		scheduler := NewScheduler()
+		scheduler.StatusFile = func(siteName string) (string, error) {
+			return filepath.Join(dir, siteName, "jobs.json"), nil
+		}
+		if err := scheduler.Register(&Job{Name: "fail", Cron: "@daily", Run: func(ctx *JobContext) error {
+			return errors.New("boom")
+		}}); err != nil {
+			t.Fatal(err)
+		}
+		return scheduler
+	}
+
+	site := newTestSite("a", nil)
+	if err = newScheduler().Trigger(site, "fail"); err == nil || err.Error() != "boom" {
+		t.Fatalf("Trigger err = %v", err)
+	}
+	if err = newScheduler().Trigger(site, "missing"); err == nil {
+		t.Fatal("expected missing job error")
+	}
+
+	// other process
+	status, err := newScheduler().Jobs(site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 1 || status[0].Name != "fail" {
+		t.Fatalf("status = %+v", status)
+	}
+	if status[0].LastRun.IsZero() || status[0].LastErr == nil || status[0].LastErr.Error() != "boom" {
+		t.Fatalf("persisted status not loaded: %+v", status[0])
+	}
+}
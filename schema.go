@@ -0,0 +1,249 @@
+package sites
+
+import (
+	"github.com/mitchellh/mapstructure"
+	"github.com/moisespsena-go/maps"
+
+	"github.com/ecletus/sites/dir_config"
+	"github.com/ecletus/sites/dir_config/schema"
+)
+
+var (
+	stringArray = schema.ArrayOf(schema.New(schema.String))
+
+	// SiteSchema is the schema of each site config, merged over the site template.
+	// Plugins contribute the schema of their keys with SiteSchema.Set.
+	SiteSchema = schema.NewObject(map[string]*schema.Schema{
+		TemplateKey: schema.New(schema.String),
+		"db": schema.MapOf(strictObject(map[string]*schema.Schema{
+			"adapter":  schema.New(schema.String),
+			"name":     schema.New(schema.String),
+			"host":     schema.New(schema.String),
+			"port":     schema.New(schema.Integer),
+			"user":     schema.New(schema.String),
+			"password": schema.New(schema.String),
+		})),
+		RateLimitConfigKey: strictObject(map[string]*schema.Schema{
+			"site":   rateLimitSchema(),
+			"client": rateLimitSchema(),
+			"paths": schema.ArrayOf(func() *schema.Schema {
+				s := rateLimitSchema()
+				s.Properties["pattern"] = schema.New(schema.String)
+				s.Properties["per_client"] = schema.New(schema.Boolean)
+				s.Required = []string{"pattern", "rate"}
+				return s
+			}()),
+		}),
+		SecurityConfigKey: strictObject(map[string]*schema.Schema{
+			"cors": func() *schema.Schema {
+				s := strictObject(map[string]*schema.Schema{
+					"allowed_origins":   stringArray,
+					"allowed_methods":   stringArray,
+					"allowed_headers":   stringArray,
+					"exposed_headers":   stringArray,
+					"allow_credentials": schema.New(schema.Boolean),
+					"max_age":           schema.New(schema.Integer),
+				})
+				s.Check = checkCORS
+				return s
+			}(),
+			"hsts": strictObject(map[string]*schema.Schema{
+				"max_age":             schema.New(schema.Integer),
+				"include_sub_domains": schema.New(schema.Boolean),
+				"preload":             schema.New(schema.Boolean),
+			}),
+			"frame_options":           schema.New(schema.String),
+			"referrer_policy":         schema.New(schema.String),
+			"content_security_policy": schema.New(schema.String),
+			"content_type_nosniff":    schema.New(schema.Boolean),
+		}),
+		DBPoolConfigKey: strictObject(map[string]*schema.Schema{
+			"limit": schema.New(schema.Integer),
+		}),
+		IsolationConfigKey: strictObject(map[string]*schema.Schema{
+			"strategy": {Type: schema.String, Enum: []interface{}{IsolationSchema, IsolationTablePrefix}},
+			"name":     schema.New(schema.String),
+			"dbs":      stringArray,
+		}),
+		StoragesConfigKey: schema.MapOf(schema.NewObject(map[string]*schema.Schema{
+			"type":       schema.New(schema.String),
+			"path":       schema.New(schema.String),
+			"endpoint":   schema.New(schema.String),
+			"bucket":     schema.New(schema.String),
+			"region":     schema.New(schema.String),
+			"access_key": schema.New(schema.String),
+			"secret_key": schema.New(schema.String),
+			"use_ssl":    schema.New(schema.Boolean),
+			"prefix":     schema.New(schema.String),
+		})),
+		AuthConfigKey: strictObject(map[string]*schema.Schema{
+			"user_registration":   schema.New(schema.Boolean),
+			"social_auth_enabled": schema.New(schema.Boolean),
+			"social_auth": strictObject(map[string]*schema.Schema{
+				"github": oauth2ProviderSchema(false),
+				"google": oauth2ProviderSchema(true),
+				"oidc":   schema.MapOf(oauth2ProviderSchema(true)),
+			}),
+			"registration": strictObject(map[string]*schema.Schema{
+				"mode": {Type: schema.String, Enum: []interface{}{
+					RegistrationClosed, RegistrationOpen, RegistrationInvite, RegistrationDomain, RegistrationApproval,
+				}},
+				"allowed_domains": stringArray,
+				"paths":           stringArray,
+			}),
+		}),
+	})
+
+	// ConfigSchema is the schema of the sites config. The sites are validated
+	// with SiteSchema. Plugins contribute the schema of their keys with ConfigSchema.Set.
+	ConfigSchema = schema.NewObject(map[string]*schema.Schema{
+		ConfigVersionKey:      schema.New(schema.Integer),
+		"default_site":        schema.New(schema.String),
+		"alone":               schema.New(schema.Boolean),
+		"prefix":              schema.New(schema.String),
+		"data_dir":            schema.New(schema.String),
+		"singular_table_name": schema.New(schema.Boolean),
+		"index_handler_plugin": {
+			Type:     schema.Object,
+			Required: []string{"path"},
+			Properties: map[string]*schema.Schema{
+				"path":   schema.New(schema.String),
+				"config": schema.New(schema.Object),
+			},
+		},
+		"index_dir":                        schema.New(schema.String),
+		"redirect_site_not_found_to_index": schema.New(schema.Boolean),
+		"log_path":                         schema.New(schema.String),
+		// the templates are partial: the required properties are checked on the sites
+		"site_template":   schema.PartialOf(SiteSchema),
+		TemplatesKey:      schema.MapOf(schema.PartialOf(SiteSchema)),
+		"sites":           schema.MapOf(schema.New(schema.Object)),
+		"trusted_proxies": stringArray,
+		"tls": strictObject(map[string]*schema.Schema{
+			"certs_dir": schema.New(schema.String),
+			"acme": strictObject(map[string]*schema.Schema{
+				"directory_url": schema.New(schema.String),
+				"email":         schema.New(schema.String),
+				"ca_roots":      schema.New(schema.String),
+			}),
+		}),
+		"rate_limit": schema.New(schema.Boolean),
+		"maintenance": strictObject(map[string]*schema.Schema{
+			"retry_after": schema.New(schema.Integer),
+			"allow":       stringArray,
+			"page":        schema.New(schema.String),
+		}),
+		"drain_timeout":   schema.New(schema.Integer),
+		"lazy_init":       schema.New(schema.Boolean),
+		"idle_timeout":    schema.New(schema.Integer),
+		"startup_workers": schema.New(schema.Integer),
+		"db_pools": strictObject(map[string]*schema.Schema{
+			"enabled":    schema.New(schema.Boolean),
+			"max_open":   schema.New(schema.Integer),
+			"max_idle":   schema.New(schema.Integer),
+			"site_limit": schema.New(schema.Integer),
+		}),
+		dir_config.VarsKey: schema.New(schema.Object),
+		"secrets": {
+			Type:       schema.Object,
+			Required:   []string{"provider"},
+			Properties: map[string]*schema.Schema{"provider": schema.New(schema.String)},
+			// the options of the provider
+			AdditionalProperties: schema.New(schema.Any),
+		},
+	})
+)
+
+// strictObject returns a object schema that rejects unknown properties. The
+// top level schemas only warn them, as plugins can add keys without schema.
+func strictObject(properties map[string]*schema.Schema) *schema.Schema {
+	s := schema.NewObject(properties)
+	s.Strict = true
+	return s
+}
+
+func rateLimitSchema() *schema.Schema {
+	return strictObject(map[string]*schema.Schema{
+		"rate":  schema.New(schema.Number),
+		"burst": schema.New(schema.Integer),
+	})
+}
+
+func checkCORS(value interface{}) error {
+	var cors CORSConfig
+	if err := mapstructure.Decode(value, &cors); err != nil {
+		return nil
+	}
+	return cors.Validate()
+}
+
+func oauth2ProviderSchema(oidc bool) *schema.Schema {
+	s := strictObject(map[string]*schema.Schema{
+		"name":          schema.New(schema.String),
+		"client_id":     schema.New(schema.String),
+		"client_secret": schema.New(schema.String),
+		"scopes":        stringArray,
+		"auth_url":      schema.New(schema.String),
+		"token_url":     schema.New(schema.String),
+		"user_info_url": schema.New(schema.String),
+		"redirect_path": schema.New(schema.String),
+	})
+	s.Required = []string{"client_id", "client_secret"}
+	if oidc {
+		s.Properties["issuer"] = schema.New(schema.String)
+	}
+	return s
+}
+
+func siteLocator(config *Config, siteName string) dir_config.Locator {
+	if config.Sources == nil {
+		return nil
+	}
+	locators := dir_config.Locators{config.Sources.Sub("sites", siteName)}
+	chain, _ := config.TemplateChain(siteName)
+	for i := len(chain) - 1; i >= 0; i-- {
+		locators = append(locators, config.Sources.Sub(TemplatesKey, chain[i]))
+	}
+	return append(locators, config.Sources.Sub("site_template"))
+}
+
+func validateSite(config *Config, siteName string, raw maps.MapSI) (errs schema.Errors) {
+	errs = SiteSchema.Validate(raw, siteLocator(config, siteName))
+	for _, err := range errs {
+		err.Path = append([]string{"sites", siteName}, err.Path...)
+	}
+	return
+}
+
+// ValidateSite validates the site raw config merged over the site template.
+func ValidateSite(config *Config, siteName string, raw maps.MapSI) error {
+	return validateSite(config, siteName, raw).Err()
+}
+
+// ValidateConfig validates the sites config and the config of each site.
+func ValidateConfig(config *Config) error {
+	var locator dir_config.Locator
+	if config.Sources != nil {
+		locator = config.Sources
+	}
+	errs := ConfigSchema.Validate(config.Raw, locator)
+	for _, siteName := range config.SiteNames() {
+		if err := ValidateSiteName(siteName); err != nil {
+			path := []string{"sites", siteName}
+			errs = append(errs, &schema.Error{Path: path, Message: err.Error()})
+			if locator != nil {
+				errs[len(errs)-1].Location, _ = locator.Locate(path)
+			}
+			continue
+		}
+		raw, err := config.MergeSiteConfig(siteName)
+		if err != nil {
+			return err
+		}
+		errs = append(errs, validateSite(config, siteName, raw)...)
+	}
+	for _, warning := range errs.Warnings() {
+		log.Warningf("config: %v", warning)
+	}
+	return errs.Err()
+}
@@ -0,0 +1,157 @@
+package secrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/moisespsena-go/maps"
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	Register("file", func(dir string, options maps.MapSI) (Provider, error) {
+		path, _ := options["path"].(string)
+		keyFile, _ := options["key_file"].(string)
+		if path == "" || keyFile == "" {
+			return nil, fmt.Errorf("`path` and `key_file` options are required")
+		}
+		return NewFileProvider(relativeTo(dir, path), relativeTo(dir, keyFile))
+	})
+}
+
+// FileProvider reads the secrets of a local YAML file, mapping each secret
+// path to its value encrypted with AES-256-GCM and base64 encoded.
+type FileProvider struct {
+	Path string
+
+	mu     sync.RWMutex
+	aead   cipher.AEAD
+	values map[string]string
+}
+
+// NewFileProvider creates a provider of the file path, decrypting with the key
+// of keyFile: 32 bytes raw, hex or base64 encoded.
+func NewFileProvider(path, keyFile string) (*FileProvider, error) {
+	key, err := ReadKeyFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileProviderKey(path, key)
+}
+
+func NewFileProviderKey(path string, key []byte) (p *FileProvider, err error) {
+	p = &FileProvider{Path: path, values: map[string]string{}}
+	var block cipher.Block
+	if block, err = aes.NewCipher(key); err != nil {
+		return
+	}
+	if p.aead, err = cipher.NewGCM(block); err != nil {
+		return
+	}
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, err
+	}
+	if err = yaml.Unmarshal(data, &p.values); err != nil {
+		return nil, fmt.Errorf("parse %q: %v", path, err)
+	}
+	return
+}
+
+// relativeTo returns pth joined to dir, if relative.
+func relativeTo(dir, pth string) string {
+	if dir == "" || filepath.IsAbs(pth) {
+		return pth
+	}
+	return filepath.Join(dir, pth)
+}
+
+// ReadKeyFile reads the 32 bytes key of the file.
+func ReadKeyFile(pth string) (key []byte, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(pth); err != nil {
+		return
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	s := strings.TrimSpace(string(data))
+	if key, err = hex.DecodeString(s); err == nil && len(key) == 32 {
+		return
+	}
+	if key, err = base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return
+	}
+	return nil, fmt.Errorf("key file %q: expected 32 bytes key, raw, hex or base64 encoded", pth)
+}
+
+func (this *FileProvider) Get(ctx context.Context, path string) (string, error) {
+	this.mu.RLock()
+	encrypted, ok := this.values[path]
+	this.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("not found")
+	}
+	return this.Decrypt(encrypted)
+}
+
+// Set encrypts and sets the value of path. Call Save to persist it.
+func (this *FileProvider) Set(path, value string) (err error) {
+	var encrypted string
+	if encrypted, err = this.Encrypt(value); err != nil {
+		return
+	}
+	this.mu.Lock()
+	this.values[path] = encrypted
+	this.mu.Unlock()
+	return
+}
+
+// Save writes the secrets file.
+func (this *FileProvider) Save() error {
+	this.mu.RLock()
+	data, err := yaml.Marshal(this.values)
+	this.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(this.Path, data, 0600)
+}
+
+func (this *FileProvider) Encrypt(value string) (string, error) {
+	nonce := make([]byte, this.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(this.aead.Seal(nonce, nonce, []byte(value), nil)), nil
+}
+
+func (this *FileProvider) Decrypt(encrypted string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < this.aead.NonceSize() {
+		return "", fmt.Errorf("bad encrypted value")
+	}
+	nonce, data := data[:this.aead.NonceSize()], data[this.aead.NonceSize():]
+	plain, err := this.aead.Open(nil, nonce, data, nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypt failed: %v", err)
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,86 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/moisespsena-go/maps"
+)
+
+func init() {
+	Register("http", func(dir string, options maps.MapSI) (Provider, error) {
+		p := &HTTPProvider{}
+		p.URL, _ = options["url"].(string)
+		p.Token, _ = options["token"].(string)
+		if p.URL == "" {
+			return nil, fmt.Errorf("`url` option is required")
+		}
+		return p, nil
+	})
+}
+
+// HTTPProvider gets the secrets of a HTTP key-value store, with `GET URL/PATH`.
+// The response body is the value, or a JSON object with the `value` key.
+type HTTPProvider struct {
+	URL string
+	// Token sent as bearer authorization
+	Token  string
+	Client *http.Client
+}
+
+func (this *HTTPProvider) Get(ctx context.Context, path string) (value string, err error) {
+	var parts = strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodGet, strings.TrimSuffix(this.URL, "/")+"/"+strings.Join(parts, "/"), nil); err != nil {
+		return
+	}
+	if this.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+this.Token)
+	}
+	client := this.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	var res *http.Response
+	if res, err = client.Do(req.WithContext(ctx)); err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	var body []byte
+	if body, err = ioutil.ReadAll(res.Body); err != nil {
+		return
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", fmt.Errorf("not found")
+	default:
+		return "", fmt.Errorf("GET %s: %s", req.URL.Path, res.Status)
+	}
+
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		var data struct {
+			Value *string `json:"value"`
+		}
+		if err = json.Unmarshal(body, &data); err != nil {
+			return
+		}
+		if data.Value == nil {
+			return "", fmt.Errorf("JSON response without the `value` key")
+		}
+		return *data.Value, nil
+	}
+	return strings.TrimSuffix(string(body), "\n"), nil
+}
@@ -0,0 +1,133 @@
+// Package secrets resolves the secret references of the configs, as the YAML
+// value `!secret db/shop/password`, from pluggable backends.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/moisespsena-go/maps"
+)
+
+// Tag is the YAML tag of the secret references.
+const Tag = "!secret"
+
+// Ref returns the string form of the reference to the secret path.
+func Ref(path string) string {
+	return Tag + " " + path
+}
+
+// ParseRef returns the path of the secret reference s.
+func ParseRef(s string) (path string, ok bool) {
+	if !strings.HasPrefix(s, Tag+" ") {
+		return
+	}
+	return strings.TrimSpace(s[len(Tag)+1:]), true
+}
+
+// Provider gets the secret values.
+type Provider interface {
+	Get(ctx context.Context, path string) (value string, err error)
+}
+
+// Setter is a provider that stores the secret values, encrypted.
+type Setter interface {
+	Provider
+	// Set sets the value of path. Call Save to persist it.
+	Set(path, value string) error
+	Save() error
+}
+
+// Config is the `secrets` key of the sites config.
+type Config struct {
+	// Provider name. The builtin providers are `file` and `http`.
+	Provider string     `mapstructure:"provider"`
+	Options  maps.MapSI `mapstructure:",remain"`
+	// Dir the config directory, the base of the relative paths of the options
+	Dir string `mapstructure:"-"`
+}
+
+// Factory creates a provider with the options. dir is the base of the
+// relative paths of the options.
+type Factory func(dir string, options maps.MapSI) (Provider, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{}
+)
+
+// Register registers the provider factory by name.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[name] = factory
+}
+
+// New creates the provider of the config.
+func New(config *Config) (Provider, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[config.Provider]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("secrets provider %q is not registered", config.Provider)
+	}
+	provider, err := factory(config.Dir, config.Options)
+	if err != nil {
+		return nil, fmt.Errorf("secrets provider %q: %v", config.Provider, err)
+	}
+	return provider, nil
+}
+
+// HasRefs returns if value has secret references.
+func HasRefs(value interface{}) bool {
+	switch t := value.(type) {
+	case string:
+		_, ok := ParseRef(t)
+		return ok
+	case maps.MapSI:
+		for _, v := range t {
+			if HasRefs(v) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, v := range t {
+			if HasRefs(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Resolve replaces recursively the secret references of value by their values.
+func Resolve(ctx context.Context, provider Provider, value interface{}) (_ interface{}, err error) {
+	switch t := value.(type) {
+	case string:
+		if pth, ok := ParseRef(t); ok {
+			if provider == nil {
+				return nil, fmt.Errorf("secret %q: no secrets provider configured", pth)
+			}
+			var v string
+			if v, err = provider.Get(ctx, pth); err != nil {
+				return nil, fmt.Errorf("secret %q: %v", pth, err)
+			}
+			return v, nil
+		}
+	case maps.MapSI:
+		for key, v := range t {
+			if t[key], err = Resolve(ctx, provider, v); err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	case []interface{}:
+		for i, v := range t {
+			if t[i], err = Resolve(ctx, provider, v); err != nil {
+				return nil, fmt.Errorf("%d: %v", i, err)
+			}
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,65 @@
+package secrets
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/moisespsena-go/maps"
+)
+
+func TestFileProviderRelativePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "key"), []byte(strings.Repeat("k", 32)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{Provider: "file", Dir: dir, Options: maps.MapSI{"path": "secrets.yaml", "key_file": "key"}}
+	provider, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setter := provider.(Setter)
+	if err = setter.Set("db/password", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	if err = setter.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "secrets.yaml")); err != nil {
+		t.Fatalf("secrets file not saved in the config dir: %v", err)
+	}
+
+	if provider, err = New(config); err != nil {
+		t.Fatal(err)
+	}
+	cfg := maps.MapSI{"db": maps.MapSI{"password": Ref("db/password"), "user": "app"}}
+	if !HasRefs(cfg) {
+		t.Fatal("expected refs")
+	}
+	if _, err = Resolve(context.Background(), provider, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg["db"].(maps.MapSI)["password"]; got != "s3cret" {
+		t.Errorf("password = %v", got)
+	}
+	if HasRefs(cfg) {
+		t.Error("refs left after resolve")
+	}
+}
+
+func TestResolveWithoutProvider(t *testing.T) {
+	if _, err := Resolve(context.Background(), nil, []interface{}{"x"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Resolve(context.Background(), nil, []interface{}{Ref("a")}); err == nil {
+		t.Fatal("expected no provider error")
+	}
+}
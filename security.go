@@ -0,0 +1,215 @@
+package sites
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/moisespsena-go/xroute"
+
+	"github.com/ecletus/core"
+)
+
+const SecurityConfigKey = "security"
+
+type CORSConfig struct {
+	// AllowedOrigins exact origins, `*` or wildcard subdomains as `https://*.example.com`
+	AllowedOrigins   []string `mapstructure:"allowed_origins"`
+	AllowedMethods   []string `mapstructure:"allowed_methods"`
+	AllowedHeaders   []string `mapstructure:"allowed_headers"`
+	ExposedHeaders   []string `mapstructure:"exposed_headers"`
+	AllowCredentials bool     `mapstructure:"allow_credentials"`
+	// MaxAge of the preflight response in seconds
+	MaxAge int `mapstructure:"max_age"`
+}
+
+// AllowOrigin reports whether the origin is allowed.
+func (this *CORSConfig) AllowOrigin(origin string) bool {
+	allowed, _ := this.MatchOrigin(origin)
+	return allowed
+}
+
+// MatchOrigin reports whether the origin is allowed, and whether it is allowed
+// only by the bare `*`, that is answered with a literal `*`.
+func (this *CORSConfig) MatchOrigin(origin string) (allowed, any bool) {
+	for _, allowed := range this.AllowedOrigins {
+		if allowed == "*" {
+			any = true
+			continue
+		}
+		if allowed == origin {
+			return true, false
+		}
+		if pos := strings.Index(allowed, "*."); pos >= 0 {
+			if strings.HasPrefix(origin, allowed[:pos]) && strings.HasSuffix(origin, allowed[pos+1:]) {
+				return true, false
+			}
+		}
+	}
+	return any, any
+}
+
+// Validate rejects the bare `*` origin with credentials, that allows any
+// website to make credentialed reads.
+func (this *CORSConfig) Validate() error {
+	if !this.AllowCredentials {
+		return nil
+	}
+	for _, allowed := range this.AllowedOrigins {
+		if allowed == "*" {
+			return fmt.Errorf("allowed origin `*` can not be used with allow_credentials")
+		}
+	}
+	return nil
+}
+
+type HSTSConfig struct {
+	// MaxAge in seconds
+	MaxAge            int  `mapstructure:"max_age"`
+	IncludeSubDomains bool `mapstructure:"include_sub_domains"`
+	Preload           bool `mapstructure:"preload"`
+}
+
+func (this *HSTSConfig) String() string {
+	v := "max-age=" + strconv.Itoa(this.MaxAge)
+	if this.IncludeSubDomains {
+		v += "; includeSubDomains"
+	}
+	if this.Preload {
+		v += "; preload"
+	}
+	return v
+}
+
+// SecurityConfig is the `security` key of the site config. The site template
+// values are the defaults, each site overrides them on its own config.
+type SecurityConfig struct {
+	CORS                  *CORSConfig `mapstructure:"cors"`
+	HSTS                  *HSTSConfig `mapstructure:"hsts"`
+	FrameOptions          string      `mapstructure:"frame_options"`
+	ReferrerPolicy        string      `mapstructure:"referrer_policy"`
+	ContentSecurityPolicy string      `mapstructure:"content_security_policy"`
+	ContentTypeNosniff    bool        `mapstructure:"content_type_nosniff"`
+}
+
+// Apply writes the headers into w. Returns true if the request was a CORS
+// preflight and was answered.
+func (this *SecurityConfig) Apply(w http.ResponseWriter, r *http.Request) (done bool) {
+	h := w.Header()
+	if this.HSTS != nil && Scheme(r) == "https" {
+		h.Set("Strict-Transport-Security", this.HSTS.String())
+	}
+	if this.FrameOptions != "" {
+		h.Set("X-Frame-Options", this.FrameOptions)
+	}
+	if this.ReferrerPolicy != "" {
+		h.Set("Referrer-Policy", this.ReferrerPolicy)
+	}
+	if this.ContentSecurityPolicy != "" {
+		h.Set("Content-Security-Policy", this.ContentSecurityPolicy)
+	}
+	if this.ContentTypeNosniff {
+		h.Set("X-Content-Type-Options", "nosniff")
+	}
+	if this.CORS != nil {
+		return this.applyCORS(w, r)
+	}
+	return
+}
+
+func (this *SecurityConfig) applyCORS(w http.ResponseWriter, r *http.Request) (done bool) {
+	var (
+		cors   = this.CORS
+		h      = w.Header()
+		origin = r.Header.Get("Origin")
+	)
+	h.Add("Vary", "Origin")
+	if origin == "" {
+		return
+	}
+	allowed, any := cors.MatchOrigin(origin)
+	if !allowed {
+		return
+	}
+	if any {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		if cors.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		if len(cors.ExposedHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(cors.ExposedHeaders, ", "))
+		}
+		return
+	}
+
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	if len(cors.AllowedMethods) > 0 {
+		h.Set("Access-Control-Allow-Methods", strings.Join(cors.AllowedMethods, ", "))
+	} else {
+		h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST")
+	}
+	if len(cors.AllowedHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+	} else if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", reqHeaders)
+	}
+	if cors.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// SecurityHeaders applies the security config of each site.
+type SecurityHeaders struct {
+	sites sync.Map
+}
+
+func (this *SecurityHeaders) Config(site *core.Site) *SecurityConfig {
+	if v, ok := this.sites.Load(site.Name()); ok {
+		return v.(*SecurityConfig)
+	}
+	cfg := &SecurityConfig{}
+	ok, err := DecodeSiteConfig(site, SecurityConfigKey, cfg)
+	if err != nil {
+		log.Errorf("[%s] decode security config failed: %v", site.Name(), err)
+		cfg = nil
+	} else if !ok {
+		cfg = nil
+	} else if cfg.CORS != nil {
+		if err = cfg.CORS.Validate(); err != nil {
+			log.Errorf("[%s] CORS disabled: %v", site.Name(), err)
+			cfg.CORS = nil
+		}
+	}
+	v, _ := this.sites.LoadOrStore(site.Name(), cfg)
+	return v.(*SecurityConfig)
+}
+
+// Forget drops the cached config of the site.
+func (this *SecurityHeaders) Forget(site *core.Site) {
+	this.sites.Delete(site.Name())
+}
+
+func (this *SecurityHeaders) Middleware() *xroute.Middleware {
+	md := xroute.NewMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if site := RequestSite(r); site != nil {
+				if cfg := this.Config(site); cfg != nil && cfg.Apply(w, r) {
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	md.Name = PKG + ".SecurityHeaders"
+	return md
+}
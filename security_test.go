@@ -0,0 +1,76 @@
+package sites
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSMatchOrigin(t *testing.T) {
+	cors := &CORSConfig{AllowedOrigins: []string{"https://app.example.com", "https://*.example.org"}}
+	for origin, want := range map[string]bool{
+		"https://app.example.com": true,
+		"https://a.example.org":   true,
+		"https://example.org":     false,
+		"https://evil.com":        false,
+	} {
+		if allowed, any := cors.MatchOrigin(origin); allowed != want || any {
+			t.Errorf("MatchOrigin(%q) = %v, %v", origin, allowed, any)
+		}
+	}
+
+	cors.AllowedOrigins = append(cors.AllowedOrigins, "*")
+	if allowed, any := cors.MatchOrigin("https://evil.com"); !allowed || !any {
+		t.Errorf("`*`: got %v, %v", allowed, any)
+	}
+	if allowed, any := cors.MatchOrigin("https://app.example.com"); !allowed || any {
+		t.Errorf("explicit origin with `*`: got %v, %v", allowed, any)
+	}
+}
+
+func TestCORSAnyOriginWithoutCredentials(t *testing.T) {
+	cfg := &SecurityConfig{CORS: &CORSConfig{AllowedOrigins: []string{"*"}}}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Origin", "https://evil.com")
+	w := httptest.NewRecorder()
+	cfg.Apply(w, r)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want *", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want none", got)
+	}
+
+	cfg.CORS.AllowCredentials = true
+	if err := cfg.CORS.Validate(); err == nil {
+		t.Error("expected `*` with credentials rejected")
+	}
+	if err := checkCORS(map[string]interface{}{
+		"allowed_origins":   []interface{}{"*"},
+		"allow_credentials": true,
+	}); err == nil {
+		t.Error("expected schema check to reject `*` with credentials")
+	}
+}
+
+func TestCORSCredentialsReflectOrigin(t *testing.T) {
+	cfg := &SecurityConfig{CORS: &CORSConfig{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowCredentials: true,
+	}}
+	r := httptest.NewRequest("OPTIONS", "/", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", "PUT")
+	w := httptest.NewRecorder()
+	if !cfg.Apply(w, r) {
+		t.Fatal("expected preflight answered")
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q", got)
+	}
+	if w.Code != 204 {
+		t.Errorf("code = %d, want 204", w.Code)
+	}
+}
@@ -0,0 +1,47 @@
+package sites
+
+import (
+	"net/http"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/moisespsena-go/maps"
+	"github.com/moisespsena-go/xroute"
+
+	"github.com/ecletus/core"
+)
+
+// SiteRawConfig returns the raw config of site, merged over the site template.
+func SiteRawConfig(site *core.Site) maps.MapSI {
+	return site.Config().Raw
+}
+
+// DecodeSiteConfig decodes the value of key from the site raw config into dst.
+// Returns false if the key is not defined.
+func DecodeSiteConfig(site *core.Site, key string, dst interface{}) (ok bool, err error) {
+	return DecodeConfigKey(SiteRawConfig(site), key, dst)
+}
+
+// DecodeConfigKey decodes the value of key from raw into dst.
+// Returns false if the key is not defined.
+func DecodeConfigKey(raw maps.MapSI, key string, dst interface{}) (ok bool, err error) {
+	var value interface{}
+	if value, ok = raw[key]; !ok || value == nil {
+		return false, nil
+	}
+	var decoder *mapstructure.Decoder
+	if decoder, err = mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		WeaklyTypedInput: true,
+		Result:           dst,
+	}); err != nil {
+		return
+	}
+	return true, decoder.Decode(value)
+}
+
+// RequestSite returns the site serving the request, or nil.
+func RequestSite(r *http.Request) *core.Site {
+	_, rctx := xroute.GetOrNewRouteContextForRequest(r)
+	site, _ := rctx.Data[PKG+".site"].(*core.Site)
+	return site
+}
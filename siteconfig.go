@@ -0,0 +1,177 @@
+package sites
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/moisespsena-go/maps"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ecletus/sites/dir_config"
+	"github.com/ecletus/sites/secrets"
+)
+
+// SiteConfigFile returns the file of the site config written by AddSiteConfig.
+func (this *Config) SiteConfigFile(siteName string) string {
+	return filepath.Join(this.Dir, "sites", siteName+".yaml")
+}
+
+// AddSiteConfig adds the raw config of the new site to Sites and writes it to
+// SiteConfigFile, if the config was loaded from a directory. Returns the func
+// that undoes it.
+func (this *Config) AddSiteConfig(siteName string, raw maps.MapSI) (undo func(), err error) {
+	if err = ValidateSiteName(siteName); err != nil {
+		return
+	}
+	if _, ok := this.Sites[siteName]; ok {
+		return nil, fmt.Errorf("site %q: config exists", siteName)
+	}
+	var pth string
+	if this.Dir == "" {
+		log.Warningf("[%s] config not saved: the config dir is unknown", siteName)
+	} else {
+		pth = this.SiteConfigFile(siteName)
+		if err = writeConfigFile(pth, raw); err != nil {
+			return nil, fmt.Errorf("site %q: save config: %v", siteName, err)
+		}
+	}
+	if this.Sites == nil {
+		this.Sites = maps.MapSI{}
+	}
+	this.Sites[siteName] = raw
+	return func() {
+		delete(this.Sites, siteName)
+		if pth != "" {
+			os.Remove(pth)
+		}
+	}, nil
+}
+
+// writeConfigFile writes the new YAML file pth with cfg, tagging the secret
+// references. Returns error if the file exists.
+func writeConfigFile(pth string, cfg maps.MapSI) (err error) {
+	var node yaml.Node
+	if err = node.Encode(map[string]interface{}(cfg)); err != nil {
+		return
+	}
+	tagSecretRefs(&node)
+	var data []byte
+	if data, err = yaml.Marshal(&node); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return
+	}
+	if _, err = os.Stat(pth); err == nil {
+		return fmt.Errorf("file %q exists", pth)
+	}
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Dir(pth), "."+filepath.Base(pth)+".*.tmp"); err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	// the link fails if pth was created meanwhile
+	return os.Link(f.Name(), pth)
+}
+
+// tagSecretRefs writes the secret references strings as `!secret PATH`.
+func tagSecretRefs(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!str" {
+		if pth, ok := secrets.ParseRef(node.Value); ok {
+			node.Tag, node.Value, node.Style = secrets.Tag, pth, 0
+		}
+		return
+	}
+	for _, child := range node.Content {
+		tagSecretRefs(child)
+	}
+}
+
+// RenameSiteConfig renames the site entry of Sites and of the config files, if
+// the config was loaded from a directory. The values of pins, by dotted key
+// path of the entry (as db.default.name), are set into the entry, if it does
+// not set them, to keep the values derived from the old name, as the DB names.
+// Returns the func that undoes it.
+func (this *Config) RenameSiteConfig(oldName, newName string, pins map[string]string) (undo func(), err error) {
+	if err = ValidateSiteName(newName); err != nil {
+		return
+	}
+	raw, ok := this.Sites[oldName].(maps.MapSI)
+	if !ok {
+		return nil, fmt.Errorf("site %q: config does not exists", oldName)
+	}
+	if _, ok = this.Sites[newName]; ok {
+		return nil, fmt.Errorf("site %q: config exists", newName)
+	}
+	var (
+		renamed = maps.MapSI{}
+		save    = this.loader != nil && this.Dir != ""
+		undos   []func()
+		keys    []string
+	)
+	rollback := func() {
+		for i := len(undos) - 1; i >= 0; i-- {
+			undos[i]()
+		}
+	}
+	defer func() {
+		if err != nil {
+			rollback()
+		}
+	}()
+	if err = raw.DeepCopy(renamed); err != nil {
+		return
+	}
+	if save {
+		var u func()
+		if u, err = this.loader.RenameFilesKey(this.Dir, []string{"sites", oldName}, newName); err != nil {
+			return nil, fmt.Errorf("site %q: rename config: %v", oldName, err)
+		}
+		undos = append(undos, u)
+	} else {
+		log.Warningf("[%s] config not renamed: the config dir is unknown", oldName)
+	}
+	for key := range pins {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		path := strings.Split(key, ".")
+		if lookup(renamed, path) == pins[key] {
+			continue
+		}
+		var changes dir_config.Changes
+		changes.Set(renamed, dir_config.KeyPath(path...), pins[key])
+		if save {
+			var u func()
+			if u, err = this.loader.SetFilesKey(this.Dir, append([]string{"sites", newName}, path...), pins[key]); err != nil {
+				return nil, fmt.Errorf("site %q: pin %s: %v", newName, key, err)
+			}
+			undos = append(undos, u)
+		}
+	}
+	delete(this.Sites, oldName)
+	this.Sites[newName] = renamed
+	if this.Sources != nil {
+		this.Sources.Move([]string{"sites", oldName}, []string{"sites", newName})
+	}
+	undos = append(undos, func() {
+		delete(this.Sites, newName)
+		this.Sites[oldName] = raw
+		if this.Sources != nil {
+			this.Sources.Move([]string{"sites", newName}, []string{"sites", oldName})
+		}
+	})
+	return rollback, nil
+}
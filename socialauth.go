@@ -0,0 +1,189 @@
+package sites
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/moisespsena-go/stringvar"
+	"golang.org/x/oauth2"
+)
+
+const GoogleIssuer = "https://accounts.google.com"
+
+var (
+	githubEndpoint = oauth2.Endpoint{
+		AuthURL:  "https://github.com/login/oauth/authorize",
+		TokenURL: "https://github.com/login/oauth/access_token",
+	}
+	githubUserInfoURL = "https://api.github.com/user"
+)
+
+// SocialProvider is a OAuth2 social auth provider of a site.
+type SocialProvider interface {
+	// ProviderName returns the provider name namespaced by the site name, as `SITE_NAME/github`.
+	ProviderName() string
+	// OAuth2Config returns the OAuth2 config, with the redirect URL derived from the site mount of r.
+	OAuth2Config(ctx context.Context, r *http.Request) (*oauth2.Config, error)
+	// GetUserInfoURL returns the URL of the user info endpoint.
+	GetUserInfoURL(ctx context.Context) (string, error)
+}
+
+type OAuth2ProviderConfig struct {
+	Name         string   `mapstructure:"name"`
+	ClientID     string   `mapstructure:"client_id"`
+	ClientSecret string   `mapstructure:"client_secret"`
+	Scopes       []string `mapstructure:"scopes"`
+	AuthURL      string   `mapstructure:"auth_url"`
+	TokenURL     string   `mapstructure:"token_url"`
+	UserInfoURL  string   `mapstructure:"user_info_url"`
+	// RedirectPath relative to the site mount. Defaults to `/auth/PROVIDER/callback`.
+	RedirectPath string `mapstructure:"redirect_path"`
+
+	defaultName string
+}
+
+func (this *OAuth2ProviderConfig) GetDefaultName() string {
+	return this.defaultName
+}
+
+// Prepare namespaces the provider name by the site name and, if args is not
+// nil, expands the client credentials.
+func (this *OAuth2ProviderConfig) Prepare(siteName, defaultName string, args *stringvar.StringVar) {
+	this.defaultName = defaultName
+	if this.Name == "" {
+		this.Name = defaultName
+	}
+	this.Name = siteName + "/" + this.Name
+	if args != nil {
+		this.ClientID = args.Format(this.ClientID)
+		this.ClientSecret = args.Format(this.ClientSecret)
+	}
+	if this.RedirectPath == "" {
+		this.RedirectPath = "/auth/" + defaultName + "/callback"
+	}
+}
+
+func (this *OAuth2ProviderConfig) setDefaults(endpoint oauth2.Endpoint) {
+	if this.AuthURL == "" {
+		this.AuthURL = endpoint.AuthURL
+	}
+	if this.TokenURL == "" {
+		this.TokenURL = endpoint.TokenURL
+	}
+	if this.UserInfoURL == "" && endpoint == githubEndpoint {
+		this.UserInfoURL = githubUserInfoURL
+	}
+}
+
+func (this *OAuth2ProviderConfig) ProviderName() string {
+	return this.Name
+}
+
+// RedirectURL returns the callback URL under the site mount of r.
+func (this *OAuth2ProviderConfig) RedirectURL(r *http.Request) string {
+	return SiteURL(r, this.RedirectPath)
+}
+
+func (this *OAuth2ProviderConfig) OAuth2Config(ctx context.Context, r *http.Request) (*oauth2.Config, error) {
+	if this.AuthURL == "" || this.TokenURL == "" {
+		return nil, fmt.Errorf("social provider %q: auth_url and token_url are required", this.Name)
+	}
+	return &oauth2.Config{
+		ClientID:     this.ClientID,
+		ClientSecret: this.ClientSecret,
+		Scopes:       this.Scopes,
+		RedirectURL:  this.RedirectURL(r),
+		Endpoint:     oauth2.Endpoint{AuthURL: this.AuthURL, TokenURL: this.TokenURL},
+	}, nil
+}
+
+func (this *OAuth2ProviderConfig) GetUserInfoURL(ctx context.Context) (string, error) {
+	return this.UserInfoURL, nil
+}
+
+// OIDCDiscovery is the OpenID Connect provider metadata.
+type OIDCDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCProviderConfig is a OpenID Connect provider. The endpoints are discovered from the issuer.
+type OIDCProviderConfig struct {
+	OAuth2ProviderConfig `mapstructure:",squash"`
+	Issuer               string `mapstructure:"issuer"`
+	// HTTPClient used on discovery. Defaults to http.DefaultClient.
+	HTTPClient *http.Client `mapstructure:"-"`
+
+	mu        sync.Mutex
+	discovery *OIDCDiscovery
+}
+
+// Discover fetches (once) the provider metadata from the issuer.
+func (this *OIDCProviderConfig) Discover(ctx context.Context) (_ *OIDCDiscovery, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.discovery != nil {
+		return this.discovery, nil
+	}
+	if this.Issuer == "" {
+		return nil, fmt.Errorf("social provider %q: issuer is blank", this.Name)
+	}
+
+	client := this.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodGet, strings.TrimSuffix(this.Issuer, "/")+"/.well-known/openid-configuration", nil); err != nil {
+		return
+	}
+	var res *http.Response
+	if res, err = client.Do(req.WithContext(ctx)); err != nil {
+		return nil, fmt.Errorf("social provider %q: discovery failed: %v", this.Name, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("social provider %q: discovery failed: %s", this.Name, res.Status)
+	}
+	var discovery OIDCDiscovery
+	if err = json.NewDecoder(res.Body).Decode(&discovery); err != nil {
+		return nil, fmt.Errorf("social provider %q: decode discovery failed: %v", this.Name, err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(this.Issuer, "/") {
+		return nil, fmt.Errorf("social provider %q: issuer mismatch %q", this.Name, discovery.Issuer)
+	}
+	this.discovery = &discovery
+	return this.discovery, nil
+}
+
+func (this *OIDCProviderConfig) OAuth2Config(ctx context.Context, r *http.Request) (*oauth2.Config, error) {
+	discovery, err := this.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cfg := this.OAuth2ProviderConfig
+	cfg.setDefaults(oauth2.Endpoint{AuthURL: discovery.AuthorizationEndpoint, TokenURL: discovery.TokenEndpoint})
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	return cfg.OAuth2Config(ctx, r)
+}
+
+func (this *OIDCProviderConfig) GetUserInfoURL(ctx context.Context) (string, error) {
+	if this.UserInfoURL != "" {
+		return this.UserInfoURL, nil
+	}
+	discovery, err := this.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return discovery.UserInfoEndpoint, nil
+}
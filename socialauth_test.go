@@ -0,0 +1,105 @@
+package sites
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newOIDCStandIn starts a local OpenID Connect provider with discovery and a
+// token endpoint that accepts the code `good`.
+func newOIDCStandIn(t *testing.T, issuer string) *httptest.Server {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	if issuer == "" {
+		issuer = srv.URL
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(OIDCDiscovery{
+			Issuer:                issuer,
+			AuthorizationEndpoint: srv.URL + "/authorize",
+			TokenEndpoint:         srv.URL + "/token",
+			UserInfoEndpoint:      srv.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "good" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token-1","token_type":"bearer"}`))
+	})
+	return srv
+}
+
+func siteRequest(mount string) *http.Request {
+	r := httptest.NewRequest("GET", "http://shop.example.com"+mount+"/login", nil)
+	ctx := context.WithValue(r.Context(), RootPathKey, "")
+	ctx = context.WithValue(ctx, SiteMountKey, mount)
+	return r.WithContext(ctx)
+}
+
+func TestOIDCProviderStandIn(t *testing.T) {
+	srv := newOIDCStandIn(t, "")
+	defer srv.Close()
+
+	provider := &OIDCProviderConfig{Issuer: srv.URL}
+	provider.ClientID, provider.ClientSecret = "client", "secret"
+	provider.Prepare("shop", "acme", nil)
+	if name := provider.ProviderName(); name != "shop/acme" {
+		t.Errorf("name = %q", name)
+	}
+
+	ctx := context.Background()
+	cfg, err := provider.OAuth2Config(ctx, siteRequest("/shop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RedirectURL != "http://shop.example.com/shop/auth/acme/callback" {
+		t.Errorf("redirect URL = %q", cfg.RedirectURL)
+	}
+	if u := cfg.AuthCodeURL("state"); !strings.HasPrefix(u, srv.URL+"/authorize?") {
+		t.Errorf("auth code URL = %q", u)
+	}
+	token, err := cfg.Exchange(ctx, "good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "token-1" {
+		t.Errorf("access token = %q", token.AccessToken)
+	}
+	if _, err = cfg.Exchange(ctx, "bad"); err == nil {
+		t.Error("expected exchange error")
+	}
+	if u, err := provider.GetUserInfoURL(ctx); err != nil || u != srv.URL+"/userinfo" {
+		t.Errorf("user info URL = %q, %v", u, err)
+	}
+}
+
+func TestOIDCProviderIssuerMismatch(t *testing.T) {
+	srv := newOIDCStandIn(t, "https://other.example.com")
+	defer srv.Close()
+
+	provider := &OIDCProviderConfig{Issuer: srv.URL}
+	provider.Prepare("shop", "acme", nil)
+	if _, err := provider.Discover(context.Background()); err == nil {
+		t.Fatal("expected issuer mismatch")
+	}
+}
+
+func TestSiteURLUsesTheSiteMount(t *testing.T) {
+	r := siteRequest("/app/shop")
+	r.RequestURI = "/app/shop/a%2Fb?x=1"
+	r.URL.Path = "/a/b"
+	if u := SiteURL(r, "auth/github/callback"); u != "http://shop.example.com/app/shop/auth/github/callback" {
+		t.Errorf("SiteURL = %q", u)
+	}
+	if u := SiteURL(siteRequest(""), "/x"); u != "http://shop.example.com/x" {
+		t.Errorf("host mapped SiteURL = %q", u)
+	}
+}
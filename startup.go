@@ -0,0 +1,201 @@
+package sites
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ecletus/core"
+)
+
+// SiteError is the error of a site.
+type SiteError struct {
+	Site string
+	Err  error
+}
+
+func (this *SiteError) Error() string {
+	return fmt.Sprintf("Site %q: %v", this.Site, this.Err)
+}
+
+// SiteErrors are the errors of many sites, sorted by site name.
+type SiteErrors []*SiteError
+
+func (this SiteErrors) Error() string {
+	var msgs = make([]string, len(this))
+	for i, err := range this {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Err returns nil if has no errors.
+func (this SiteErrors) Err() error {
+	if len(this) == 0 {
+		return nil
+	}
+	return this
+}
+
+// Startup runs a task for many sites with a bounded number of workers.
+type Startup struct {
+	// Workers the max concurrent sites. Defaults to the number of CPUs.
+	Workers int
+}
+
+func NewStartup(workers int) *Startup {
+	return &Startup{Workers: workers}
+}
+
+func (this *Startup) workers(n int) int {
+	workers := this.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > n {
+		workers = n
+	}
+	return workers
+}
+
+// Each runs f for each site, logging the time of each one. All sites run, and
+// the errors are returned sorted by site name.
+func (this *Startup) Each(task string, sites []*core.Site, f func(site *core.Site) error) error {
+	if len(sites) == 0 {
+		return nil
+	}
+	var (
+		start   = time.Now()
+		queue   = make(chan *core.Site)
+		mu      sync.Mutex
+		errs    SiteErrors
+		wg      sync.WaitGroup
+		workers = this.workers(len(sites))
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for site := range queue {
+				siteStart := time.Now()
+				err := f(site)
+				if err != nil {
+					log.Errorf("[%s] %s failed in %s", site.Name(), task, time.Since(siteStart))
+					mu.Lock()
+					errs = append(errs, &SiteError{site.Name(), err})
+					mu.Unlock()
+				} else {
+					log.Infof("[%s] %s done in %s", site.Name(), task, time.Since(siteStart))
+				}
+			}
+		}()
+	}
+	for _, site := range sites {
+		queue <- site
+	}
+	close(queue)
+	wg.Wait()
+
+	log.Infof("%s: %d sites done in %s with %d workers (%d failed)", task, len(sites), time.Since(start), workers, len(errs))
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Site < errs[j].Site
+	})
+	return errs.Err()
+}
+
+// Run runs f for each registered site, as Each. The lazy sites not loaded run
+// f on their first use, after their initialization.
+func (this *Startup) Run(task string, sites *SitesRouter, f func(site *core.Site) error) error {
+	var (
+		loaded []*core.Site
+		errs   SiteErrors
+	)
+	sites.Register.ByName.Each(func(site *core.Site) error {
+		if sites.Lazy != nil && !sites.Lazy.Loaded(site.Name()) {
+			// runs now if loaded meanwhile
+			if err := sites.Lazy.Defer(site.Name(), func() error {
+				return f(site)
+			}); err != nil {
+				errs = append(errs, &SiteError{site.Name(), err})
+			}
+			return nil
+		}
+		loaded = append(loaded, site)
+		return nil
+	})
+	if err := this.Each(task, loaded, f); err != nil {
+		errs = append(errs, err.(SiteErrors)...)
+		sort.Slice(errs, func(i, j int) bool {
+			return errs[i].Site < errs[j].Site
+		})
+	}
+	return errs.Err()
+}
+
+// Init initializes the registered sites with the workers, and the sites added
+// later on add.
+func (this *Startup) Init(register *core.SitesRegister, initSite func(site *core.Site) error) error {
+	var (
+		mu      sync.Mutex
+		booting = true
+		// the sites of the boot, skipped by the hook if added concurrently
+		boot = map[string]bool{}
+	)
+	register.OnAdd(func(site *core.Site) {
+		mu.Lock()
+		if booting || boot[site.Name()] {
+			delete(boot, site.Name())
+			mu.Unlock()
+			return
+		}
+		mu.Unlock()
+		if err := initSite(site); err != nil {
+			log.Errorf("[%s] init failed: %v", site.Name(), err)
+		}
+	})
+	var sites []*core.Site
+	mu.Lock()
+	booting = false
+	register.ByName.Each(func(site *core.Site) error {
+		boot[site.Name()] = true
+		sites = append(sites, site)
+		return nil
+	})
+	mu.Unlock()
+	return this.Each("init", sites, initSite)
+}
+
+// KeyLocks are mutexes by key, as to serialize the tasks of the sites on the
+// same DB.
+type KeyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// Lock locks the key, waiting until unlocked by other.
+func (this *KeyLocks) Lock(key string) (unlock func()) {
+	this.mu.Lock()
+	if this.locks == nil {
+		this.locks = map[string]*sync.Mutex{}
+	}
+	l := this.locks[key]
+	if l == nil {
+		l = &sync.Mutex{}
+		this.locks[key] = l
+	}
+	this.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// DBLockKey returns the key of the physical DB of the site DB: the sites of a
+// shared DB have the same key.
+func DBLockKey(site *core.Site, dbName string) string {
+	if cfg := site.Config().Db[dbName]; cfg != nil {
+		return fmt.Sprintf("%s://%s:%v/%s", cfg.Adapter, cfg.Host, cfg.Port, cfg.Name)
+	}
+	return site.Name() + "/" + dbName
+}
@@ -0,0 +1,183 @@
+package sites
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ecletus/core"
+	"github.com/ecletus/core/db/dbconfig"
+	"github.com/ecletus/core/site_config"
+)
+
+func TestStartupEach(t *testing.T) {
+	var (
+		sites   []*core.Site
+		mu      sync.Mutex
+		ran     = map[string]bool{}
+		running int32
+		max     int32
+	)
+	for _, name := range []string{"e", "d", "c", "b", "a"} {
+		sites = append(sites, newTestSite(name, nil))
+	}
+	err := NewStartup(2).Each("test", sites, func(site *core.Site) error {
+		if n := atomic.AddInt32(&running, 1); n > atomic.LoadInt32(&max) {
+			atomic.StoreInt32(&max, n)
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		mu.Lock()
+		ran[site.Name()] = true
+		mu.Unlock()
+		if site.Name() != "c" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if len(ran) != len(sites) {
+		t.Errorf("ran %v", ran)
+	}
+	if max > 2 {
+		t.Errorf("%d sites ran concurrently", max)
+	}
+	errs, ok := err.(SiteErrors)
+	if !ok || len(errs) != 4 {
+		t.Fatalf("err = %v", err)
+	}
+	for i, name := range []string{"a", "b", "d", "e"} {
+		if errs[i].Site != name {
+			t.Errorf("errs[%d] = %q, expected %q", i, errs[i].Site, name)
+		}
+	}
+
+	if err := NewStartup(2).Each("test", sites, func(*core.Site) error { return nil }); err != nil {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestKeyLocks(t *testing.T) {
+	var (
+		locks   KeyLocks
+		wg      sync.WaitGroup
+		running = map[string]*int32{"a": new(int32), "b": new(int32)}
+		failed  int32
+	)
+	for i := 0; i < 10; i++ {
+		for key := range running {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				defer locks.Lock(key)()
+				if atomic.AddInt32(running[key], 1) > 1 {
+					atomic.StoreInt32(&failed, 1)
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(running[key], -1)
+			}(key)
+		}
+	}
+	wg.Wait()
+	if failed != 0 {
+		t.Error("the same key was locked concurrently")
+	}
+}
+
+func TestDBLockKey(t *testing.T) {
+	site := func(name string, cfg *dbconfig.DBConfig) *core.Site {
+		return core.NewSite(name, site_config.Config{Db: map[string]*dbconfig.DBConfig{"default": cfg}}, nil, nil)
+	}
+	a := site("a", &dbconfig.DBConfig{Adapter: "postgres", Host: "db", User: "a", Name: "shared"})
+	b := site("b", &dbconfig.DBConfig{Adapter: "postgres", Host: "db", User: "b", Name: "shared"})
+	c := site("c", &dbconfig.DBConfig{Adapter: "postgres", Host: "db", User: "c", Name: "c"})
+	if DBLockKey(a, "default") != DBLockKey(b, "default") {
+		t.Errorf("the sites of the shared DB have other keys: %q, %q", DBLockKey(a, "default"), DBLockKey(b, "default"))
+	}
+	if DBLockKey(a, "default") == DBLockKey(c, "default") {
+		t.Errorf("the sites of other DBs have the same key %q", DBLockKey(a, "default"))
+	}
+	if key := DBLockKey(a, "other"); key != "a/other" {
+		t.Errorf("key of DB without config = %q", key)
+	}
+}
+
+func TestStartupRunLazy(t *testing.T) {
+	register := &core.SitesRegister{}
+	for _, name := range []string{"a", "b"} {
+		if err := register.Add(newTestSite(name, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var (
+		mu    sync.Mutex
+		inits = map[string]int{}
+		runs  = map[string]int{}
+	)
+	sites := NewSitesRouter(register, nil)
+	sites.Lazy = NewLazySites(func(site *core.Site) error {
+		mu.Lock()
+		defer mu.Unlock()
+		inits[site.Name()]++
+		return nil
+	})
+	// the boot: the DB events of the lazy sites are deferred
+	if err := NewStartup(2).Run("migrate", sites, func(site *core.Site) error {
+		mu.Lock()
+		defer mu.Unlock()
+		runs[site.Name()]++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(inits) != 0 || len(runs) != 0 {
+		t.Fatalf("booted lazy sites: inits %v, runs %v", inits, runs)
+	}
+
+	// the first request
+	site, _ := register.ByName.Get("a")
+	if err := sites.Lazy.Ensure(site); err != nil {
+		t.Fatal(err)
+	}
+	if inits["a"] != 1 || runs["a"] != 1 || inits["b"] != 0 || runs["b"] != 0 {
+		t.Errorf("inits %v, runs %v", inits, runs)
+	}
+}
+
+func TestStartupInit(t *testing.T) {
+	register := &core.SitesRegister{}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := register.Add(newTestSite(name, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var (
+		mu    sync.Mutex
+		inits = map[string]int{}
+	)
+	initSite := func(site *core.Site) error {
+		mu.Lock()
+		defer mu.Unlock()
+		inits[site.Name()]++
+		if site.Name() == "c" {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	err := NewStartup(2).Init(register, initSite)
+	if errs, ok := err.(SiteErrors); !ok || len(errs) != 1 || errs[0].Site != "c" {
+		t.Errorf("err = %v", err)
+	}
+	if inits["a"] != 1 || inits["b"] != 1 || inits["c"] != 1 {
+		t.Errorf("inits of the boot sites = %v", inits)
+	}
+
+	// the site added after the boot is initialized on add
+	if err := register.Add(newTestSite("d", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if len(inits) != 4 || inits["d"] != 1 || inits["a"] != 1 {
+		t.Errorf("inits = %v", inits)
+	}
+}
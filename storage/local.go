@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moisespsena-go/maps"
+)
+
+func init() {
+	Register("local", func(env Env, options maps.MapSI) (Storage, error) {
+		pth, _ := options["path"].(string)
+		if pth == "" {
+			pth = env.StorageName
+		}
+		if !filepath.IsAbs(pth) {
+			root := filepath.Clean(env.Root)
+			if pth = filepath.Join(root, pth); !strings.HasPrefix(pth, root+string(filepath.Separator)) {
+				return nil, fmt.Errorf("path %q escapes the site uploads dir", options["path"])
+			}
+		}
+		return NewLocal(pth)
+	})
+}
+
+// Local stores the files in the dir Root.
+type Local struct {
+	Root string
+}
+
+func NewLocal(root string) (*Local, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &Local{filepath.Clean(root)}, nil
+}
+
+// Path returns the file path of key.
+func (this *Local) Path(key string) (string, error) {
+	pth := filepath.Join(this.Root, filepath.FromSlash(key))
+	if !strings.HasPrefix(pth, this.Root+string(filepath.Separator)) {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	return pth, nil
+}
+
+func (this *Local) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (err error) {
+	var pth string
+	if pth, err = this.Path(key); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return
+	}
+	// a temp file per put: the concurrent puts of the key do not write the same file
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Dir(pth), "."+filepath.Base(pth)+".*.tmp"); err != nil {
+		return
+	}
+	if err = f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	return os.Rename(f.Name(), pth)
+}
+
+func (this *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	pth, err := this.Path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(pth)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (this *Local) Delete(ctx context.Context, key string) error {
+	pth, err := this.Path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(pth); os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (this *Local) Exists(ctx context.Context, key string) (bool, error) {
+	pth, err := this.Path(key)
+	if err != nil {
+		return false, err
+	}
+	if _, err = os.Stat(pth); err == nil {
+		return true, nil
+	} else if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestLocalConcurrentPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local, err := NewLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		ctx = context.Background()
+		wg  sync.WaitGroup
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := bytes.Repeat([]byte(fmt.Sprint(i%10)), 64*1024)
+			if err := local.Put(ctx, "a/file", bytes.NewReader(data), int64(len(data)), ""); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "a", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 64*1024 || !bytes.Equal(data, bytes.Repeat(data[:1], len(data))) {
+		t.Fatal("mixed content of concurrent puts")
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Join(dir, "a")); len(entries) != 1 {
+		t.Fatalf("temp files left: %v", entries)
+	}
+}
+
+func TestLocalNotFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local, err := NewLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err = local.Get(ctx, "x"); err != ErrNotFound {
+		t.Errorf("Get = %v, want ErrNotFound", err)
+	}
+	if err = local.Delete(ctx, "x"); err != ErrNotFound {
+		t.Errorf("Delete = %v, want ErrNotFound", err)
+	}
+	if err = local.Put(ctx, "../x", bytes.NewReader(nil), 0, ""); err == nil {
+		t.Error("put a key out of the root")
+	}
+}
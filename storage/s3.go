@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/moisespsena-go/maps"
+)
+
+func init() {
+	Register("s3", func(env Env, options maps.MapSI) (Storage, error) {
+		var (
+			endpoint, _  = options["endpoint"].(string)
+			bucket, _    = options["bucket"].(string)
+			region, _    = options["region"].(string)
+			accessKey, _ = options["access_key"].(string)
+			secretKey, _ = options["secret_key"].(string)
+			prefix, _    = options["prefix"].(string)
+			useSSL       = true
+		)
+		if v, ok := options["use_ssl"].(bool); ok {
+			useSSL = v
+		}
+		if endpoint == "" || bucket == "" {
+			return nil, fmt.Errorf("`endpoint` and `bucket` options are required")
+		}
+		return NewS3(endpoint, bucket, &minio.Options{
+			Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+			Secure: useSSL,
+			Region: region,
+		}, prefix)
+	})
+}
+
+// S3 stores the files in a bucket of a S3 compatible server, as AWS S3 or MinIO.
+type S3 struct {
+	Client *minio.Client
+	Bucket string
+	// Prefix of the object names
+	Prefix string
+}
+
+func NewS3(endpoint, bucket string, options *minio.Options, prefix string) (*S3, error) {
+	client, err := minio.New(endpoint, options)
+	if err != nil {
+		return nil, err
+	}
+	return &S3{client, bucket, strings.Trim(prefix, "/")}, nil
+}
+
+func (this *S3) objectName(key string) (string, error) {
+	name := path.Clean("/" + key)[1:]
+	if name == "" || name != strings.TrimPrefix(key, "/") {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	if this.Prefix != "" {
+		name = this.Prefix + "/" + name
+	}
+	return name, nil
+}
+
+func (this *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	name, err := this.objectName(key)
+	if err != nil {
+		return err
+	}
+	_, err = this.Client.PutObject(ctx, this.Bucket, name, r, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (this *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	name, err := this.objectName(key)
+	if err != nil {
+		return nil, err
+	}
+	// GetObject does not request the object, stat it to report ErrNotFound
+	if _, err = this.Client.StatObject(ctx, this.Bucket, name, minio.StatObjectOptions{}); err != nil {
+		if isNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return this.Client.GetObject(ctx, this.Bucket, name, minio.GetObjectOptions{})
+}
+
+func (this *S3) Delete(ctx context.Context, key string) error {
+	name, err := this.objectName(key)
+	if err != nil {
+		return err
+	}
+	// RemoveObject does not fail if the object does not exist
+	if _, err = this.Client.StatObject(ctx, this.Bucket, name, minio.StatObjectOptions{}); err != nil {
+		if isNotFound(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return this.Client.RemoveObject(ctx, this.Bucket, name, minio.RemoveObjectOptions{})
+}
+
+func (this *S3) Exists(ctx context.Context, key string) (bool, error) {
+	name, err := this.objectName(key)
+	if err != nil {
+		return false, err
+	}
+	if _, err = this.Client.StatObject(ctx, this.Bucket, name, minio.StatObjectOptions{}); err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func isNotFound(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+func TestS3DeleteNotFound(t *testing.T) {
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodHead:
+			if strings.HasSuffix(r.URL.Path, "/exists") {
+				w.Header().Set("Last-Modified", "Mon, 19 Oct 2026 10:00:00 GMT")
+				w.Header().Set("ETag", `"x"`)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		case http.MethodDelete:
+			deleted = append(deleted, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	defer server.Close()
+
+	s3, err := NewS3(strings.TrimPrefix(server.URL, "http://"), "bucket", &minio.Options{
+		Creds:  credentials.NewStaticV4("key", "secret", ""),
+		Region: "us-east-1",
+	}, "site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = s3.Delete(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("Delete = %v, want ErrNotFound", err)
+	}
+	if err = s3.Delete(ctx, "exists"); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != "/bucket/site/exists" {
+		t.Errorf("deleted = %v", deleted)
+	}
+}
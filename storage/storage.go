@@ -0,0 +1,73 @@
+// Package storage stores the files of the sites in pluggable backends, as
+// the local file system or a S3 compatible bucket.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/moisespsena-go/maps"
+)
+
+// ErrNotFound is returned when the key is not stored.
+var ErrNotFound = errors.New("storage: not found")
+
+// Storage stores files by key. The keys are slash separated paths.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	Exists(ctx context.Context, key string) (bool, error)
+}
+
+// Config is a named storage of the `storages` key of the site config.
+type Config struct {
+	// Type of the storage. The builtin types are `local` and `s3`.
+	Type    string     `mapstructure:"type"`
+	Options maps.MapSI `mapstructure:",remain"`
+}
+
+// Env is the environment of the storage being created.
+type Env struct {
+	SiteName    string
+	StorageName string
+	// Root the site uploads dir, where the local storages are created
+	Root string
+}
+
+// Factory creates a storage with the options.
+type Factory func(env Env, options maps.MapSI) (Storage, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{}
+)
+
+// Register registers the storage factory by type.
+func Register(typ string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[typ] = factory
+}
+
+// New creates the storage of the config.
+func New(env Env, config *Config) (Storage, error) {
+	typ := config.Type
+	if typ == "" {
+		typ = "local"
+	}
+	factoriesMu.RLock()
+	factory, ok := factories[typ]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("storage type %q is not registered", typ)
+	}
+	s, err := factory(env, config.Options)
+	if err != nil {
+		return nil, fmt.Errorf("storage %q: %v", env.StorageName, err)
+	}
+	return s, nil
+}
@@ -0,0 +1,108 @@
+package sites
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ecletus/core"
+
+	"github.com/ecletus/sites/storage"
+)
+
+// StoragesConfigKey is the site config key of the named storages:
+//
+//	storages:
+//	  default:
+//	    type: local        # under the site uploads dir
+//	  media:
+//	    type: s3
+//	    endpoint: localhost:9000
+//	    bucket: media
+//	    access_key: !secret minio/access_key
+//	    secret_key: !secret minio/secret_key
+//	    use_ssl: false
+const StoragesConfigKey = "storages"
+
+// DefaultStorageName is the storage of the sites. If not declared, it is a
+// local storage in the `default` dir of the site uploads dir.
+const DefaultStorageName = "default"
+
+// Storages resolves the named storages of the sites.
+type Storages struct {
+	Config *Config
+
+	mu       sync.Mutex
+	storages map[string]storage.Storage
+}
+
+func NewStorages(config *Config) *Storages {
+	return &Storages{Config: config, storages: map[string]storage.Storage{}}
+}
+
+// Configs returns the storages declared by the site.
+func (this *Storages) Configs(site *core.Site) (configs map[string]*storage.Config, err error) {
+	if _, err = DecodeSiteConfig(site, StoragesConfigKey, &configs); err != nil {
+		return nil, fmt.Errorf("decode storages config: %v", err)
+	}
+	if configs == nil {
+		configs = map[string]*storage.Config{}
+	}
+	if configs[DefaultStorageName] == nil {
+		configs[DefaultStorageName] = &storage.Config{Type: "local"}
+	}
+	return
+}
+
+// Names returns the sorted names of the storages of the site.
+func (this *Storages) Names(site *core.Site) (names []string, err error) {
+	var configs map[string]*storage.Config
+	if configs, err = this.Configs(site); err != nil {
+		return
+	}
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Get returns the storage of the site by name.
+func (this *Storages) Get(site *core.Site, name string) (s storage.Storage, err error) {
+	key := SiteStorageName(site.Name(), name)
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if s = this.storages[key]; s != nil {
+		return
+	}
+	var configs map[string]*storage.Config
+	if configs, err = this.Configs(site); err != nil {
+		return
+	}
+	cfg := configs[name]
+	if cfg == nil {
+		return nil, fmt.Errorf("storage %q is not declared", name)
+	}
+	env := storage.Env{SiteName: site.Name(), StorageName: name}
+	if env.Root, err = this.Config.SiteDirs(site.Name()).Uploads(); err != nil {
+		return
+	}
+	if s, err = storage.New(env, cfg); err != nil {
+		return
+	}
+	this.storages[key] = s
+	return
+}
+
+// Forget drops the storages of the site.
+func (this *Storages) Forget(site *core.Site) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	prefix := SiteStorageName(site.Name(), "")
+	for key := range this.storages {
+		if strings.HasPrefix(key, prefix) {
+			delete(this.storages, key)
+		}
+	}
+}